@@ -2,18 +2,19 @@ package buildtree
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"html/template"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/anduintransaction/doriath/utils"
-	"github.com/joho/godotenv"
 	"github.com/palantir/stacktrace"
 	yaml "gopkg.in/yaml.v2"
 )
@@ -24,22 +25,57 @@ type BuildTree struct {
 	pull        []string
 	rootNodes   []*buildNode
 	allNodes    map[string]*buildNode
+	sortedNodes []*buildNode
 	credentials map[string]*credentialConfig
+	builder     utils.Builder
+	// newRegistry creates the client of a registry, registries holds the
+	// clients already created by credential name
+	newRegistry func(credential *utils.DockerCredential, optFns ...utils.RegistryOptFn) (utils.Registry, error)
+	registries  map[string]utils.Registry
+	// retry is used for registry requests and pushes, requestTimeout for
+	// registry requests
+	retry          *utils.RetryPolicy
+	requestTimeout time.Duration
+	// dockerConfigDir holds the docker config used for registries missing
+	// from credentials, read once when first needed
+	dockerConfigDir string
+	dockerConfig    *utils.DockerConfig
+	// isolateDockerConfig makes Push log into registries in a temporary
+	// docker config instead of the docker config of the user
+	isolateDockerConfig bool
+	// variables are the variables of the config files, with the defaults of
+	// declared variables
+	variables *variableValues
+	// profile is the profile applied, profileChanges the values it set
+	profile        string
+	profileChanges []string
 }
 
 type buildNode struct {
+	// rootDir is the root dir of the config file declaring the node
+	rootDir    string
 	buildRoot  string
 	name       string
 	alias      string
 	tag        string
-	depend     string
+	depend     []string
 	preBuild   string
 	postBuild  string
+	parents    []*buildNode
 	children   []*buildNode
 	dirty      bool
 	forceBuild bool
 	pushLatest bool
 	platforms  []string
+	dockerfile string
+	target     string
+	buildArgs  map[string]string
+	labels     map[string]string
+	// contextHash is the hash of the build context and of the parent context
+	contextHash string
+	// imageID and digest are set by the builder once the image is built and pushed
+	imageID string
+	digest  string
 }
 
 func (n buildNode) PullableName() string {
@@ -54,6 +90,15 @@ func (n buildNode) DisplayName() string {
 	return ret
 }
 
+func (n buildNode) hasParent(parent *buildNode) bool {
+	for _, p := range n.parents {
+		if p == parent {
+			return true
+		}
+	}
+	return false
+}
+
 func (n buildNode) GetNameOrAlias() string {
 	if n.alias != "" {
 		return n.alias
@@ -62,23 +107,82 @@ func (n buildNode) GetNameOrAlias() string {
 }
 
 type config struct {
-	RootDir     string              `yaml:"root_dir"`
-	Pull        []string            `yaml:"pull"`
-	Build       []*buildNodeConfig  `yaml:"build"`
-	Credentials []*credentialConfig `yaml:"credentials"`
+	RootDir              string              `yaml:"root_dir"`
+	Include              stringList          `yaml:"include"`
+	Variables            []*Variable         `yaml:"variables"`
+	Builder              string              `yaml:"builder"`
+	Retry                retryConfig         `yaml:"retry"`
+	RequestTimeout       time.Duration       `yaml:"request_timeout"`
+	IsolatedDockerConfig *bool               `yaml:"isolated_docker_config"`
+	SecretVariables      []string            `yaml:"secret_variables"`
+	Pull                 []string            `yaml:"pull"`
+	Build                []*buildNodeConfig  `yaml:"build"`
+	Credentials          []*credentialConfig `yaml:"credentials"`
+	// Profiles are applied before decoding the config
+	Profiles map[string]*profileConfig `yaml:"profiles"`
+	// profileFound tells if the file declares the profile applied,
+	// profileChanges holds the values it set
+	profileFound   bool
+	profileChanges []string
 }
 
 type buildNodeConfig struct {
-	Name       string   `yaml:"name"`
-	Alias      string   `yaml:"alias"`
-	From       string   `yaml:"from"`
-	Tag        string   `yaml:"tag"`
-	Depend     string   `yaml:"depend"`
-	PreBuild   string   `yaml:"pre_build"`
-	PostBuild  string   `yaml:"post_build"`
-	ForceBuild bool     `yaml:"force_build"`
-	PushLatest bool     `yaml:"push_latest"`
-	Platforms  []string `yaml:"platforms"`
+	Name       string            `yaml:"name"`
+	Alias      string            `yaml:"alias"`
+	From       string            `yaml:"from"`
+	Tag        string            `yaml:"tag"`
+	Depend     stringList        `yaml:"depend"`
+	PreBuild   string            `yaml:"pre_build"`
+	PostBuild  string            `yaml:"post_build"`
+	ForceBuild bool              `yaml:"force_build"`
+	PushLatest bool              `yaml:"push_latest"`
+	Platforms  []string          `yaml:"platforms"`
+	Dockerfile string            `yaml:"dockerfile"`
+	Target     string            `yaml:"target"`
+	BuildArgs  map[string]string `yaml:"build_args"`
+	Labels     map[string]string `yaml:"labels"`
+}
+
+type retryConfig struct {
+	Attempts     int           `yaml:"attempts"`
+	InitialDelay time.Duration `yaml:"initial_delay"`
+	MaxDelay     time.Duration `yaml:"max_delay"`
+}
+
+// retryPolicy returns the retry policy, using defaults for missing values
+func (c retryConfig) retryPolicy() *utils.RetryPolicy {
+	policy := utils.DefaultRetryPolicy()
+	if c.Attempts > 0 {
+		policy.Attempts = c.Attempts
+	}
+	if c.InitialDelay > 0 {
+		policy.InitialDelay = c.InitialDelay
+	}
+	if c.MaxDelay > 0 {
+		policy.MaxDelay = c.MaxDelay
+	}
+	return policy
+}
+
+// stringList is a list of strings which can also be written as a single string
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err == nil {
+		if value == "" {
+			*l = nil
+		} else {
+			*l = stringList{value}
+		}
+		return nil
+	}
+	var values []string
+	if err := unmarshal(&values); err != nil {
+		return err
+	}
+	*l = values
+	return nil
 }
 
 type credentialConfig struct {
@@ -89,99 +193,446 @@ type credentialConfig struct {
 	PasswordFile  string `yaml:"password_file"`
 	HTTPToken     string `yaml:"http_token"`
 	ChallengeType string `yaml:"challenge_type"`
+	CAFile        string `yaml:"ca_file"`
+	ClientCert    string `yaml:"client_cert"`
+	ClientKey     string `yaml:"client_key"`
+	Insecure      bool   `yaml:"insecure"`
+	// Type is empty for a static credential, or the kind of registry providing
+	// tokens: ecr, gcp_service_account or acr
+	Type string `yaml:"type"`
+	// Account, Region and Profile are the settings of ecr credentials
+	Account string `yaml:"account"`
+	Region  string `yaml:"region"`
+	Profile string `yaml:"profile"`
+	// Endpoint replaces the ECR API endpoint, the GCP token URL or the Azure
+	// AD authority
+	Endpoint string `yaml:"endpoint"`
+	// KeyFile and Scope are the settings of gcp_service_account credentials
+	KeyFile string `yaml:"key_file"`
+	Scope   string `yaml:"scope"`
+	// Tenant, ClientID, ClientSecret and RefreshToken are the settings of acr
+	// credentials
+	Tenant       string `yaml:"tenant"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	RefreshToken string `yaml:"refresh_token"`
+	provider     utils.CredentialProvider
+}
+
+// Credential types
+const (
+	credentialTypeECR               = "ecr"
+	credentialTypeGCPServiceAccount = "gcp_service_account"
+	credentialTypeACR               = "acr"
+)
+
+func (c *credentialConfig) dockerCredential() *utils.DockerCredential {
+	return &utils.DockerCredential{
+		Registry:      c.Registry,
+		Username:      c.Username,
+		Password:      c.Password,
+		HTTPToken:     c.HTTPToken,
+		ChallengeType: c.ChallengeType,
+		CAFile:        c.CAFile,
+		ClientCert:    c.ClientCert,
+		ClientKey:     c.ClientKey,
+		Insecure:      c.Insecure,
+		Provider:      c.provider,
+	}
+}
+
+// hasSecret checks if the credential authenticates by itself, otherwise the
+// docker config is used
+func (c *credentialConfig) hasSecret() bool {
+	return c.Username != "" || c.Password != "" || c.HTTPToken != "" || c.provider != nil
 }
 
-// ReadBuildTree reads a build tree from reader
-func ReadBuildTree(r io.Reader, variableMap map[string]string, variableFiles []string) (*BuildTree, error) {
+// ReadBuildTree reads a build tree from reader, included files are relative
+// to the current folder
+func ReadBuildTree(r io.Reader, variableMap map[string]string, variableFiles []string, optFns ...ReadOptFn) (*BuildTree, error) {
 	fileContent, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "Cannot read build content")
 	}
-	return readBuildTree("", fileContent, variableMap, variableFiles)
+	loader, err := newConfigLoader(variableMap, variableFiles, optFns)
+	if err != nil {
+		return nil, err
+	}
+	err = loader.load("", fileContent)
+	if err != nil {
+		return nil, err
+	}
+	return readBuildTree(loader)
 }
 
 // ReadBuildTreeFromFile reads BuildTree from a build file
-func ReadBuildTreeFromFile(buildFile string, variableMap map[string]string, variableFiles []string) (*BuildTree, error) {
-	fileContent, err := ioutil.ReadFile(buildFile)
+func ReadBuildTreeFromFile(buildFile string, variableMap map[string]string, variableFiles []string, optFns ...ReadOptFn) (*BuildTree, error) {
+	return ReadBuildTreeFromFiles([]string{buildFile}, variableMap, variableFiles, optFns...)
+}
+
+// ReadBuildTreeFromFiles reads BuildTree from several build files, which are
+// merged like included files. Settings other than build, pull and
+// credentials can only be set in the first file.
+func ReadBuildTreeFromFiles(buildFiles []string, variableMap map[string]string, variableFiles []string, optFns ...ReadOptFn) (*BuildTree, error) {
+	if len(buildFiles) == 0 {
+		return nil, stacktrace.NewError("No build file")
+	}
+	loader, err := newConfigLoader(variableMap, variableFiles, optFns)
 	if err != nil {
-		return nil, stacktrace.Propagate(err, "Cannot read build file %q", buildFile)
+		return nil, err
 	}
-	return readBuildTree(buildFile, fileContent, variableMap, variableFiles)
+	for _, buildFile := range buildFiles {
+		err := loader.loadFile(buildFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return readBuildTree(loader)
 }
 
-func readBuildTree(configFilePath string, fileContent []byte, variableMap map[string]string, variableFiles []string) (*BuildTree, error) {
-	buildConfig, err := readBuildConfig(fileContent, variableMap, variableFiles)
+func readBuildTree(loader *configLoader) (*BuildTree, error) {
+	if loader.profile != "" && !loader.profileFound {
+		return nil, stacktrace.Propagate(ErrUnknownProfile{loader.profile}, "Profile %q is not declared", loader.profile)
+	}
+	files := loader.files
+	buildConfig := files[0].config
+	builder, err := utils.NewBuilder(buildConfig.Builder)
 	if err != nil {
 		return nil, err
 	}
-	configFileFolder := filepath.Dir(configFilePath)
 	buildTree := &BuildTree{
-		rootDir:     filepath.Join(configFileFolder, buildConfig.RootDir),
-		pull:        buildConfig.Pull,
-		rootNodes:   []*buildNode{},
-		allNodes:    make(map[string]*buildNode),
-		credentials: make(map[string]*credentialConfig),
-	}
-	for _, buildNodeConfig := range buildConfig.Build {
-		node := &buildNode{
-			buildRoot:  utils.ResolveDir(buildTree.rootDir, buildNodeConfig.From),
-			name:       buildNodeConfig.Name,
-			alias:      buildNodeConfig.Alias,
-			tag:        buildNodeConfig.Tag,
-			depend:     buildNodeConfig.Depend,
-			preBuild:   buildNodeConfig.PreBuild,
-			postBuild:  buildNodeConfig.PostBuild,
-			children:   []*buildNode{},
-			dirty:      false,
-			forceBuild: buildNodeConfig.ForceBuild,
-			pushLatest: buildNodeConfig.PushLatest,
-			platforms:  buildNodeConfig.Platforms,
-		}
-		buildTree.allNodes[node.GetNameOrAlias()] = node
-	}
-	for _, credential := range buildConfig.Credentials {
-		resolvedCredential, err := resolveCredential(credential, buildTree.rootDir)
-		if err != nil {
-			return nil, err
+		rootDir:         files[0].rootDir,
+		variables:       loader.variables,
+		profile:         loader.profile,
+		profileChanges:  loader.profileChanges,
+		pull:            []string{},
+		rootNodes:       []*buildNode{},
+		allNodes:        make(map[string]*buildNode),
+		credentials:     make(map[string]*credentialConfig),
+		builder:         builder,
+		newRegistry:     utils.NewRegistry,
+		registries:      make(map[string]utils.Registry),
+		dockerConfigDir: utils.DockerConfigDir(),
+		retry:           buildConfig.Retry.retryPolicy(),
+		requestTimeout:  buildConfig.RequestTimeout,
+	}
+	if buildTree.requestTimeout <= 0 {
+		buildTree.requestTimeout = utils.DefaultRegistryTimeout
+	}
+	// Defaults to true in continuous integrations
+	buildTree.isolateDockerConfig = utils.IsCI()
+	if buildConfig.IsolatedDockerConfig != nil {
+		buildTree.isolateDockerConfig = *buildConfig.IsolatedDockerConfig
+	}
+	// Files declaring each node and credential, to report duplicates
+	nodeFiles := make(map[string]string)
+	// Keys of the nodes in declaration order, and by image name
+	nodeKeys := []string{}
+	imageKeys := make(map[string]string)
+	credentialFiles := make(map[string]string)
+	pulled := make(utils.StringSet)
+	for i, file := range files {
+		if i > 0 {
+			err := checkIncludedConfig(file.config, file.displayName())
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, image := range file.config.Pull {
+			if !pulled.Exists(image) {
+				pulled.Add(image)
+				buildTree.pull = append(buildTree.pull, image)
+			}
+		}
+		for _, buildNodeConfig := range file.config.Build {
+			err := checkBuildNodeConfig(buildNodeConfig, file.displayName())
+			if err != nil {
+				return nil, err
+			}
+			node := newBuildNode(file.rootDir, buildNodeConfig)
+			name := node.GetNameOrAlias()
+			if otherFile, ok := nodeFiles[name]; ok {
+				return nil, stacktrace.Propagate(ErrDuplicateImage{name, otherFile, file.displayName()}, "Image %q is declared twice", name)
+			}
+			nodeFiles[name] = file.displayName()
+			buildTree.allNodes[name] = node
+			nodeKeys = append(nodeKeys, name)
+			if _, ok := imageKeys[node.name]; !ok {
+				imageKeys[node.name] = name
+			}
+		}
+		for _, credential := range file.config.Credentials {
+			resolvedCredential, err := resolveCredential(credential, file.rootDir)
+			if err != nil {
+				return nil, err
+			}
+			name := resolvedCredential.Name
+			if name == "" {
+				return nil, stacktrace.NewError("Missing name of a credential in %q", file.displayName())
+			}
+			if otherFile, ok := credentialFiles[name]; ok {
+				return nil, stacktrace.Propagate(ErrDuplicateCredential{name, otherFile, file.displayName()}, "Credential %q is declared twice", name)
+			}
+			credentialFiles[name] = file.displayName()
+			buildTree.credentials[name] = resolvedCredential
+		}
+	}
+	// An alias cannot be the name of another image, depend would be ambiguous
+	for _, key := range nodeKeys {
+		node := buildTree.allNodes[key]
+		if otherKey, ok := imageKeys[node.alias]; ok && otherKey != key {
+			return nil, stacktrace.Propagate(ErrDuplicateImage{node.alias, nodeFiles[otherKey], nodeFiles[key]}, "Alias %q is the name of another image", node.alias)
 		}
-		buildTree.credentials[credential.Name] = resolvedCredential
 	}
 	return buildTree, nil
 }
 
-func readBuildConfig(fileContent []byte, variableMap map[string]string, variableFiles []string) (*config, error) {
-	variablesFromFiles := make(map[string]string)
-	var err error
-	if len(variableFiles) > 0 {
-		variablesFromFiles, err = godotenv.Read(variableFiles...)
+// newBuildNode creates the node of a build entry of a config file with the
+// given root dir
+func newBuildNode(rootDir string, buildNodeConfig *buildNodeConfig) *buildNode {
+	buildRoot := utils.ResolveDir(rootDir, buildNodeConfig.From)
+	dockerfile := buildNodeConfig.Dockerfile
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+	return &buildNode{
+		rootDir:    rootDir,
+		buildRoot:  buildRoot,
+		name:       buildNodeConfig.Name,
+		alias:      buildNodeConfig.Alias,
+		tag:        buildNodeConfig.Tag,
+		depend:     buildNodeConfig.Depend,
+		preBuild:   buildNodeConfig.PreBuild,
+		postBuild:  buildNodeConfig.PostBuild,
+		children:   []*buildNode{},
+		dirty:      false,
+		forceBuild: buildNodeConfig.ForceBuild,
+		pushLatest: buildNodeConfig.PushLatest,
+		platforms:  buildNodeConfig.Platforms,
+		dockerfile: utils.ResolveDir(buildRoot, dockerfile),
+		target:     buildNodeConfig.Target,
+		buildArgs:  buildNodeConfig.BuildArgs,
+		labels:     buildNodeConfig.Labels,
+	}
+}
+
+// configFile is a config file read by a configLoader
+type configFile struct {
+	path    string
+	rootDir string
+	config  *config
+}
+
+// displayName returns the path of the file for messages
+func (f *configFile) displayName() string {
+	return displayPath(f.path)
+}
+
+// configLoader reads config files and the files they include, once each
+type configLoader struct {
+	// variables are shared by all files, with the defaults of the variables
+	// declared by the files already read
+	variables *variableValues
+	files     []*configFile
+	loaded    utils.StringSet
+	// profile is applied to every file declaring it, profileChanges holds the
+	// values it set
+	profile        string
+	profileFound   bool
+	profileChanges []string
+}
+
+func newConfigLoader(variableMap map[string]string, variableFiles []string, optFns []ReadOptFn) (*configLoader, error) {
+	opt := new(readOpt)
+	for _, fn := range optFns {
+		fn(opt)
+	}
+	variables, err := readVariables(variableMap, variableFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &configLoader{
+		variables: variables,
+		loaded:    make(utils.StringSet),
+		profile:   opt.profile,
+	}, nil
+}
+
+// loadFile reads a config file unless it was already read
+func (l *configLoader) loadFile(path string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot resolve build file %q", path)
+	}
+	if l.loaded.Exists(absPath) {
+		return nil
+	}
+	l.loaded.Add(absPath)
+	fileContent, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	return l.load(path, fileContent)
+}
+
+// load reads the content of a config file, then the files it includes. Include
+// patterns are relative to the folder of the file.
+func (l *configLoader) load(path string, fileContent []byte) error {
+	buildConfig, err := readBuildConfig(path, fileContent, l.variables, l.profile)
+	if err != nil {
+		if path == "" {
+			return err
+		}
+		return stacktrace.Propagate(err, "Cannot read build file %q", path)
+	}
+	if buildConfig.profileFound {
+		l.profileFound = true
+		for _, change := range buildConfig.profileChanges {
+			l.profileChanges = append(l.profileChanges, fmt.Sprintf("%s (%s)", change, displayPath(path)))
+		}
+	}
+	configFileFolder := filepath.Dir(path)
+	l.files = append(l.files, &configFile{
+		path:    path,
+		rootDir: filepath.Join(configFileFolder, buildConfig.RootDir),
+		config:  buildConfig,
+	})
+	matches, err := globIncludes(configFileFolder, buildConfig.Include)
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		err = l.loadFile(match)
 		if err != nil {
-			return nil, stacktrace.Propagate(err, "cannot read variable files")
+			return err
 		}
 	}
-	allVars := variablesFromFiles
-	for k, v := range variableMap {
-		allVars[k] = v
+	return nil
+}
+
+// readFile reads a config file
+func readFile(path string) ([]byte, error) {
+	fileContent, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot read build file %q", path)
+	}
+	return fileContent, nil
+}
+
+// globIncludes returns the files matching include patterns relative to
+// folder, each pattern must match a file
+func globIncludes(folder string, patterns []string) ([]string, error) {
+	files := []string{}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(utils.ResolveDir(folder, pattern))
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "Invalid include pattern %q", pattern)
+		}
+		if len(matches) == 0 {
+			return nil, stacktrace.NewError("No build file matches include pattern %q", pattern)
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// readBuildConfig renders and decodes the config file at path with variables.
+// The variables of the profile and the defaults of the variables declared by
+// the file are added to variables first, then the profile is applied.
+func readBuildConfig(path string, fileContent []byte, variables *variableValues, profile string) (*config, error) {
+	err := checkSourceKeys(path, fileContent)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot decode build file")
+	}
+	declarations, err := readVariableDeclarations(path, fileContent)
+	if err != nil {
+		return nil, err
+	}
+	var profileVariables map[string]interface{}
+	profileFound := false
+	if profile != "" {
+		profileVariables, profileFound, err = readProfileVariables(path, fileContent, profile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	profileChanges := []string{}
+	for _, name := range variables.setDefaults(nil, profileVariables, "profile "+profile+" of "+displayPath(path)) {
+		profileChanges = append(profileChanges, "variables "+name)
+	}
+	err = applyVariableDeclarations(declarations, variables)
+	if err != nil {
+		return nil, err
 	}
 	fileContentWithEnvExpanded := os.ExpandEnv(string(fileContent))
-	tmpl, err := template.New("doriath").Parse(fileContentWithEnvExpanded)
+	tmpl, err := newConfigTemplate(filepath.Dir(path), fileContentWithEnvExpanded)
 	if err != nil {
 		return nil, err
 	}
-	tmpl = tmpl.Option("missingkey=error")
 	b := &bytes.Buffer{}
-	err = tmpl.Execute(b, allVars)
+	err = tmpl.execute(b, variables.values)
 	if err != nil {
-		return nil, err
+		return nil, stacktrace.Propagate(missingVariableError(path, err), "Cannot render build file")
+	}
+	// Secret variables are masked before decoding the config, since decoding
+	// errors may quote values
+	secretValues := []string{}
+	for _, variable := range declarations {
+		if variable.Secret {
+			secretValues = append(secretValues, variable.Value)
+		}
+	}
+	document := b.Bytes()
+	err = checkRenderedKeys(path, document)
+	if err != nil {
+		return nil, stacktrace.Propagate(maskYAMLError(err, secretValues), "Cannot decode build file")
+	}
+	if profileFound {
+		var changes []string
+		document, changes, err = applyProfile(document, profile)
+		if err != nil {
+			return nil, stacktrace.Propagate(maskYAMLError(err, secretValues), "Cannot apply profile %q", profile)
+		}
+		profileChanges = append(profileChanges, changes...)
 	}
 	buildConfig := &config{}
-	err = yaml.Unmarshal(b.Bytes(), buildConfig)
+	err = yaml.Unmarshal(document, buildConfig)
 	if err != nil {
-		return nil, stacktrace.Propagate(err, "Cannot decode build file")
+		return nil, stacktrace.Propagate(maskYAMLError(err, secretValues), "Cannot decode build file")
 	}
+	buildConfig.profileFound, buildConfig.profileChanges = profileFound, profileChanges
 	return buildConfig, nil
 }
 
+// yamlValueRegex matches the values quoted in yaml errors, truncated with
+// "..." when long
+var yamlValueRegex = regexp.MustCompile("`[^`]*`")
+
+// maskYAMLError masks the parts of secret values quoted in a yaml error, which
+// the secret masking cannot recognize once truncated
+func maskYAMLError(err error, secretValues []string) error {
+	masked := false
+	message := yamlValueRegex.ReplaceAllStringFunc(err.Error(), func(quoted string) string {
+		value := strings.TrimSuffix(strings.Trim(quoted, "`"), "...")
+		for _, secret := range secretValues {
+			if value != "" && strings.Contains(secret, value) {
+				masked = true
+				return "`" + utils.SecretMask + "`"
+			}
+		}
+		return quoted
+	})
+	if !masked {
+		return err
+	}
+	return errors.New(message)
+}
+
 func resolveCredential(credential *credentialConfig, rootDir string) (*credentialConfig, error) {
+	if credential.PasswordFile != "" && credential.Password != "" {
+		return nil, stacktrace.Propagate(ErrConflictingPassword{credential.Name}, "Cannot resolve credential %q", credential.Name)
+	}
 	if credential.PasswordFile != "" {
 		passwordFile := utils.ResolveDir(rootDir, credential.PasswordFile)
 		content, err := ioutil.ReadFile(passwordFile)
@@ -190,9 +641,126 @@ func resolveCredential(credential *credentialConfig, rootDir string) (*credentia
 		}
 		credential.Password = strings.TrimSpace(string(content))
 	}
+	utils.AddCredentialSecret(credential.Username, credential.Password)
+	utils.AddSecret(credential.HTTPToken, credential.ClientSecret, credential.RefreshToken)
+	for _, file := range []*string{&credential.CAFile, &credential.ClientCert, &credential.ClientKey, &credential.KeyFile} {
+		if *file != "" {
+			*file = utils.ResolveDir(rootDir, *file)
+		}
+	}
+	switch credential.Type {
+	case "":
+	case credentialTypeECR:
+		err := resolveECRCredential(credential)
+		if err != nil {
+			return nil, err
+		}
+	case credentialTypeGCPServiceAccount:
+		err := resolveGCPCredential(credential)
+		if err != nil {
+			return nil, err
+		}
+	case credentialTypeACR:
+		err := resolveACRCredential(credential)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, stacktrace.Propagate(ErrUnknownCredentialType{credential.Name, credential.Type}, "Cannot resolve credential %q", credential.Name)
+	}
 	return credential, nil
 }
 
+// resolveECRCredential derives the registry of an ECR credential from its
+// account and region, the region defaulting to the AWS region of the
+// environment
+func resolveECRCredential(credential *credentialConfig) error {
+	if credential.Account == "" {
+		return stacktrace.NewError("Missing account in ECR credential %q", credential.Name)
+	}
+	if credential.Region == "" {
+		credential.Region = utils.AWSRegion()
+	}
+	if credential.Region == "" {
+		return stacktrace.NewError("Missing region in ECR credential %q", credential.Name)
+	}
+	host := utils.ECRRegistryHost(credential.Account, credential.Region)
+	if credential.Name == "" {
+		credential.Name = host
+	}
+	if credential.Registry == "" {
+		credential.Registry = "https://" + host
+	}
+	credential.provider = utils.CacheCredentialProvider(&utils.ECRCredentialProvider{
+		Account:  credential.Account,
+		Region:   credential.Region,
+		Profile:  credential.Profile,
+		Endpoint: credential.Endpoint,
+	})
+	return nil
+}
+
+// resolveGCPCredential sets the provider of a GCP service account credential,
+// authenticating to the registry named like the credential
+func resolveGCPCredential(credential *credentialConfig) error {
+	if credential.Name == "" {
+		return stacktrace.NewError("Missing name of GCP credential")
+	}
+	if credential.KeyFile == "" {
+		return stacktrace.NewError("Missing key file in GCP credential %q", credential.Name)
+	}
+	if credential.Registry == "" {
+		credential.Registry = "https://" + credential.Name
+	}
+	credential.provider = utils.CacheCredentialProvider(&utils.GCPServiceAccountProvider{
+		KeyFile:  credential.KeyFile,
+		TokenURL: credential.Endpoint,
+		Scope:    credential.Scope,
+	})
+	return nil
+}
+
+// resolveACRCredential sets the provider of an ACR credential, authenticating
+// to the registry named like the credential
+func resolveACRCredential(credential *credentialConfig) error {
+	if credential.Name == "" {
+		return stacktrace.NewError("Missing name of ACR credential")
+	}
+	if credential.Registry == "" {
+		credential.Registry = "https://" + credential.Name
+	}
+	credential.provider = utils.CacheCredentialProvider(&utils.ACRProvider{
+		Registry:     credential.Registry,
+		TenantID:     credential.Tenant,
+		ClientID:     credential.ClientID,
+		ClientSecret: credential.ClientSecret,
+		RefreshToken: credential.RefreshToken,
+		Authority:    credential.Endpoint,
+	})
+	return nil
+}
+
+// UseBuilder replaces the builder set in the config file
+func (t *BuildTree) UseBuilder(name string) error {
+	builder, err := utils.NewBuilder(name)
+	if err != nil {
+		return err
+	}
+	t.builder = builder
+	return nil
+}
+
+// IsolateDockerConfig sets whether Push logs into registries in a temporary
+// docker config, removed once done, instead of the docker config of the user
+func (t *BuildTree) IsolateDockerConfig(isolate bool) {
+	t.isolateDockerConfig = isolate
+}
+
+// BuilderName returns the name of the builder used to build images
+func (t *BuildTree) BuilderName() string {
+	return t.builder.Name()
+}
+
 // Prepare checks the build tree for error and produces build steps
 type prepareOpt struct {
 	skipDirtyCheck bool
@@ -214,31 +782,51 @@ func (t *BuildTree) Prepare(optFns ...PrepareOptFn) error {
 	}
 
 	for _, node := range t.allNodes {
-		if node.depend == "" {
+		if len(node.depend) == 0 {
 			t.rootNodes = append(t.rootNodes, node)
-		} else {
-			parent, ok := t.allNodes[node.depend]
+			continue
+		}
+		depends := make(utils.StringSet)
+		for _, depend := range node.depend {
+			if depends.Exists(depend) {
+				continue
+			}
+			depends.Add(depend)
+			parent, ok := t.allNodes[depend]
 			if !ok {
-				return stacktrace.NewError("Dependency for %q not found: %q", node.name, node.depend)
+				return stacktrace.Propagate(ErrDependencyMissing{node.name, depend}, "Dependency for %q not found: %q", node.name, depend)
 			}
 			parent.children = append(parent.children, node)
-			err := t.cyclicCheck(node)
-			if err != nil {
-				return err
-			}
+			node.parents = append(node.parents, parent)
 		}
 	}
 
+	err := t.sortNodes()
+	if err != nil {
+		return err
+	}
+
 	for _, node := range t.allNodes {
-		err := t.assertDockerfile(node)
+		err := t.assertBuildRoot(node)
+		if err != nil {
+			return err
+		}
+		err = t.assertDockerfile(node)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, node := range t.sortedNodes {
+		err := t.computeContextHash(node)
 		if err != nil {
 			return err
 		}
 	}
 
 	if !opt.skipDirtyCheck {
-		for _, node := range t.rootNodes {
-			err := t.dirtyCheck(node, false, false)
+		for _, node := range t.sortedNodes {
+			err := t.dirtyCheck(node)
 			if err != nil {
 				return err
 			}
@@ -252,7 +840,7 @@ func (t *BuildTree) Prepare(optFns ...PrepareOptFn) error {
 func (t *BuildTree) Pull() error {
 	for _, image := range t.pull {
 		utils.Info("Pulling image %s", image)
-		err := utils.DockerPull(image)
+		err := t.builder.Pull(image, nil)
 		if err != nil {
 			return err
 		}
@@ -261,77 +849,148 @@ func (t *BuildTree) Pull() error {
 }
 
 // Build builds all new images
-func (t *BuildTree) Build() error {
-	err := utils.DetectRequirement()
+func (t *BuildTree) Build(optFns ...BuildOptFn) error {
+	opt := newBuildOpt(optFns)
+	err := t.builder.Detect()
 	if err != nil {
 		return err
 	}
 	utils.Info("Building new images")
-	for _, node := range t.rootNodes {
-		err = t.buildNodeAndChildren(node)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return t.walk(opt.jobs, t.buildNodeTask)
 }
 
 // TryBuild tries to build new images locally, then delete them
-func (t *BuildTree) TryBuild() error {
-	err := utils.DetectRequirement()
+func (t *BuildTree) TryBuild(optFns ...BuildOptFn) error {
+	opt := newBuildOpt(optFns)
+	err := t.builder.Detect()
 	if err != nil {
 		return err
 	}
 	utils.Info("Try building new images")
-	for _, node := range t.rootNodes {
-		err = t.tryBuildNodeAndChildren(node)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return t.walk(opt.jobs, t.tryBuildNodeTask)
 }
 
 // Push pushes new images to registry
-func (t *BuildTree) Push() error {
-	err := t.Build()
+func (t *BuildTree) Push(optFns ...BuildOptFn) error {
+	opt := newBuildOpt(optFns)
+	err := t.Build(optFns...)
 	if err != nil {
 		return err
 	}
+	if t.isolateDockerConfig {
+		tempConfig, err := t.tempDockerConfig()
+		if err != nil {
+			return err
+		}
+		defer tempConfig.Remove()
+		utils.Info("Using temporary docker config %s", tempConfig.Dir)
+	}
 	utils.Info("Logging into registry")
 	for _, credential := range t.credentials {
-		err = utils.DockerLogin(credential.Registry, credential.Username, credential.Password)
+		if !credential.hasSecret() {
+			continue
+		}
+		username, password, err := credential.dockerCredential().BasicAuth()
+		if err != nil {
+			return err
+		}
+		err = t.builder.Login(credential.Registry, username, password)
 		if err != nil {
 			return err
 		}
 	}
 	utils.Info("Pushing new images")
-	for _, node := range t.rootNodes {
-		err = t.pushNodeAndChildren(node)
+	return t.walk(opt.jobs, t.pushNodeTask)
+}
+
+// tempDockerConfig creates a temporary docker config holding the credentials
+// found in the docker config of the user for the registries to push to and to
+// pull from, when they have no credential in the config file
+func (t *BuildTree) tempDockerConfig() (*utils.TempDockerConfig, error) {
+	registryNames, err := t.usedRegistries()
+	if err != nil {
+		return nil, err
+	}
+	credentials := make(map[string]*utils.DockerCredential)
+	for _, registryName := range registryNames {
+		if credential := t.credentials[registryName]; credential != nil && credential.hasSecret() {
+			continue
+		}
+		credential, err := t.dockerConfigCredential(registryName)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if credential != nil {
+			credentials[registryName] = credential
 		}
 	}
-	return nil
+	return utils.NewTempDockerConfig(t.dockerConfigDir, credentials)
+}
+
+// usedRegistries returns the registries of the images to build, of the images
+// they are built from, in depend or in their dockerfile, and of pull, since
+// some builders pull them again when pushing
+func (t *BuildTree) usedRegistries() ([]string, error) {
+	images := append([]string{}, t.pull...)
+	for _, node := range t.sortedNodes {
+		if !t.needBuild(node) {
+			continue
+		}
+		images = append(images, node.name)
+		for _, parent := range node.parents {
+			images = append(images, parent.name)
+		}
+		dockerfile, err := utils.ReadDockerfile(node.dockerfile, node.buildArgs)
+		if err != nil {
+			return nil, err
+		}
+		dockerfileImages, err := dockerfile.Images(node.target)
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range dockerfileImages {
+			images = append(images, image.FullName)
+		}
+	}
+	registryNames := []string{}
+	found := make(utils.StringSet)
+	for _, image := range images {
+		imageInfo, err := utils.ExtractDockerImageInfo(image)
+		if err != nil {
+			return nil, err
+		}
+		if !found.Exists(imageInfo.RegistryName) {
+			found.Add(imageInfo.RegistryName)
+			registryNames = append(registryNames, imageInfo.RegistryName)
+		}
+	}
+	return registryNames, nil
 }
 
-// FindLatestTag .
+// FindLatestTag returns a tag of an image pointing to the same manifest as latest
 func (t *BuildTree) FindLatestTag(name string) (string, error) {
-	imageInfo, err := utils.ExtractDockerImageInfo(name)
+	_, tags, err := t.FindMatchingTags(name, "latest")
 	if err != nil {
 		return "", err
 	}
-	credential := t.credentials[imageInfo.RegistryName]
-	if credential == nil {
-		return "", stacktrace.Propagate(ErrMissingCredential{imageInfo.RegistryName}, "Cannot find credential for %s", imageInfo.RegistryName)
+	if len(tags) == 0 {
+		return "", stacktrace.NewError("cannot find latest tag")
 	}
-	return utils.DockerFindLatestTag(imageInfo, &utils.DockerCredential{
-		Username:      credential.Username,
-		Registry:      credential.Registry,
-		Password:      credential.Password,
-		HTTPToken:     credential.HTTPToken,
-		ChallengeType: credential.ChallengeType,
-	})
+	return tags[0], nil
+}
+
+// FindMatchingTags returns the digest of the reference tag of an image and the
+// other tags pointing to the same manifest
+func (t *BuildTree) FindMatchingTags(name, reference string) (string, []string, error) {
+	imageInfo, err := utils.ExtractDockerImageInfo(name)
+	if err != nil {
+		return "", nil, err
+	}
+	registry, err := t.registry(imageInfo.RegistryName)
+	if err != nil {
+		return "", nil, err
+	}
+	return registry.FindMatchingTags(imageInfo.ShortName, reference)
 }
 
 func (t *BuildTree) WaitImageExist(name string, timeout time.Duration, interval time.Duration) error {
@@ -339,18 +998,12 @@ func (t *BuildTree) WaitImageExist(name string, timeout time.Duration, interval
 	if err != nil {
 		return err
 	}
-	credential := t.credentials[imageInfo.RegistryName]
-	if credential == nil {
-		return stacktrace.Propagate(ErrMissingCredential{imageInfo.RegistryName}, "Cannot find credential for %s", imageInfo.RegistryName)
+	registry, err := t.registry(imageInfo.RegistryName)
+	if err != nil {
+		return err
 	}
 	checkExistFn := func() bool {
-		exist, err := utils.DockerCheckTagExists(imageInfo.ShortName, imageInfo.Tag, &utils.DockerCredential{
-			Username:      credential.Username,
-			Registry:      credential.Registry,
-			Password:      credential.Password,
-			HTTPToken:     credential.HTTPToken,
-			ChallengeType: credential.ChallengeType,
-		})
+		exist, _, err := registry.TagExists(imageInfo.ShortName, imageInfo.Tag)
 		if err != nil {
 			utils.Error(err)
 			return false
@@ -377,13 +1030,13 @@ func (t *BuildTree) Clean() {
 	for _, node := range t.allNodes {
 		if node.buildRoot != "provided" {
 			utils.Info("====> Removing docker image %s:%s", node.name, node.tag)
-			err := utils.DockerTryRMI(node.PullableName(), node.tag)
+			err := t.tryRemove(node.PullableName(), node.tag)
 			if err != nil {
 				utils.Error(err)
 			}
 			if node.pushLatest {
 				utils.Info("====> Removing docker image %s:%s", node.name, "latest")
-				err = utils.DockerTryRMI(node.PullableName(), "latest")
+				err = t.tryRemove(node.PullableName(), "latest")
 				if err != nil {
 					utils.Error(err)
 				}
@@ -392,55 +1045,132 @@ func (t *BuildTree) Clean() {
 	}
 }
 
-// PrintTree prints the build tree
+// tryRemove removes an image, retrying while it is still used by a container
+// being removed
+func (t *BuildTree) tryRemove(name, tag string) error {
+	return t.retry.Do(func() error {
+		return utils.Retryable(t.builder.Remove(name, tag, nil), 0)
+	})
+}
+
+// PrintTree prints the build tree. A node with several parents is printed
+// under each of them, but its children are only printed the first time.
 func (t *BuildTree) PrintTree(noColor bool) {
+	if t.profile != "" {
+		fmt.Printf("Profile %s:\n", t.profile)
+		for _, change := range t.profileChanges {
+			fmt.Printf("  %s\n", change)
+		}
+	}
+	printed := make(utils.StringSet)
 	for _, node := range t.rootNodes {
-		t.printTree(node, 0, noColor)
+		t.printTree(node, 0, noColor, printed)
 	}
 }
 
-func (t *BuildTree) cyclicCheck(node *buildNode) error {
-	nodes := make(utils.StringSet)
-	current := node
-	for {
-		nameId := current.GetNameOrAlias()
-		if nodes.Exists(nameId) {
-			return stacktrace.Propagate(ErrCyclicDependency{nameId}, "Cyclic dependency found for %q", nameId)
-		}
-		nodes.Add(nameId)
-		if current.depend == "" {
+// sortNodes sorts all nodes so that parents always come before their children,
+// failing on cyclic dependencies
+func (t *BuildTree) sortNodes() error {
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := make(map[*buildNode]int)
+	sortedNodes := []*buildNode{}
+	var visit func(node *buildNode) error
+	visit = func(node *buildNode) error {
+		switch state[node] {
+		case visiting:
+			nameID := node.GetNameOrAlias()
+			return stacktrace.Propagate(ErrCyclicDependency{nameID}, "Cyclic dependency found for %q", nameID)
+		case visited:
 			return nil
 		}
-		parent, ok := t.allNodes[current.depend]
-		if !ok {
-			return stacktrace.Propagate(ErrDependencyMissing{node.name, node.depend}, "Dependency for %q not found: %q", node.name, node.depend)
+		state[node] = visiting
+		for _, parent := range node.parents {
+			err := visit(parent)
+			if err != nil {
+				return err
+			}
+		}
+		state[node] = visited
+		sortedNodes = append(sortedNodes, node)
+		return nil
+	}
+	names := []string{}
+	for name := range t.allNodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := visit(t.allNodes[name])
+		if err != nil {
+			return err
 		}
-		current = parent
 	}
+	t.sortedNodes = sortedNodes
+	return nil
 }
 
 func (t *BuildTree) assertDockerfile(node *buildNode) error {
-	if node.depend == "" {
+	if t.isProvided(node) {
 		return nil
 	}
-	// Check FROM:xxx and node dep
-	imageInfo, err := utils.ExtractParentImageFromDockerfile(filepath.Join(node.buildRoot, "Dockerfile"))
+	// Check every FROM:xxx and COPY --from=xxx against node deps
+	dockerfile, err := utils.ReadDockerfile(node.dockerfile, node.buildArgs)
 	if err != nil {
 		return err
 	}
-	dependentNode := t.allNodes[node.depend]
-	if !utils.CompareDockerName(dependentNode.PullableName(), imageInfo.FullName) {
-		return stacktrace.Propagate(ErrMismatchDependencyImage{node.name, node.depend, imageInfo.FullName}, "Mismatch dependency for %q: %q in config but got %q in dockerfile", node.name, node.depend, imageInfo.FullName)
+	images, err := dockerfile.Images(node.target)
+	if err != nil {
+		return err
+	}
+	for _, depend := range node.depend {
+		dependentNode := t.allNodes[depend]
+		matchedImages := []*utils.DockerImageInfo{}
+		for _, image := range images {
+			if utils.CompareDockerName(dependentNode.PullableName(), image.FullName) {
+				matchedImages = append(matchedImages, image)
+			}
+		}
+		if len(matchedImages) == 0 {
+			actualFullnames := []string{}
+			for _, image := range images {
+				actualFullnames = append(actualFullnames, image.FullName)
+			}
+			actualFullname := strings.Join(actualFullnames, ", ")
+			return stacktrace.Propagate(ErrMismatchDependencyImage{node.name, depend, actualFullname}, "Mismatch dependency for %q: %q in config but got %q in dockerfile", node.name, depend, actualFullname)
+		}
+		parentTag := dependentNode.tag
+		for _, imageInfo := range matchedImages {
+			if parentTag != imageInfo.Tag {
+				return stacktrace.Propagate(ErrMismatchDependencyTag{node.name, depend, parentTag, imageInfo.Tag}, "Mismatch dependency image tag for %q (parent is %q): %q in config but got %q in dockerfile", node.name, depend, parentTag, imageInfo.Tag)
+			}
+		}
 	}
-	parentTag := dependentNode.tag
-	if parentTag != imageInfo.Tag {
-		return stacktrace.Propagate(ErrMismatchDependencyTag{node.name, node.depend, parentTag, imageInfo.Tag}, "Mismatch dependency image tag for %q (parent is %q): %q in config but got %q in dockerfile", node.name, node.depend, parentTag, imageInfo.Tag)
+	// Images built by this tree must be declared so that they are built first,
+	// other tags of these images already exist
+	for _, image := range images {
+		for _, other := range t.allNodes {
+			if other == node || t.isProvided(other) || !utils.CompareDockerName(other.PullableName(), image.FullName) || other.tag != image.Tag {
+				continue
+			}
+			if !node.hasParent(other) {
+				return stacktrace.Propagate(ErrUndeclaredDependency{node.name, image.FullName}, "Dockerfile of %q uses %q which is not declared in depend", node.name, image.FullName)
+			}
+		}
 	}
 	return nil
 }
 
-func (t *BuildTree) dirtyCheck(node *buildNode, parentIsDirty, parentIsForced bool) error {
+func (t *BuildTree) dirtyCheck(node *buildNode) error {
 	utils.Info("Dirty check node %s", node.DisplayName())
+	parentIsDirty := false
+	parentIsForced := false
+	for _, parent := range node.parents {
+		parentIsDirty = parentIsDirty || parent.dirty
+		parentIsForced = parentIsForced || parent.forceBuild
+	}
 	if parentIsForced || node.forceBuild {
 		node.forceBuild = true
 		node.dirty = true
@@ -451,17 +1181,11 @@ func (t *BuildTree) dirtyCheck(node *buildNode, parentIsDirty, parentIsForced bo
 		if err != nil {
 			return err
 		}
-		credential := t.credentials[imageInfo.RegistryName]
-		if credential == nil {
-			return stacktrace.Propagate(ErrMissingCredential{imageInfo.RegistryName}, "Cannot find credential for %s", imageInfo.RegistryName)
-		}
-		tagExists, err := utils.DockerCheckTagExists(imageInfo.ShortName, node.tag, &utils.DockerCredential{
-			Registry:      credential.Registry,
-			Username:      credential.Username,
-			Password:      credential.Password,
-			HTTPToken:     credential.HTTPToken,
-			ChallengeType: credential.ChallengeType,
-		})
+		registry, err := t.registry(imageInfo.RegistryName)
+		if err != nil {
+			return err
+		}
+		tagExists, digest, err := registry.TagExists(imageInfo.ShortName, node.tag)
 		if err != nil {
 			return err
 		}
@@ -477,18 +1201,129 @@ func (t *BuildTree) dirtyCheck(node *buildNode, parentIsDirty, parentIsForced bo
 			}
 		} else {
 			node.dirty = !tagExists
+			if tagExists {
+				node.digest = digest
+				err = t.assertContextUnchanged(node, imageInfo, registry)
+				if err != nil {
+					return err
+				}
+			}
 		}
 	}
+	return nil
+}
 
-	for _, child := range node.children {
-		err := t.dirtyCheck(child, node.dirty, node.forceBuild)
+// assertContextUnchanged compares the context hash of an existing image with the
+// local one. Images built before doriath labelled them are assumed unchanged.
+func (t *BuildTree) assertContextUnchanged(node *buildNode, imageInfo *utils.DockerImageInfo, registry utils.Registry) error {
+	labels, err := registry.ImageLabels(imageInfo.ShortName, node.tag)
+	if err != nil {
+		return err
+	}
+	remoteHash, ok := labels[utils.ContextHashLabel]
+	if !ok || remoteHash == node.contextHash {
+		return nil
+	}
+	return stacktrace.Propagate(ErrImageContextChanged{node.name, node.tag}, "Build context of %q changed but tag %q was not updated", node.name, node.tag)
+}
+
+// registry returns the client of a registry, using the credential with the same
+// name, or the docker config when there is none
+func (t *BuildTree) registry(registryName string) (utils.Registry, error) {
+	if registry, ok := t.registries[registryName]; ok {
+		return registry, nil
+	}
+	credential := t.credentials[registryName]
+	var dockerCredential *utils.DockerCredential
+	if credential != nil && credential.hasSecret() {
+		dockerCredential = credential.dockerCredential()
+	} else {
+		var err error
+		dockerCredential, err = t.dockerConfigCredential(registryName)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		switch {
+		case credential != nil && dockerCredential == nil:
+			// Anonymous access with the TLS settings of the credential
+			dockerCredential = credential.dockerCredential()
+		case credential != nil:
+			configCredential := dockerCredential
+			dockerCredential = credential.dockerCredential()
+			dockerCredential.Username = configCredential.Username
+			dockerCredential.Password = configCredential.Password
+			dockerCredential.IdentityToken = configCredential.IdentityToken
+			if dockerCredential.Registry == "" {
+				dockerCredential.Registry = configCredential.Registry
+			}
+		case dockerCredential == nil:
+			return nil, stacktrace.Propagate(ErrMissingCredential{registryName}, "Cannot find credential for %s", registryName)
 		}
 	}
+	registry, err := t.newRegistry(dockerCredential, utils.WithTimeout(t.requestTimeout), utils.WithRetryPolicy(t.retry))
+	if err != nil {
+		return nil, err
+	}
+	t.registries[registryName] = registry
+	return registry, nil
+}
+
+// dockerConfigCredential returns the credential of a registry found in the
+// docker config, nil if there is none
+func (t *BuildTree) dockerConfigCredential(registryName string) (*utils.DockerCredential, error) {
+	if t.dockerConfig == nil {
+		dockerConfig, err := utils.ReadDockerConfig(t.dockerConfigDir)
+		if err != nil {
+			return nil, err
+		}
+		t.dockerConfig = dockerConfig
+	}
+	return t.dockerConfig.Credential(registryName)
+}
+
+func (t *BuildTree) computeContextHash(node *buildNode) error {
+	if t.isProvided(node) {
+		node.contextHash = utils.HashStrings(node.name, node.tag)
+		return nil
+	}
+	contextHash, err := utils.HashBuildContext(node.buildRoot, node.dockerfile)
+	if err != nil {
+		return err
+	}
+	// The dockerfile may live outside of the build context
+	dockerfileHash, err := utils.HashFile(node.dockerfile)
+	if err != nil {
+		return err
+	}
+	hashes := []string{contextHash, dockerfileHash, node.target}
+	hashes = append(hashes, utils.SortedKeyValues(node.buildArgs)...)
+	hashes = append(hashes, utils.SortedKeyValues(node.labels)...)
+	for _, parent := range node.parents {
+		hashes = append(hashes, parent.contextHash)
+	}
+	node.contextHash = utils.HashStrings(hashes...)
 	return nil
 }
 
+func (t *BuildTree) buildOptions(ctx context.Context, node *buildNode, tag string) *utils.DockerBuildOptions {
+	labels := make(map[string]string)
+	for key, value := range node.labels {
+		labels[key] = value
+	}
+	labels[utils.ContextHashLabel] = node.contextHash
+	return &utils.DockerBuildOptions{
+		Name:       node.PullableName(),
+		Tag:        tag,
+		BuildRoot:  node.buildRoot,
+		Dockerfile: node.dockerfile,
+		Target:     node.target,
+		BuildArgs:  node.buildArgs,
+		Labels:     labels,
+		Platforms:  node.platforms,
+		Context:    ctx,
+	}
+}
+
 func (t *BuildTree) isProvided(node *buildNode) bool {
 	return node.buildRoot == "provided"
 }
@@ -497,26 +1332,22 @@ func (t *BuildTree) needBuild(node *buildNode) bool {
 	return !t.isProvided(node) && (node.dirty || node.forceBuild)
 }
 
-func (t *BuildTree) buildNodeAndChildren(node *buildNode) error {
+func (t *BuildTree) buildNodeTask(ctx context.Context, node *buildNode, out io.Writer) error {
 	if !t.needBuild(node) {
-		utils.Info2("====> Skipping %s", node.name)
-	} else {
-		utils.Info2("====> Building %s:%s", node.name, node.tag)
-		err := t.buildNode(node, node.tag)
-		if err != nil {
-			return err
-		}
-		if node.pushLatest {
-			latestTag := "latest"
-			utils.Info2("====> Building %s:%s", node.name, latestTag)
-			err = t.buildNode(node, latestTag)
-			if err != nil {
-				return err
-			}
-		}
+		utils.Info2To(out, "====> Skipping %s", node.name)
+		return nil
 	}
-	for _, child := range node.children {
-		err := t.buildNodeAndChildren(child)
+	utils.Info2To(out, "====> Building %s:%s", node.name, node.tag)
+	imageID, err := t.buildNode(ctx, node, node.tag, out)
+	if err != nil {
+		return err
+	}
+	node.imageID = imageID
+	utils.Info2To(out, "====> Built %s:%s %s", node.name, node.tag, imageID)
+	if node.pushLatest {
+		latestTag := "latest"
+		utils.Info2To(out, "====> Tagging %s:%s as %s", node.name, node.tag, latestTag)
+		err = t.builder.Tag(node.PullableName(), node.tag, latestTag)
 		if err != nil {
 			return err
 		}
@@ -524,43 +1355,38 @@ func (t *BuildTree) buildNodeAndChildren(node *buildNode) error {
 	return nil
 }
 
-func (t *BuildTree) tryBuildNodeAndChildren(node *buildNode) error {
+func (t *BuildTree) tryBuildNodeTask(ctx context.Context, node *buildNode, out io.Writer) error {
 	if !t.needBuild(node) {
-		utils.Info2("====> Skipping %s", node.name)
-	} else {
-		randomTag := fmt.Sprintf("%s-%d", node.tag, time.Now().UnixNano())
-		utils.Info2("====> Building %s:%s", node.name, randomTag)
-		err := t.buildNode(node, randomTag)
-		if err != nil {
-			return err
-		}
-		utils.Info2("====> Removing %s:%s", node.name, randomTag)
-		err = utils.DockerRMI(node.PullableName(), randomTag)
-		if err != nil {
-			utils.Error(err)
-		}
+		utils.Info2To(out, "====> Skipping %s", node.name)
+		return nil
 	}
-	for _, child := range node.children {
-		err := t.tryBuildNodeAndChildren(child)
-		if err != nil {
-			return err
-		}
+	randomTag := fmt.Sprintf("%s-%d", node.tag, time.Now().UnixNano())
+	utils.Info2To(out, "====> Building %s:%s", node.name, randomTag)
+	_, err := t.buildNode(ctx, node, randomTag, out)
+	if err != nil {
+		return err
+	}
+	utils.Info2To(out, "====> Removing %s:%s", node.name, randomTag)
+	err = t.builder.Remove(node.PullableName(), randomTag, out)
+	if err != nil {
+		utils.Error(err)
 	}
 	return nil
 }
 
-func (t *BuildTree) buildNode(node *buildNode, tag string) error {
+// buildNode builds the image of a node and returns its ID
+func (t *BuildTree) buildNode(ctx context.Context, node *buildNode, tag string, out io.Writer) (string, error) {
 	if node.preBuild != "" {
-		err := utils.RunShellCommand(t.resolveShellCommandPath(t.rootDir, node.preBuild))
+		err := utils.RunShellCommandContext(ctx, t.resolveShellCommandPath(node.rootDir, node.preBuild), out)
 		if err != nil {
-			return err
+			return "", err
 		}
 	}
-	err := utils.DockerBuild(node.PullableName(), tag, node.buildRoot)
+	imageID, err := t.builder.Build(t.buildOptions(ctx, node, tag), out)
 	if node.postBuild != "" {
-		utils.RunShellCommand(t.resolveShellCommandPath(t.rootDir, node.postBuild))
+		utils.RunShellCommandWithOutput(t.resolveShellCommandPath(node.rootDir, node.postBuild), out)
 	}
-	return err
+	return imageID, err
 }
 
 func (t *BuildTree) resolveShellCommandPath(buildRoot, command string) string {
@@ -573,26 +1399,22 @@ func (t *BuildTree) resolveShellCommandPath(buildRoot, command string) string {
 	return command
 }
 
-func (t *BuildTree) pushNodeAndChildren(node *buildNode) error {
+func (t *BuildTree) pushNodeTask(ctx context.Context, node *buildNode, out io.Writer) error {
 	if !t.needBuild(node) {
-		utils.Info2("====> Skipping %s", node.name)
-	} else {
-		utils.Info2("====> Pushing %s:%s", node.name, node.tag)
-		err := utils.DockerPush(node.PullableName(), node.tag, node.buildRoot, node.platforms)
-		if err != nil {
-			return err
-		}
-		if node.pushLatest {
-			latestTag := "latest"
-			utils.Info2("====> Pushing %s:%s", node.name, latestTag)
-			err := utils.DockerPush(node.PullableName(), latestTag, node.buildRoot, node.platforms)
-			if err != nil {
-				return err
-			}
-		}
+		utils.Info2To(out, "====> Skipping %s", node.name)
+		return nil
 	}
-	for _, child := range node.children {
-		err := t.pushNodeAndChildren(child)
+	utils.Info2To(out, "====> Pushing %s:%s", node.name, node.tag)
+	digest, err := t.push(ctx, node, node.tag, out)
+	if err != nil {
+		return err
+	}
+	node.digest = digest
+	utils.Info2To(out, "====> Pushed %s:%s %s", node.name, node.tag, digest)
+	if node.pushLatest {
+		latestTag := "latest"
+		utils.Info2To(out, "====> Pushing %s:%s", node.name, latestTag)
+		_, err := t.push(ctx, node, latestTag, out)
 		if err != nil {
 			return err
 		}
@@ -600,7 +1422,21 @@ func (t *BuildTree) pushNodeAndChildren(node *buildNode) error {
 	return nil
 }
 
-func (t *BuildTree) printTree(node *buildNode, level int, noColor bool) {
+// push pushes a tag of a node, retrying failed pushes until ctx is done
+func (t *BuildTree) push(ctx context.Context, node *buildNode, tag string, out io.Writer) (string, error) {
+	var digest string
+	err := t.retry.DoContext(ctx, func() error {
+		var err error
+		digest, err = t.builder.Push(t.buildOptions(ctx, node, tag), out)
+		if err != nil {
+			utils.Info2To(out, "====> Failed to push %s:%s: %s", node.name, tag, stacktrace.RootCause(err))
+		}
+		return utils.Retryable(err, 0)
+	})
+	return digest, err
+}
+
+func (t *BuildTree) printTree(node *buildNode, level int, noColor bool, printed utils.StringSet) {
 	prefix := strings.Repeat("  ", level) + "-"
 	var dirtyPrefix string
 	var dirtyMark string
@@ -612,8 +1448,17 @@ func (t *BuildTree) printTree(node *buildNode, level int, noColor bool) {
 			dirtySuffix = "\033[0m"
 		}
 	}
+	nameID := node.GetNameOrAlias()
+	if printed.Exists(nameID) {
+		if len(node.children) > 0 {
+			dirtyMark += " (see above)"
+		}
+		fmt.Printf("%s%s %s%s%s\n", dirtyPrefix, prefix, node.DisplayName(), dirtyMark, dirtySuffix)
+		return
+	}
+	printed.Add(nameID)
 	fmt.Printf("%s%s %s%s%s\n", dirtyPrefix, prefix, node.DisplayName(), dirtyMark, dirtySuffix)
 	for _, child := range node.children {
-		t.printTree(child, level+1, noColor)
+		t.printTree(child, level+1, noColor, printed)
 	}
 }
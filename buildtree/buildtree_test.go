@@ -1,13 +1,28 @@
 package buildtree
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/anduintransaction/doriath/utils"
+	"github.com/anduintransaction/doriath/utils/registrytest"
 	"github.com/palantir/stacktrace"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -42,6 +57,12 @@ build:
     platforms:
       - linux/amd64
       - linux/arm64
+    dockerfile: "Dockerfile.prod"
+    target: "prod"
+    build_args:
+      VERSION: "{{.aragornTag}}"
+    labels:
+      team: "fellowship"
 credentials:
   - name: gcr.io
     registry: "https://gcr.io/v2/"
@@ -59,7 +80,9 @@ credentials:
 	variableFiles := []string{
 		filepath.Join(s.resourceFolder, "vars", "vars"),
 	}
-	buildConfig, err := readBuildConfig([]byte(fileContent), variables, variableFiles)
+	allVariables, err := readVariables(variables, variableFiles)
+	require.Nil(s.T(), err, "variables should be readable")
+	buildConfig, err := readBuildConfig("", []byte(fileContent), allVariables, "")
 	require.Nil(s.T(), err, "read build config should be successful")
 	require.Equal(s.T(), ".", buildConfig.RootDir)
 	expectedBuilds := []*buildNodeConfig{
@@ -72,12 +95,16 @@ credentials:
 			Name:       "human/aragorn",
 			Tag:        "3.1.4",
 			From:       "./human/aragorn",
-			Depend:     "ubuntu",
+			Depend:     stringList{"ubuntu"},
 			PreBuild:   "./init.sh",
 			PostBuild:  "./finalize.sh",
 			ForceBuild: true,
 			PushLatest: true,
 			Platforms:  []string{"linux/amd64", "linux/arm64"},
+			Dockerfile: "Dockerfile.prod",
+			Target:     "prod",
+			BuildArgs:  map[string]string{"VERSION": "3.1.4"},
+			Labels:     map[string]string{"team": "fellowship"},
 		},
 	}
 	require.Equal(s.T(), expectedBuilds, buildConfig.Build)
@@ -117,7 +144,6 @@ func (s *BuildTreeTestSuite) TestBuildTreeHappyPath() {
 		buildRoot: "provided",
 		name:      "library/debian",
 		tag:       "8",
-		depend:    "",
 		children:  []string{"library/ubuntu"},
 		dirty:     false,
 	}
@@ -126,7 +152,7 @@ func (s *BuildTreeTestSuite) TestBuildTreeHappyPath() {
 		buildRoot: filepath.Join(rootFolder, "parent1"),
 		name:      "library/ubuntu",
 		tag:       "16.04",
-		depend:    "library/debian",
+		depend:    []string{"library/debian"},
 		children:  []string{"library/alpine", "library/nginx", "library/postgres"},
 		dirty:     false,
 	}
@@ -135,7 +161,7 @@ func (s *BuildTreeTestSuite) TestBuildTreeHappyPath() {
 		buildRoot: filepath.Join(rootFolder, "child1"),
 		name:      "library/alpine",
 		tag:       "3.5",
-		depend:    "library/ubuntu",
+		depend:    []string{"library/ubuntu"},
 		children:  []string{"library/busybox"},
 		dirty:     false,
 	}
@@ -144,7 +170,7 @@ func (s *BuildTreeTestSuite) TestBuildTreeHappyPath() {
 		buildRoot: filepath.Join(rootFolder, "grandchild1"),
 		name:      "library/busybox",
 		tag:       "1",
-		depend:    "library/alpine",
+		depend:    []string{"library/alpine"},
 		children:  []string{},
 		dirty:     false,
 	}
@@ -153,7 +179,7 @@ func (s *BuildTreeTestSuite) TestBuildTreeHappyPath() {
 		buildRoot: filepath.Join(rootFolder, "child2"),
 		name:      "library/nginx",
 		tag:       "should-not-exist",
-		depend:    "library/ubuntu",
+		depend:    []string{"library/ubuntu"},
 		children:  []string{"library/redis"},
 		dirty:     true,
 	}
@@ -162,7 +188,7 @@ func (s *BuildTreeTestSuite) TestBuildTreeHappyPath() {
 		buildRoot: filepath.Join(rootFolder, "grandchild2"),
 		name:      "library/redis",
 		tag:       "should-not-exist",
-		depend:    "library/nginx",
+		depend:    []string{"library/nginx"},
 		children:  []string{},
 		dirty:     true,
 	}
@@ -171,7 +197,7 @@ func (s *BuildTreeTestSuite) TestBuildTreeHappyPath() {
 		buildRoot:  filepath.Join(rootFolder, "child3"),
 		name:       "library/postgres",
 		tag:        "9.6",
-		depend:     "library/ubuntu",
+		depend:     []string{"library/ubuntu"},
 		children:   []string{"library/mariadb"},
 		dirty:      true,
 		forceBuild: true,
@@ -181,7 +207,7 @@ func (s *BuildTreeTestSuite) TestBuildTreeHappyPath() {
 		buildRoot:  filepath.Join(rootFolder, "grandchild3"),
 		name:       "library/mariadb",
 		tag:        "10",
-		depend:     "library/postgres",
+		depend:     []string{"library/postgres"},
 		children:   []string{},
 		dirty:      true,
 		forceBuild: true,
@@ -189,6 +215,50 @@ func (s *BuildTreeTestSuite) TestBuildTreeHappyPath() {
 	require.Equal(s.T(), expectedGrandChildNode3, s.convertNodeToTestData(buildTree.allNodes["library/mariadb"]))
 }
 
+func (s *BuildTreeTestSuite) TestBuilderConfig() {
+	buildTree, err := ReadBuildTree(strings.NewReader("builder: podman\n"), map[string]string{}, nil)
+	require.Nil(s.T(), err, "build tree must be readable")
+	require.Equal(s.T(), utils.BuilderPodman, buildTree.BuilderName())
+	err = buildTree.UseBuilder(utils.BuilderBuildah)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), utils.BuilderBuildah, buildTree.BuilderName())
+	_, err = ReadBuildTree(strings.NewReader("builder: kaniko\n"), map[string]string{}, nil)
+	require.NotNil(s.T(), err, "unknown builder must fail")
+}
+
+func (s *BuildTreeTestSuite) TestRetryConfig() {
+	buildTree, err := ReadBuildTree(strings.NewReader("retry:\n  attempts: 3\n  initial_delay: 2s\nrequest_timeout: 10s\n"), map[string]string{}, nil)
+	require.Nil(s.T(), err, "build tree must be readable")
+	require.Equal(s.T(), 3, buildTree.retry.Attempts)
+	require.Equal(s.T(), 2*time.Second, buildTree.retry.InitialDelay)
+	require.Equal(s.T(), utils.DefaultRetryMaxDelay, buildTree.retry.MaxDelay)
+	require.Equal(s.T(), 10*time.Second, buildTree.requestTimeout)
+	buildTree, err = ReadBuildTree(strings.NewReader("root_dir: .\n"), map[string]string{}, nil)
+	require.Nil(s.T(), err, "build tree must be readable")
+	require.Equal(s.T(), utils.DefaultRetryPolicy(), buildTree.retry)
+	require.Equal(s.T(), utils.DefaultRegistryTimeout, buildTree.requestTimeout)
+}
+
+func (s *BuildTreeTestSuite) TestSecrets() {
+	config := `secret_variables:
+  - token
+credentials:
+  - name: quay.io
+    username: sam
+    password: "{{.password}}"
+  - name: ghcr.io
+    http_token: "{{.token}}"
+`
+	_, err := ReadBuildTree(strings.NewReader(config), map[string]string{"password": "s3cr3t-password", "token": "s3cr3t-token", "tag": "1.0"}, nil)
+	require.Nil(s.T(), err, "build tree must be readable")
+	require.Equal(s.T(), "**** ****", utils.Mask("s3cr3t-password s3cr3t-token"), "credentials must be masked")
+	require.Equal(s.T(), "1.0", utils.Mask("1.0"), "variables which are not secret must not be masked")
+
+	_, err = ReadBuildTree(strings.NewReader("secret_variables: [timeout]\nrequest_timeout: {{.timeout}}\n"), map[string]string{"timeout": "s3cr3t-timeout"}, nil)
+	require.NotNil(s.T(), err)
+	require.Contains(s.T(), err.Error(), "cannot unmarshal !!str `****`", "secret variables must be masked in decoding errors")
+}
+
 func (s *BuildTreeTestSuite) TestCyclicCheck() {
 	rootFolder := filepath.Join(s.resourceFolder, "cyclic-check")
 	buildTree, err := ReadBuildTreeFromFile(filepath.Join(rootFolder, "doriath.yml"), map[string]string{}, nil)
@@ -225,6 +295,66 @@ func (s *BuildTreeTestSuite) TestDependOnAlias() {
 	require.Equal(s.T(), expectedRootNode, s.convertNodeToTestData(buildTree.rootNodes[0]))
 }
 
+func (s *BuildTreeTestSuite) TestInclude() {
+	rootFolder := filepath.Join(s.resourceFolder, "include")
+	buildTree, err := ReadBuildTreeFromFile(filepath.Join(rootFolder, "doriath.yml"), map[string]string{}, nil)
+	require.Nil(s.T(), err, "build tree must be readable")
+	err = buildTree.Prepare(skipTestDirtyCheck...)
+	require.Nil(s.T(), err, "build tree must be able to be prepared")
+	elves := filepath.Join(rootFolder, "teams", "elves")
+	elrond := buildTree.allNodes["anduin/elrond"]
+	require.Equal(s.T(), filepath.Join(elves, "elrond"), elrond.buildRoot, "from must be relative to the included file")
+	require.Equal(s.T(), filepath.Join(elves, "scripts", "prebuild.sh"), filepath.Clean(buildTree.resolveShellCommandPath(elrond.rootDir, elrond.preBuild)))
+	dwarves := filepath.Join(rootFolder, "teams", "dwarves", "images")
+	require.Equal(s.T(), filepath.Join(dwarves, "gimli"), buildTree.allNodes["anduin/gimli"].buildRoot, "root_dir must be relative to the included file")
+	require.Equal(s.T(), []string{"anduin/elrond", "anduin/gimli"}, s.convertNodeToTestData(buildTree.allNodes["anduin/base"]).children)
+	require.Equal(s.T(), "s3cr3t-gimli", buildTree.credentials["dwarves.corp"].Password)
+	require.Equal(s.T(), []string{"library/alpine:3.5"}, buildTree.pull, "pulled images must be merged")
+
+	buildTree, err = ReadBuildTreeFromFiles([]string{filepath.Join(rootFolder, "doriath.yml"), filepath.Join(rootFolder, "extra", "doriath.yml")}, map[string]string{}, nil)
+	require.Nil(s.T(), err, "several build files must be readable")
+	err = buildTree.Prepare(skipTestDirtyCheck...)
+	require.Nil(s.T(), err, "merged build tree must be able to be prepared")
+	require.Equal(s.T(), filepath.Join(rootFolder, "extra", "arwen"), buildTree.allNodes["anduin/arwen"].buildRoot)
+	require.Equal(s.T(), []string{"anduin/arwen"}, s.convertNodeToTestData(buildTree.allNodes["anduin/elrond"]).children)
+}
+
+func (s *BuildTreeTestSuite) TestIncludeErrors() {
+	dir := s.T().TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.Nil(s.T(), os.MkdirAll(filepath.Dir(path), 0755))
+		require.Nil(s.T(), ioutil.WriteFile(path, []byte(content), 0644))
+		return path
+	}
+	writeFile("a/doriath.yml", "build:\n  - name: anduin/elrond\n    tag: \"1.0\"\n    from: provided\ncredentials:\n  - name: anduin.corp\n")
+	writeFile("b/doriath.yml", "build:\n  - name: anduin/elrond\n    tag: \"2.0\"\n    from: provided\n")
+	mainFile := writeFile("doriath.yml", "include: \"*/doriath.yml\"\n")
+	_, err := ReadBuildTreeFromFile(mainFile, nil, nil)
+	duplicate, ok := stacktrace.RootCause(err).(ErrDuplicateImage)
+	require.True(s.T(), ok, "duplicate images must be detected, got %v", err)
+	require.Equal(s.T(), ErrDuplicateImage{"anduin/elrond", filepath.Join(dir, "a", "doriath.yml"), filepath.Join(dir, "b", "doriath.yml")}, duplicate)
+
+	otherFile := writeFile("other.yml", "credentials:\n  - name: anduin.corp\n")
+	_, err = ReadBuildTreeFromFiles([]string{filepath.Join(dir, "a", "doriath.yml"), otherFile}, nil, nil)
+	_, ok = stacktrace.RootCause(err).(ErrDuplicateCredential)
+	require.True(s.T(), ok, "duplicate credentials must be detected, got %v", err)
+
+	cyclicFile := writeFile("cyclic/doriath.yml", "include: [doriath.yml, ../a/doriath.yml, ../a/*.yml]\n")
+	buildTree, err := ReadBuildTreeFromFile(cyclicFile, nil, nil)
+	require.Nil(s.T(), err, "files must be included once")
+	require.Len(s.T(), buildTree.allNodes, 1)
+
+	_, err = ReadBuildTreeFromFile(writeFile("missing.yml", "include: teams/*.yml\n"), nil, nil)
+	require.NotNil(s.T(), err, "include patterns must match files")
+
+	writeFile("settings/doriath.yml", "retry:\n  attempts: 5\n")
+	_, err = ReadBuildTreeFromFile(writeFile("settings.yml", "builder: podman\ninclude: settings/doriath.yml\n"), nil, nil)
+	require.Equal(s.T(), ErrIncludedSetting{"retry", filepath.Join(dir, "settings", "doriath.yml")}, stacktrace.RootCause(err), "included files cannot set top-level settings")
+	_, err = ReadBuildTreeFromFiles([]string{filepath.Join(dir, "a", "doriath.yml"), writeFile("builder.yml", "builder: podman\n")}, nil, nil)
+	require.Equal(s.T(), ErrIncludedSetting{"builder", filepath.Join(dir, "builder.yml")}, stacktrace.RootCause(err), "config files after the first one cannot set top-level settings")
+}
+
 func (s *BuildTreeTestSuite) TestMismatchImage() {
 	rootFolder := filepath.Join(s.resourceFolder, "mismatch-image")
 	buildTree, err := ReadBuildTreeFromFile(filepath.Join(rootFolder, "doriath.yml"), map[string]string{}, nil)
@@ -243,6 +373,29 @@ func (s *BuildTreeTestSuite) TestMismatchTag() {
 	require.True(s.T(), ok)
 }
 
+func (s *BuildTreeTestSuite) TestBuildArgsInDockerfile() {
+	rootFolder := filepath.Join(s.resourceFolder, "build-args")
+	buildTree, err := ReadBuildTreeFromFile(filepath.Join(rootFolder, "doriath.yml"), map[string]string{}, nil)
+	require.Nil(s.T(), err, "build tree must be readable")
+	err = buildTree.Prepare(skipTestDirtyCheck...)
+	require.Nil(s.T(), err, "build args must override ARG defaults")
+}
+
+func (s *BuildTreeTestSuite) TestDockerfileAndTarget() {
+	rootFolder := filepath.Join(s.resourceFolder, "dockerfile-target")
+	buildTree, err := ReadBuildTreeFromFile(filepath.Join(rootFolder, "doriath.yml"), map[string]string{}, nil)
+	require.Nil(s.T(), err, "build tree must be readable")
+	err = buildTree.Prepare(skipTestDirtyCheck...)
+	require.Nil(s.T(), err, "only stages needed by the target must be checked")
+	node := buildTree.allNodes["node1"]
+	opts := buildTree.buildOptions(context.Background(), node, node.tag)
+	require.Equal(s.T(), filepath.Join(rootFolder, "node1", "Dockerfile.prod"), opts.Dockerfile)
+	require.Equal(s.T(), "prod", opts.Target)
+	require.Equal(s.T(), map[string]string{"UBUNTU_TAG": "16.04"}, opts.BuildArgs)
+	require.Equal(s.T(), "fellowship", opts.Labels["team"])
+	require.Equal(s.T(), node.contextHash, opts.Labels[utils.ContextHashLabel])
+}
+
 func (s *BuildTreeTestSuite) TestMissingProvidedImage() {
 	if !checkDockerhubTestEnable(s.Suite) {
 		s.T().Log("Skipping test missing provided image")
@@ -288,11 +441,585 @@ func (s *BuildTreeTestSuite) TestPrePostBuild() {
 	utils.RunShellCommand("docker rmi node1:1.0")
 }
 
+func (s *BuildTreeTestSuite) TestMultipleParents() {
+	rootFolder := filepath.Join(s.resourceFolder, "multi-parent")
+	buildTree, err := ReadBuildTreeFromFile(filepath.Join(rootFolder, "doriath.yml"), map[string]string{}, nil)
+	require.Nil(s.T(), err, "build tree must be readable")
+	err = buildTree.Prepare(skipTestDirtyCheck...)
+	require.Nil(s.T(), err, "build tree must be able to be prepared")
+	expectedNode := &buildNodeForTestData{
+		buildRoot: filepath.Join(rootFolder, "app"),
+		name:      "app",
+		tag:       "1.0",
+		depend:    []string{"builder", "runtime"},
+		children:  []string{},
+	}
+	require.Equal(s.T(), expectedNode, s.convertNodeToTestData(buildTree.allNodes["app"]))
+	require.Equal(s.T(), []string{"app"}, s.convertNodeToTestData(buildTree.allNodes["builder"]).children)
+	require.Equal(s.T(), []string{"app"}, s.convertNodeToTestData(buildTree.allNodes["runtime"]).children)
+	position := make(map[string]int)
+	for i, node := range buildTree.sortedNodes {
+		position[node.name] = i
+	}
+	require.Less(s.T(), position["builder"], position["app"])
+	require.Less(s.T(), position["runtime"], position["app"])
+}
+
+func (s *BuildTreeTestSuite) TestUndeclaredDependency() {
+	rootFolder := filepath.Join(s.resourceFolder, "undeclared-dependency")
+	buildTree, err := ReadBuildTreeFromFile(filepath.Join(rootFolder, "doriath.yml"), map[string]string{}, nil)
+	require.Nil(s.T(), err, "build tree must be readable")
+	err = buildTree.Prepare(skipTestDirtyCheck...)
+	_, ok := stacktrace.RootCause(err).(ErrUndeclaredDependency)
+	require.True(s.T(), ok)
+
+	rootFolder = filepath.Join(s.resourceFolder, "undeclared-other-tag")
+	buildTree, err = ReadBuildTreeFromFile(filepath.Join(rootFolder, "doriath.yml"), map[string]string{}, nil)
+	require.Nil(s.T(), err, "build tree must be readable")
+	err = buildTree.Prepare(skipTestDirtyCheck...)
+	require.Nil(s.T(), err, "other tags of images of the tree need not be declared, got %v", err)
+}
+
+func (s *BuildTreeTestSuite) TestWalkParallel() {
+	rootFolder := filepath.Join(s.resourceFolder, "parallel")
+	buildTree, err := ReadBuildTreeFromFile(filepath.Join(rootFolder, "doriath.yml"), map[string]string{}, nil)
+	require.Nil(s.T(), err, "build tree must be readable")
+	err = buildTree.Prepare(skipTestDirtyCheck...)
+	require.Nil(s.T(), err, "build tree must be able to be prepared")
+	lock := sync.Mutex{}
+	done := make(map[string]bool)
+	startedEarly := []string{}
+	err = buildTree.walk(4, func(ctx context.Context, node *buildNode, out io.Writer) error {
+		lock.Lock()
+		for _, depend := range node.depend {
+			if !done[depend] {
+				startedEarly = append(startedEarly, node.name)
+			}
+		}
+		lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		lock.Lock()
+		done[node.GetNameOrAlias()] = true
+		lock.Unlock()
+		return nil
+	})
+	require.Nil(s.T(), err)
+	require.Empty(s.T(), startedEarly, "nodes must be started after their parents completed")
+	require.Equal(s.T(), len(buildTree.allNodes), len(done), "all nodes must be processed")
+}
+
+func (s *BuildTreeTestSuite) TestWalkStopOnFailure() {
+	rootFolder := filepath.Join(s.resourceFolder, "parallel")
+	buildTree, err := ReadBuildTreeFromFile(filepath.Join(rootFolder, "doriath.yml"), map[string]string{}, nil)
+	require.Nil(s.T(), err, "build tree must be readable")
+	err = buildTree.Prepare(skipTestDirtyCheck...)
+	require.Nil(s.T(), err, "build tree must be able to be prepared")
+	lock := sync.Mutex{}
+	started := make(map[string]bool)
+	cancelled := make(map[string]bool)
+	expectedErr := errors.New("build failed")
+	begin := time.Now()
+	err = buildTree.walk(4, func(ctx context.Context, node *buildNode, out io.Writer) error {
+		lock.Lock()
+		started[node.GetNameOrAlias()] = true
+		lock.Unlock()
+		switch node.name {
+		case "a":
+			time.Sleep(10 * time.Millisecond)
+			return expectedErr
+		case "b":
+			select {
+			case <-ctx.Done():
+				lock.Lock()
+				cancelled[node.name] = true
+				lock.Unlock()
+				return ctx.Err()
+			case <-time.After(10 * time.Second):
+				return nil
+			}
+		}
+		return nil
+	})
+	require.Equal(s.T(), expectedErr, err)
+	require.True(s.T(), cancelled["b"], "running tasks must be cancelled when a task fails")
+	require.Less(s.T(), time.Since(begin), 5*time.Second, "walk must not wait for cancelled tasks to finish on their own")
+	require.False(s.T(), started["a1"], "children of a failed node must not be processed")
+	require.False(s.T(), started["b1"], "no node must be started after a failure")
+}
+
+// readRegistryTree reads the build tree of the registry test resource, with
+// images stored in a fake registry and a fake builder pushing to it
+func (s *BuildTreeTestSuite) readRegistryTree(registry *registrytest.Registry) (*BuildTree, *fakeBuilder) {
+	rootFolder := filepath.Join(s.resourceFolder, "registry")
+	buildTree, err := ReadBuildTreeFromFile(filepath.Join(rootFolder, "doriath.yml"), map[string]string{"registry": registry.Host()}, nil)
+	require.Nil(s.T(), err, "build tree must be readable")
+	builder := &fakeBuilder{registry: registry}
+	buildTree.builder = builder
+	return buildTree, builder
+}
+
+func (s *BuildTreeTestSuite) TestRegistryDirtyCheckAndPush() {
+	registry := registrytest.NewRegistry()
+	defer registry.Close()
+	registry.Username = "frodo"
+	registry.Password = "mellon"
+	registry.PutImage("library/ubuntu", "16.04", nil)
+	elrond := registry.Host() + "/anduin/elrond"
+	arwen := registry.Host() + "/anduin/arwen"
+
+	buildTree, builder := s.readRegistryTree(registry)
+	err := buildTree.Prepare()
+	require.Nil(s.T(), err, "build tree must be able to be prepared")
+	require.False(s.T(), buildTree.allNodes[registry.Host()+"/library/ubuntu"].dirty)
+	require.True(s.T(), buildTree.allNodes[elrond].dirty)
+	require.True(s.T(), buildTree.allNodes[arwen].dirty)
+	err = buildTree.Push()
+	require.Nil(s.T(), err, "build tree must be able to be pushed")
+	require.Equal(s.T(), []string{elrond + ":1.0", arwen + ":2.0"}, builder.built)
+	require.Equal(s.T(), []string{elrond + ":1.0", elrond + ":latest", arwen + ":2.0"}, builder.pushed)
+	require.Equal(s.T(), []string{"http://" + registry.Host()}, builder.logins)
+	require.Equal(s.T(), "sha256:"+elrond, buildTree.allNodes[elrond].imageID)
+	pushedDigest := buildTree.allNodes[elrond].digest
+	require.NotEmpty(s.T(), pushedDigest)
+
+	buildTree, _ = s.readRegistryTree(registry)
+	err = buildTree.Prepare()
+	require.Nil(s.T(), err, "build tree must be able to be prepared after push")
+	for name, node := range buildTree.allNodes {
+		require.False(s.T(), node.dirty, "%s must not be dirty after push", name)
+	}
+	require.Equal(s.T(), pushedDigest, buildTree.allNodes[elrond].digest, "digest must be read from the registry")
+	require.Len(s.T(), registry.TokenRequests(), 2, "a token must be requested once per repository")
+}
+
+func (s *BuildTreeTestSuite) TestRegistryContextChanged() {
+	registry := registrytest.NewRegistry()
+	defer registry.Close()
+	registry.PutImage("library/ubuntu", "16.04", nil)
+	registry.PutImage("anduin/elrond", "1.0", map[string]string{utils.ContextHashLabel: "sha256:old"})
+	buildTree, _ := s.readRegistryTree(registry)
+	err := buildTree.Prepare()
+	_, ok := stacktrace.RootCause(err).(ErrImageContextChanged)
+	require.True(s.T(), ok, "changed context must be detected, got %v", err)
+}
+
+func (s *BuildTreeTestSuite) TestRegistryOutdatedTag() {
+	registry := registrytest.NewRegistry()
+	defer registry.Close()
+	registry.PutImage("library/ubuntu", "16.04", nil)
+	registry.PutImage("anduin/arwen", "2.0", nil)
+	buildTree, _ := s.readRegistryTree(registry)
+	err := buildTree.Prepare()
+	_, ok := stacktrace.RootCause(err).(ErrImageTagOutdated)
+	require.True(s.T(), ok, "outdated tag must be detected, got %v", err)
+}
+
+func (s *BuildTreeTestSuite) TestRegistryPushRetry() {
+	registry := registrytest.NewRegistry()
+	defer registry.Close()
+	registry.PutImage("library/ubuntu", "16.04", nil)
+	buildTree, builder := s.readRegistryTree(registry)
+	buildTree.retry = &utils.RetryPolicy{Attempts: 3}
+	builder.failPushes = 2
+	err := buildTree.Prepare()
+	require.Nil(s.T(), err, "build tree must be able to be prepared")
+	err = buildTree.Push()
+	require.Nil(s.T(), err, "failed pushes must be retried")
+	elrond := registry.Host() + "/anduin/elrond:1.0"
+	require.Equal(s.T(), elrond, builder.pushed[0])
+	require.Equal(s.T(), elrond, builder.pushed[2])
+
+	buildTree, builder = s.readRegistryTree(registry)
+	buildTree.retry = &utils.RetryPolicy{Attempts: 2}
+	builder.failPushes = 2
+	for _, node := range buildTree.allNodes {
+		node.forceBuild = true
+	}
+	err = buildTree.Prepare()
+	require.Nil(s.T(), err, "build tree must be able to be prepared")
+	err = buildTree.Push()
+	require.Equal(s.T(), errPushFailed, stacktrace.RootCause(err))
+}
+
+func (s *BuildTreeTestSuite) TestRegistryFindLatestTag() {
+	registry := registrytest.NewRegistry()
+	defer registry.Close()
+	registry.PutImage("anduin/elrond", "1.0", map[string]string{"version": "1.0"})
+	registry.PutImage("anduin/elrond", "1.1", map[string]string{"version": "1.1"})
+	registry.PutImage("anduin/elrond", "latest", map[string]string{"version": "1.1"})
+	registry.PutImage("anduin/arwen", "latest", nil)
+	buildTree, _ := s.readRegistryTree(registry)
+	tag, err := buildTree.FindLatestTag(registry.Host() + "/anduin/elrond")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "1.1", tag)
+	_, err = buildTree.FindLatestTag(registry.Host() + "/anduin/arwen")
+	require.NotNil(s.T(), err, "latest without other tag must be an error")
+	digest, tags, err := buildTree.FindMatchingTags(registry.Host()+"/anduin/elrond", "1.0")
+	require.Nil(s.T(), err)
+	require.NotEmpty(s.T(), digest)
+	require.Empty(s.T(), tags)
+}
+
+func (s *BuildTreeTestSuite) TestRegistryTLS() {
+	registry := registrytest.NewTLSRegistry(nil)
+	defer registry.Close()
+	registry.Username = "frodo"
+	registry.Password = "mellon"
+	registry.PutImage("anduin/elrond", "1.0", nil)
+	registry.PutImage("anduin/elrond", "latest", nil)
+	dir := s.T().TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "ca.pem"), registry.CACertificate(), 0600)
+	require.Nil(s.T(), err)
+	auth := base64.StdEncoding.EncodeToString([]byte("frodo:mellon"))
+	dockerConfig := fmt.Sprintf(`{"auths": {%q: {"auth": %q}}}`, registry.Host(), auth)
+	err = ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(dockerConfig), 0600)
+	require.Nil(s.T(), err)
+	fileContent := fmt.Sprintf(`
+root_dir: .
+credentials:
+  - name: %q
+    registry: %q
+    ca_file: ca.pem
+`, registry.Host(), registry.URL)
+	err = ioutil.WriteFile(filepath.Join(dir, "doriath.yml"), []byte(fileContent), 0600)
+	require.Nil(s.T(), err)
+	buildTree, err := ReadBuildTreeFromFile(filepath.Join(dir, "doriath.yml"), nil, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), filepath.Join(dir, "ca.pem"), buildTree.credentials[registry.Host()].CAFile)
+	buildTree.dockerConfigDir = dir
+	tag, err := buildTree.FindLatestTag(registry.Host() + "/anduin/elrond")
+	require.Nil(s.T(), err, "CA file and docker config credential must be used")
+	require.Equal(s.T(), "1.0", tag)
+}
+
+func (s *BuildTreeTestSuite) TestRegistryECR() {
+	registry := registrytest.NewRegistry()
+	defer registry.Close()
+	registry.BasicAuth = true
+	registry.Username = "AWS"
+	registry.Password = "ecr-password"
+	registry.PutImage("anduin/elrond", "1.0", nil)
+	registry.PutImage("anduin/elrond", "latest", nil)
+	ecr := registrytest.NewECR("AKIDECR", "AWS", "ecr-password")
+	defer ecr.Close()
+	s.T().Setenv("AWS_ACCESS_KEY_ID", "AKIDECR")
+	s.T().Setenv("AWS_SECRET_ACCESS_KEY", "ecr-secret")
+	s.T().Setenv("AWS_REGION", "us-west-2")
+	fileContent := fmt.Sprintf(`
+credentials:
+  - name: %q
+    registry: %q
+    type: ecr
+    account: "123456789012"
+    region: eu-west-1
+    endpoint: %q
+  - type: ecr
+    account: "210987654321"
+`, registry.Host(), registry.URL, ecr.URL)
+	buildTree, err := ReadBuildTree(strings.NewReader(fileContent), nil, nil)
+	require.Nil(s.T(), err)
+	derived := buildTree.credentials["210987654321.dkr.ecr.us-west-2.amazonaws.com"]
+	require.NotNil(s.T(), derived, "registry must be derived from the account and the region")
+	require.Equal(s.T(), "https://210987654321.dkr.ecr.us-west-2.amazonaws.com", derived.Registry)
+	delete(buildTree.credentials, derived.Name)
+	builder := &fakeBuilder{registry: registry}
+	buildTree.builder = builder
+
+	tag, err := buildTree.FindLatestTag(registry.Host() + "/anduin/elrond")
+	require.Nil(s.T(), err, "ECR token must be used")
+	require.Equal(s.T(), "1.0", tag)
+	err = buildTree.Push()
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), []string{registry.URL}, builder.logins)
+	require.Equal(s.T(), []string{"123456789012"}, ecr.Requests(), "ECR token must be reused")
+
+	_, err = ReadBuildTree(strings.NewReader("credentials:\n  - type: ecr\n"), nil, nil)
+	require.NotNil(s.T(), err, "account must be required")
+	_, err = ReadBuildTree(strings.NewReader("credentials:\n  - name: quay.io\n    type: quay\n"), nil, nil)
+	_, ok := stacktrace.RootCause(err).(ErrUnknownCredentialType)
+	require.True(s.T(), ok, "unknown credential type must be detected, got %v", err)
+}
+
+func (s *BuildTreeTestSuite) TestRegistryGCP() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(s.T(), err)
+	oauth2 := registrytest.NewOAuth2("gcp-access-token")
+	defer oauth2.Close()
+	oauth2.PublicKey = &key.PublicKey
+	registry := registrytest.NewRegistry()
+	defer registry.Close()
+	registry.BasicAuth = true
+	registry.Username = utils.GCPTokenUsername
+	registry.Password = "gcp-access-token"
+	registry.PutImage("anduin/elrond", "1.0", nil)
+	registry.PutImage("anduin/elrond", "latest", nil)
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	keyContent, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "doriath@anduin.iam.gserviceaccount.com",
+		"private_key":  string(privateKey),
+	})
+	require.Nil(s.T(), err)
+	keyFile := filepath.Join(s.T().TempDir(), "key.json")
+	require.Nil(s.T(), ioutil.WriteFile(keyFile, keyContent, 0600))
+	fileContent := fmt.Sprintf(`
+credentials:
+  - name: %q
+    registry: %q
+    type: gcp_service_account
+    key_file: %q
+    endpoint: %q
+  - name: europe-docker.pkg.dev
+    type: gcp_service_account
+    key_file: key.json
+`, registry.Host(), registry.URL, keyFile, oauth2.URL+"/token")
+	buildTree, err := ReadBuildTree(strings.NewReader(fileContent), nil, nil)
+	require.Nil(s.T(), err)
+	derived := buildTree.credentials["europe-docker.pkg.dev"]
+	require.Equal(s.T(), "https://europe-docker.pkg.dev", derived.Registry, "registry must be derived from the name")
+	require.Equal(s.T(), "key.json", derived.KeyFile)
+
+	tag, err := buildTree.FindLatestTag(registry.Host() + "/anduin/elrond")
+	require.Nil(s.T(), err, "GCP access token must be used")
+	require.Equal(s.T(), "1.0", tag)
+	require.Equal(s.T(), []string{"/token urn:ietf:params:oauth:grant-type:jwt-bearer"}, oauth2.Requests())
+
+	_, err = ReadBuildTree(strings.NewReader("credentials:\n  - name: gcr.io\n    type: gcp_service_account\n"), nil, nil)
+	require.NotNil(s.T(), err, "key file must be required")
+}
+
+func (s *BuildTreeTestSuite) TestRegistryACR() {
+	aad := registrytest.NewOAuth2("aad-access-token")
+	defer aad.Close()
+	aad.ClientID = "doriath"
+	aad.ClientSecret = "acr-client-secret"
+	registry := registrytest.NewRegistry()
+	defer registry.Close()
+	registry.BasicAuth = true
+	registry.Username = utils.ACRTokenUsername
+	registry.Password = "acr-refresh-token"
+	registry.ExchangeToken = "aad-access-token"
+	registry.PutImage("anduin/elrond", "1.0", nil)
+	registry.PutImage("anduin/elrond", "latest", nil)
+	s.T().Setenv("AZURE_CLIENT_SECRET", "acr-client-secret")
+	fileContent := fmt.Sprintf(`
+credentials:
+  - name: %q
+    registry: %q
+    type: acr
+    tenant: anduin
+    client_id: doriath
+    endpoint: %q
+  - name: anduin.azurecr.io
+    type: acr
+    refresh_token: aad-refresh-token
+`, registry.Host(), registry.URL, aad.URL)
+	buildTree, err := ReadBuildTree(strings.NewReader(fileContent), nil, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "https://anduin.azurecr.io", buildTree.credentials["anduin.azurecr.io"].Registry, "registry must be derived from the name")
+	delete(buildTree.credentials, "anduin.azurecr.io")
+	builder := &fakeBuilder{registry: registry}
+	buildTree.builder = builder
+
+	tag, err := buildTree.FindLatestTag(registry.Host() + "/anduin/elrond")
+	require.Nil(s.T(), err, "ACR token must be used")
+	require.Equal(s.T(), "1.0", tag)
+	err = buildTree.Push()
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), []string{registry.URL}, builder.logins)
+	require.Equal(s.T(), []string{"/anduin/oauth2/v2.0/token client_credentials"}, aad.Requests(), "ACR token must be reused")
+}
+
+func (s *BuildTreeTestSuite) TestRegistryDockerConfig() {
+	registry := registrytest.NewRegistry()
+	defer registry.Close()
+	registry.Username = "frodo"
+	registry.Password = "mellon"
+	registry.PutImage("library/ubuntu", "16.04", nil)
+	elrond := registry.Host() + "/anduin/elrond"
+	dockerConfigDir, err := ioutil.TempDir("", "doriath-docker-config")
+	require.Nil(s.T(), err)
+	defer os.RemoveAll(dockerConfigDir)
+	auth := base64.StdEncoding.EncodeToString([]byte("frodo:mellon"))
+	dockerConfig := fmt.Sprintf(`{"auths": {%q: {"auth": %q}}}`, registry.Host(), auth)
+	err = ioutil.WriteFile(filepath.Join(dockerConfigDir, "config.json"), []byte(dockerConfig), 0600)
+	require.Nil(s.T(), err)
+
+	rootFolder := filepath.Join(s.resourceFolder, "registry-docker-config")
+	buildTree, err := ReadBuildTreeFromFile(filepath.Join(rootFolder, "doriath.yml"), map[string]string{"registry": registry.Host()}, nil)
+	require.Nil(s.T(), err, "build tree must be readable")
+	buildTree.dockerConfigDir = dockerConfigDir
+	err = buildTree.Prepare()
+	require.Nil(s.T(), err, "credential must be read from the docker config")
+	require.True(s.T(), buildTree.allNodes[elrond].dirty)
+
+	buildTree, err = ReadBuildTreeFromFile(filepath.Join(rootFolder, "doriath.yml"), map[string]string{"registry": registry.Host()}, nil)
+	require.Nil(s.T(), err, "build tree must be readable")
+	buildTree.dockerConfigDir = s.T().TempDir()
+	err = buildTree.Prepare()
+	_, ok := stacktrace.RootCause(err).(ErrMissingCredential)
+	require.True(s.T(), ok, "missing credential must be detected, got %v", err)
+}
+
+func (s *BuildTreeTestSuite) TestRegistryIsolatedDockerConfig() {
+	registry := registrytest.NewRegistry()
+	defer registry.Close()
+	registry.Username = "frodo"
+	registry.Password = "mellon"
+	registry.PutImage("library/ubuntu", "16.04", nil)
+	dockerConfigDir := s.T().TempDir()
+	auth := base64.StdEncoding.EncodeToString([]byte("frodo:mellon"))
+	dockerConfig := fmt.Sprintf(`{"auths": {%q: {"auth": %q}}}`, registry.Host(), auth)
+	err := ioutil.WriteFile(filepath.Join(dockerConfigDir, "config.json"), []byte(dockerConfig), 0600)
+	require.Nil(s.T(), err)
+	oldDockerConfig, hadDockerConfig := os.LookupEnv("DOCKER_CONFIG")
+
+	rootFolder := filepath.Join(s.resourceFolder, "registry-docker-config")
+	buildTree, err := ReadBuildTreeFromFile(filepath.Join(rootFolder, "doriath.yml"), map[string]string{"registry": registry.Host()}, nil)
+	require.Nil(s.T(), err, "build tree must be readable")
+	buildTree.dockerConfigDir = dockerConfigDir
+	buildTree.IsolateDockerConfig(true)
+	builder := &fakeBuilder{registry: registry}
+	buildTree.builder = builder
+	err = buildTree.Prepare()
+	require.Nil(s.T(), err, "build tree must be able to be prepared")
+	err = buildTree.Push()
+	require.Nil(s.T(), err, "images must be pushed")
+	require.Len(s.T(), builder.dockerConfigs, 1)
+	tempDir := builder.dockerConfigs[0][0]
+	require.Contains(s.T(), builder.dockerConfigs[0][1], auth, "temporary docker config must hold the credential")
+	require.NotEqual(s.T(), dockerConfigDir, tempDir, "images must be pushed with a temporary docker config")
+	require.NotEqual(s.T(), oldDockerConfig, tempDir, "images must be pushed with a temporary docker config")
+	_, err = os.Stat(tempDir)
+	require.True(s.T(), os.IsNotExist(err), "temporary docker config must be removed")
+	dockerConfigEnv, hasDockerConfig := os.LookupEnv("DOCKER_CONFIG")
+	require.Equal(s.T(), hadDockerConfig, hasDockerConfig)
+	require.Equal(s.T(), oldDockerConfig, dockerConfigEnv, "DOCKER_CONFIG must be restored")
+}
+
+func (s *BuildTreeTestSuite) TestIsolatedDockerConfigRegistries() {
+	dir := s.T().TempDir()
+	writeFile := func(name, content string) {
+		path := filepath.Join(dir, name)
+		require.Nil(s.T(), os.MkdirAll(filepath.Dir(path), 0755))
+		require.Nil(s.T(), ioutil.WriteFile(path, []byte(content), 0644))
+	}
+	writeFile("doriath.yml", `root_dir: .
+pull:
+  - pull.anduin.local/library/alpine:3.5
+build:
+  - name: base.anduin.local/library/ubuntu
+    tag: "16.04"
+    from: provided
+  - name: push.anduin.local/anduin/elrond
+    tag: "1.0"
+    from: ./elrond
+    depend: base.anduin.local/library/ubuntu
+    force_build: true
+`)
+	writeFile("elrond/Dockerfile", "FROM base.anduin.local/library/ubuntu:16.04\nCOPY --from=tools.anduin.local/anduin/tools:1.0 /bin/tool /bin/tool\n")
+	auths := []string{}
+	for _, host := range []string{"pull.anduin.local", "base.anduin.local", "push.anduin.local", "tools.anduin.local", "other.anduin.local"} {
+		auths = append(auths, fmt.Sprintf("%q: {\"auth\": %q}", host, base64.StdEncoding.EncodeToString([]byte("frodo:"+host))))
+	}
+	writeFile("docker/config.json", `{"auths": {`+strings.Join(auths, ", ")+`}}`)
+
+	buildTree, err := ReadBuildTreeFromFile(filepath.Join(dir, "doriath.yml"), nil, nil)
+	require.Nil(s.T(), err, "build tree must be readable")
+	buildTree.dockerConfigDir = filepath.Join(dir, "docker")
+	require.Nil(s.T(), buildTree.Prepare(SkipDirtyCheck()))
+	tempConfig, err := buildTree.tempDockerConfig()
+	require.Nil(s.T(), err)
+	defer tempConfig.Remove()
+	content, err := ioutil.ReadFile(filepath.Join(tempConfig.Dir, "config.json"))
+	require.Nil(s.T(), err)
+	for _, host := range []string{"pull.anduin.local", "base.anduin.local", "push.anduin.local", "tools.anduin.local"} {
+		require.Contains(s.T(), string(content), host, "credentials of the registries images are pulled from must be copied")
+	}
+	require.NotContains(s.T(), string(content), "other.anduin.local", "credentials of unused registries must not be copied")
+}
+
+var errPushFailed = errors.New("push failed")
+
+// fakeBuilder records the builder calls and pushes images to a fake registry,
+// failing the first failPushes pushes. It records the docker config directory
+// and content used by each push in dockerConfigs.
+type fakeBuilder struct {
+	registry      *registrytest.Registry
+	lock          sync.Mutex
+	built         []string
+	pushed        []string
+	logins        []string
+	labels        map[string]map[string]string
+	failPushes    int
+	dockerConfigs [][2]string
+}
+
+func (b *fakeBuilder) Name() string {
+	return "fake"
+}
+
+func (b *fakeBuilder) Detect() error {
+	return nil
+}
+
+func (b *fakeBuilder) Build(opts *utils.DockerBuildOptions, out io.Writer) (string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.built = append(b.built, opts.FullName())
+	if b.labels == nil {
+		b.labels = make(map[string]map[string]string)
+	}
+	b.labels[opts.FullName()] = opts.Labels
+	return "sha256:" + opts.Name, nil
+}
+
+func (b *fakeBuilder) Push(opts *utils.DockerBuildOptions, out io.Writer) (string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.pushed = append(b.pushed, opts.FullName())
+	dockerConfigDir := os.Getenv("DOCKER_CONFIG")
+	content, _ := ioutil.ReadFile(filepath.Join(dockerConfigDir, "config.json"))
+	b.dockerConfigs = append(b.dockerConfigs, [2]string{dockerConfigDir, string(content)})
+	if b.failPushes > 0 {
+		b.failPushes--
+		return "", errPushFailed
+	}
+	imageInfo, err := utils.ExtractDockerImageInfo(opts.FullName())
+	if err != nil {
+		return "", err
+	}
+	return b.registry.PutImage(imageInfo.ShortName, opts.Tag, opts.Labels), nil
+}
+
+func (b *fakeBuilder) Tag(name, tag, newTag string) error {
+	return nil
+}
+
+func (b *fakeBuilder) Remove(name, tag string, out io.Writer) error {
+	return nil
+}
+
+func (b *fakeBuilder) ExistsLocally(fullname string) (bool, error) {
+	return true, nil
+}
+
+func (b *fakeBuilder) Pull(fullname string, out io.Writer) error {
+	return nil
+}
+
+func (b *fakeBuilder) Login(host, username, password string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.logins = append(b.logins, host)
+	return nil
+}
+
 type buildNodeForTestData struct {
 	buildRoot  string
 	name       string
 	tag        string
-	depend     string
+	depend     []string
 	children   []string
 	dirty      bool
 	forceBuild bool
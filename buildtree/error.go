@@ -64,3 +64,131 @@ type ErrImageTagOutdated struct {
 func (e ErrImageTagOutdated) Error() string {
 	return fmt.Sprintf("image needs to be updated but still using old tag: %q", e.Name)
 }
+
+type ErrImageContextChanged struct {
+	Name string
+	Tag  string
+}
+
+func (e ErrImageContextChanged) Error() string {
+	return fmt.Sprintf("build context of %q changed but tag %q was not updated", e.Name, e.Tag)
+}
+
+type ErrUndeclaredDependency struct {
+	Name  string
+	Image string
+}
+
+func (e ErrUndeclaredDependency) Error() string {
+	return fmt.Sprintf("dockerfile of %q uses %q which is not declared in depend", e.Name, e.Image)
+}
+
+type ErrUnknownCredentialType struct {
+	Name string
+	Type string
+}
+
+func (e ErrUnknownCredentialType) Error() string {
+	return fmt.Sprintf("unknown type %q for credential %q", e.Type, e.Name)
+}
+
+type ErrDuplicateImage struct {
+	Name      string
+	File      string
+	OtherFile string
+}
+
+func (e ErrDuplicateImage) Error() string {
+	return fmt.Sprintf("image %q is declared in both %q and %q", e.Name, e.File, e.OtherFile)
+}
+
+type ErrDuplicateCredential struct {
+	Name      string
+	File      string
+	OtherFile string
+}
+
+func (e ErrDuplicateCredential) Error() string {
+	return fmt.Sprintf("credential %q is declared in both %q and %q", e.Name, e.File, e.OtherFile)
+}
+
+type ErrMissingVariable struct {
+	Name string
+	File string
+	// Line is the line using the variable, zero for a required variable
+	Line int
+}
+
+func (e ErrMissingVariable) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("variable %q required by %q is not set, pass it with --variable or --variableFile", e.Name, e.File)
+	}
+	return fmt.Sprintf("variable %q used in %q line %d is not set, pass it with --variable or --variableFile, or declare it with a default in variables", e.Name, e.File, e.Line)
+}
+
+type ErrInvalidVariable struct {
+	Name    string
+	File    string
+	Pattern string
+}
+
+func (e ErrInvalidVariable) Error() string {
+	return fmt.Sprintf("value of variable %q declared in %q does not match %q", e.Name, e.File, e.Pattern)
+}
+
+type ErrUnknownProfile struct {
+	Name string
+}
+
+func (e ErrUnknownProfile) Error() string {
+	return fmt.Sprintf("profile %q is not declared in any config file", e.Name)
+}
+
+type ErrUnknownKey struct {
+	Key    string
+	File   string
+	Line   int
+	Column int
+}
+
+func (e ErrUnknownKey) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("unknown key %q in %q once rendered", e.Key, e.File)
+	}
+	return fmt.Sprintf("unknown key %q in %q line %d column %d", e.Key, e.File, e.Line, e.Column)
+}
+
+type ErrProvidedImageHook struct {
+	Name string
+	Hook string
+}
+
+func (e ErrProvidedImageHook) Error() string {
+	return fmt.Sprintf("provided image %q cannot have %s", e.Name, e.Hook)
+}
+
+type ErrConflictingPassword struct {
+	Name string
+}
+
+func (e ErrConflictingPassword) Error() string {
+	return fmt.Sprintf("credential %q sets both password and password_file", e.Name)
+}
+
+type ErrMissingBuildContext struct {
+	Name string
+	Dir  string
+}
+
+func (e ErrMissingBuildContext) Error() string {
+	return fmt.Sprintf("build context of %q is not a folder: %q", e.Name, e.Dir)
+}
+
+type ErrIncludedSetting struct {
+	Key  string
+	File string
+}
+
+func (e ErrIncludedSetting) Error() string {
+	return fmt.Sprintf("%q can only be set in the main config file, not in %q", e.Key, e.File)
+}
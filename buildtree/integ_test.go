@@ -4,7 +4,6 @@ import (
 	"path/filepath"
 	"testing"
 
-	"github.com/anduintransaction/doriath/utils"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
@@ -29,8 +28,8 @@ func (s *IntegTestSuite) TestBuildPush() {
 	require.Nil(s.T(), err, "build tree must be able to be prepared")
 	err = buildTree.Push()
 	require.Nil(s.T(), err, "build tree must be able to be built")
-	utils.DockerRMI("anduin/doriath-test", "1.1")
-	utils.DockerRMI("anduin/doriath-test", "latest")
+	buildTree.builder.Remove("anduin/doriath-test", "1.1", nil)
+	buildTree.builder.Remove("anduin/doriath-test", "latest", nil)
 }
 
 func TestInteg(t *testing.T) {
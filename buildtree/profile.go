@@ -0,0 +1,209 @@
+package buildtree
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type readOpt struct {
+	profile string
+}
+
+// ReadOptFn is an option of ReadBuildTree, ReadBuildTreeFromFile and
+// ReadBuildTreeFromFiles
+type ReadOptFn func(opt *readOpt)
+
+// UseProfile applies the profile with the given name of every config file
+// declaring it. At least one file must declare it.
+func UseProfile(name string) ReadOptFn {
+	return func(opt *readOpt) {
+		opt.profile = name
+	}
+}
+
+// profileConfig is a profile of a config file, overlaying its entries
+type profileConfig struct {
+	Variables   map[string]interface{} `yaml:"variables"`
+	Pull        []string               `yaml:"pull"`
+	Build       []*buildNodeConfig     `yaml:"build"`
+	Credentials []*credentialConfig    `yaml:"credentials"`
+}
+
+// readProfileVariables reads the variables of a profile of a config file
+// before it is rendered, like variable declarations. It returns false if the
+// file does not declare the profile.
+func readProfileVariables(path string, fileContent []byte, profile string) (map[string]interface{}, bool, error) {
+	profiles := &struct {
+		Profiles map[string]struct {
+			Variables map[string]interface{} `yaml:"variables"`
+		} `yaml:"profiles"`
+	}{}
+	block, err := topLevelBlock(path, fileContent, "profiles")
+	if err != nil {
+		return nil, false, err
+	}
+	err = yaml.Unmarshal(block, profiles)
+	if err != nil {
+		return nil, false, stacktrace.Propagate(err, "Cannot decode profiles of %q", displayPath(path))
+	}
+	values, ok := profiles.Profiles[profile]
+	if !ok {
+		return nil, false, nil
+	}
+	variables, _ := normalizeVariable(values.Variables).(map[string]interface{})
+	return variables, true, nil
+}
+
+// applyProfile overlays a profile on a rendered config file and returns the
+// new document with the changes made. Entries of build and credentials are
+// matched by name, or by alias for build entries: maps like build_args are
+// merged, other fields are replaced, and new entries are added. Images of pull
+// are added.
+func applyProfile(document []byte, profile string) ([]byte, []string, error) {
+	doc := make(map[interface{}]interface{})
+	err := yaml.Unmarshal(document, &doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	profiles, _ := doc["profiles"].(map[interface{}]interface{})
+	overlay, ok := profiles[profile]
+	if !ok {
+		return document, nil, nil
+	}
+	overlayMap, ok := overlay.(map[interface{}]interface{})
+	if !ok && overlay != nil {
+		return nil, nil, stacktrace.NewError("Profile %q must be a map", profile)
+	}
+	changes := []string{}
+	for _, key := range sortedKeys(overlayMap) {
+		value := overlayMap[key]
+		switch key {
+		case "variables":
+			// Applied before rendering
+		case "build", "credentials":
+			merged, entryChanges, err := mergeNamedEntries(doc[key], value, fmt.Sprint(key))
+			if err != nil {
+				return nil, nil, err
+			}
+			doc[key] = merged
+			changes = append(changes, entryChanges...)
+		case "pull":
+			pull, _ := doc["pull"].([]interface{})
+			images, ok := value.([]interface{})
+			if !ok {
+				return nil, nil, stacktrace.NewError("pull of profile %q must be a list", profile)
+			}
+			for _, image := range images {
+				if !containsValue(pull, image) {
+					pull = append(pull, image)
+					changes = append(changes, fmt.Sprintf("pull %v", image))
+				}
+			}
+			doc["pull"] = pull
+		default:
+			return nil, nil, stacktrace.NewError("Unknown key %q in profile %q, only build, pull, credentials and variables can be overlaid", key, profile)
+		}
+	}
+	merged, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, nil, stacktrace.Propagate(err, "Cannot encode build file with profile %q", profile)
+	}
+	return merged, changes, nil
+}
+
+// mergeNamedEntries merges the entries of a profile into the build or the
+// credentials entries of a config file
+func mergeNamedEntries(base, overlay interface{}, section string) ([]interface{}, []string, error) {
+	entries, _ := base.([]interface{})
+	overlayEntries, ok := overlay.([]interface{})
+	if !ok {
+		return nil, nil, stacktrace.NewError("%s must be a list", section)
+	}
+	changes := []string{}
+	for _, overlayEntry := range overlayEntries {
+		overlayMap, ok := overlayEntry.(map[interface{}]interface{})
+		if !ok {
+			return nil, nil, stacktrace.NewError("Entries of %s must be maps", section)
+		}
+		name := entryName(overlayMap)
+		if name == "" {
+			return nil, nil, stacktrace.NewError("Missing name of an entry of %s", section)
+		}
+		var target map[interface{}]interface{}
+		for _, entry := range entries {
+			entryMap, _ := entry.(map[interface{}]interface{})
+			if entryMap != nil && (entryName(entryMap) == name || fmt.Sprint(entryMap["name"]) == name) {
+				target = entryMap
+				break
+			}
+		}
+		if target == nil {
+			entries = append(entries, overlayMap)
+			changes = append(changes, fmt.Sprintf("%s %s: added", section, name))
+			continue
+		}
+		fields := mergeMaps(target, overlayMap, "")
+		if len(fields) > 0 {
+			changes = append(changes, fmt.Sprintf("%s %s: %s", section, name, strings.Join(fields, ", ")))
+		}
+	}
+	return entries, changes, nil
+}
+
+// entryName returns the alias of an entry, or its name
+func entryName(entry map[interface{}]interface{}) string {
+	for _, key := range []string{"alias", "name"} {
+		if value, ok := entry[key]; ok && value != nil && fmt.Sprint(value) != "" {
+			return fmt.Sprint(value)
+		}
+	}
+	return ""
+}
+
+// mergeMaps merges overlay into base recursively, replacing values which are
+// not maps, and returns the dotted paths of the fields set
+func mergeMaps(base, overlay map[interface{}]interface{}, prefix string) []string {
+	fields := []string{}
+	for _, key := range sortedKeys(overlay) {
+		value := overlay[key]
+		path := prefix + fmt.Sprint(key)
+		baseMap, baseIsMap := base[key].(map[interface{}]interface{})
+		overlayMap, overlayIsMap := value.(map[interface{}]interface{})
+		if baseIsMap && overlayIsMap {
+			fields = append(fields, mergeMaps(baseMap, overlayMap, path+".")...)
+			continue
+		}
+		if key == "name" || key == "alias" {
+			if fmt.Sprint(base[key]) == fmt.Sprint(value) {
+				continue
+			}
+		}
+		base[key] = value
+		fields = append(fields, path)
+	}
+	return fields
+}
+
+func sortedKeys(values map[interface{}]interface{}) []interface{} {
+	keys := make([]interface{}, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+	return keys
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if fmt.Sprint(v) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
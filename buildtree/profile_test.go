@@ -0,0 +1,94 @@
+package buildtree
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/palantir/stacktrace"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ProfileTestSuite struct {
+	suite.Suite
+	configFile string
+}
+
+func (s *ProfileTestSuite) SetupTest() {
+	s.configFile = filepath.Join("../test-resources", "profiles", "doriath.yml")
+}
+
+func (s *ProfileTestSuite) TestWithoutProfile() {
+	buildTree, err := ReadBuildTreeFromFile(s.configFile, nil, nil)
+	require.Nil(s.T(), err, "build tree must be readable")
+	base := buildTree.allNodes["base"]
+	require.Equal(s.T(), "registry.anduin.local/anduin/base", base.name)
+	require.Equal(s.T(), "1.0", base.tag)
+	require.Equal(s.T(), map[string]string{"team": "core", "env": "dev"}, base.labels)
+	require.Nil(s.T(), buildTree.allNodes["anduin/arwen"], "profiles must not be applied by default")
+	require.Empty(s.T(), buildTree.pull)
+	require.Equal(s.T(), "dev-password", buildTree.credentials["registry.anduin.local"].Password)
+}
+
+func (s *ProfileTestSuite) TestProfile() {
+	buildTree, err := ReadBuildTreeFromFile(s.configFile, nil, nil, UseProfile("prod"))
+	require.Nil(s.T(), err, "build tree must be readable with a profile")
+	base := buildTree.allNodes["base"]
+	require.Equal(s.T(), "registry.anduin.prod/anduin/base", base.name, "variables of the profile must be used")
+	require.Equal(s.T(), "2.0", base.tag)
+	require.Equal(s.T(), map[string]string{"team": "core", "env": "prod"}, base.labels, "maps must be merged")
+	require.NotNil(s.T(), buildTree.allNodes["anduin/elrond"])
+	require.NotNil(s.T(), buildTree.allNodes["anduin/arwen"], "profiles of included files must be applied")
+	require.Equal(s.T(), []string{"library/alpine:3.5"}, buildTree.pull)
+	credential := buildTree.credentials["registry.anduin.prod"]
+	require.Equal(s.T(), "anduin", credential.Username)
+	require.Equal(s.T(), "prod-password", credential.Password)
+
+	elvesFile := filepath.Join("../test-resources", "profiles", "elves", "doriath.yml")
+	expected := []string{
+		"variables registry (" + s.configFile + ")",
+		"build base: labels.env, tag (" + s.configFile + ")",
+		"credentials registry.anduin.prod: password (" + s.configFile + ")",
+		"pull library/alpine:3.5 (" + s.configFile + ")",
+		"build anduin/arwen: added (" + elvesFile + ")",
+	}
+	require.Equal(s.T(), expected, buildTree.profileChanges)
+	require.Contains(s.T(), buildTree.Variables(), &VariableValue{"registry", "registry.anduin.prod", "profile prod of " + s.configFile})
+
+	buildTree, err = ReadBuildTreeFromFile(s.configFile, map[string]string{"registry": "quay.io"}, nil, UseProfile("prod"))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "quay.io/anduin/base", buildTree.allNodes["base"].name, "variables must take precedence over the profile")
+	require.Equal(s.T(), "2.0", buildTree.allNodes["base"].tag)
+	require.Equal(s.T(), "dev-password", buildTree.credentials["quay.io"].Password, "credentials of other registries must be kept")
+}
+
+func (s *ProfileTestSuite) TestErrors() {
+	_, err := ReadBuildTreeFromFile(s.configFile, nil, nil, UseProfile("staging"))
+	unknown, ok := stacktrace.RootCause(err).(ErrUnknownProfile)
+	require.True(s.T(), ok, "unknown profiles must be reported, got %v", err)
+	require.Equal(s.T(), "staging", unknown.Name)
+
+	config := `build:
+  - name: anduin/elrond
+    tag: "1.0"
+    from: provided
+profiles:
+  prod:
+    root_dir: /tmp
+`
+	for _, optFns := range [][]ReadOptFn{{UseProfile("prod")}, nil} {
+		_, err = ReadBuildTree(strings.NewReader(config), nil, nil, optFns...)
+		unknownKey, ok := stacktrace.RootCause(err).(ErrUnknownKey)
+		require.True(s.T(), ok, "only build, pull, credentials and variables can be overlaid, got %v", err)
+		require.Equal(s.T(), ErrUnknownKey{"profiles.prod.root_dir", "<input>", 7, 5}, unknownKey)
+	}
+
+	config = "profiles:\n  prod:\n    build:\n      - tag: \"2.0\"\n"
+	_, err = ReadBuildTree(strings.NewReader(config), nil, nil, UseProfile("prod"))
+	require.NotNil(s.T(), err, "entries of a profile must be named")
+}
+
+func TestProfile(t *testing.T) {
+	suite.Run(t, new(ProfileTestSuite))
+}
@@ -0,0 +1,133 @@
+package buildtree
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/anduintransaction/doriath/utils"
+	"github.com/palantir/stacktrace"
+)
+
+type buildOpt struct {
+	jobs int
+}
+
+// BuildOptFn sets an option for Build, TryBuild and Push
+type BuildOptFn func(opt *buildOpt)
+
+// WithJobs sets the maximum number of nodes processed at the same time
+func WithJobs(jobs int) BuildOptFn {
+	return func(opt *buildOpt) {
+		opt.jobs = jobs
+	}
+}
+
+func newBuildOpt(optFns []BuildOptFn) *buildOpt {
+	opt := &buildOpt{
+		jobs: 1,
+	}
+	for _, fn := range optFns {
+		fn(opt)
+	}
+	if opt.jobs < 1 {
+		opt.jobs = 1
+	}
+	return opt
+}
+
+// nodeTask processes a single node, sending its output to out. It must stop
+// when ctx is done.
+type nodeTask func(ctx context.Context, node *buildNode, out io.Writer) error
+
+type nodeTaskResult struct {
+	node *buildNode
+	err  error
+}
+
+// walk runs task on every node of the tree, with at most jobs tasks running at
+// the same time. A node is started as soon as all of its parents are done. When
+// a task fails or on interrupt, no new node is started, running tasks are
+// cancelled and the first error is returned.
+func (t *BuildTree) walk(jobs int, task nodeTask) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pending := make(map[*buildNode]int)
+	for _, node := range t.allNodes {
+		for _, child := range node.children {
+			pending[child]++
+		}
+	}
+	// ready is used as a stack so that a single job walks the tree depth first
+	ready := []*buildNode{}
+	for i := len(t.rootNodes) - 1; i >= 0; i-- {
+		ready = append(ready, t.rootNodes[i])
+	}
+	results := make(chan *nodeTaskResult)
+	running := 0
+	var firstErr error
+	for {
+		if firstErr == nil && ctx.Err() != nil {
+			firstErr = stacktrace.Propagate(ctx.Err(), "Interrupted")
+		}
+		for firstErr == nil && len(ready) > 0 && running < jobs {
+			node := ready[len(ready)-1]
+			ready = ready[:len(ready)-1]
+			running++
+			go func(node *buildNode) {
+				results <- &nodeTaskResult{
+					node: node,
+					err:  t.runTask(ctx, node, jobs, task),
+				}
+			}(node)
+		}
+		if running == 0 {
+			return firstErr
+		}
+		var result *nodeTaskResult
+		select {
+		case result = <-results:
+		case <-ctx.Done():
+			if firstErr == nil {
+				firstErr = stacktrace.Propagate(ctx.Err(), "Interrupted")
+				utils.Warn("====> Interrupted, cancelling %d running job(s)", running)
+			}
+			result = <-results
+		}
+		running--
+		if result.err != nil {
+			if firstErr == nil {
+				firstErr = result.err
+				if running > 0 {
+					utils.Warn("====> %s failed, cancelling %d running job(s)", result.node.name, running)
+				}
+				cancel()
+			} else if ctx.Err() == nil {
+				utils.Error(result.err)
+			}
+			continue
+		}
+		children := result.node.children
+		for i := len(children) - 1; i >= 0; i-- {
+			child := children[i]
+			pending[child]--
+			if pending[child] == 0 {
+				ready = append(ready, child)
+			}
+		}
+	}
+}
+
+func (t *BuildTree) runTask(ctx context.Context, node *buildNode, jobs int, task nodeTask) error {
+	if jobs <= 1 {
+		return task(ctx, node, nil)
+	}
+	out := utils.NewPrefixWriter("["+node.GetNameOrAlias()+"] ", os.Stdout)
+	err := task(ctx, node, out)
+	out.Flush()
+	return err
+}
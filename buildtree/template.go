@@ -0,0 +1,212 @@
+package buildtree
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/anduintransaction/doriath/utils"
+	"github.com/palantir/stacktrace"
+)
+
+// configTemplate is the template of a config file
+type configTemplate struct {
+	*template.Template
+	// optional holds the paths of the variables given to default and
+	// required, which may be missing
+	optional [][]string
+}
+
+// newConfigTemplate parses the template of a config file, failing on missing
+// variables unless they are given to default or required
+func newConfigTemplate(configFolder, content string) (*configTemplate, error) {
+	tmpl, err := template.New("doriath").Funcs(templateFuncs(configFolder)).Parse(content)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot parse build file template")
+	}
+	t := &configTemplate{Template: tmpl.Option("missingkey=error")}
+	t.addOptional(tmpl.Tree.Root)
+	return t, nil
+}
+
+// addOptional adds the fields given to default and required in the nodes of
+// a template. Fields under range and with are relative to another value and
+// are left out.
+func (t *configTemplate) addOptional(node parse.Node) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return
+		}
+		for _, child := range node.Nodes {
+			t.addOptional(child)
+		}
+	case *parse.ActionNode:
+		t.addOptional(node.Pipe)
+	case *parse.IfNode:
+		t.addOptional(node.Pipe)
+		t.addOptional(node.List)
+		t.addOptional(node.ElseList)
+	case *parse.RangeNode:
+		t.addOptional(node.Pipe)
+	case *parse.WithNode:
+		t.addOptional(node.Pipe)
+	case *parse.TemplateNode:
+		t.addOptional(node.Pipe)
+	case *parse.PipeNode:
+		if node == nil {
+			return
+		}
+		for i, cmd := range node.Cmds {
+			if identifier, ok := cmd.Args[0].(*parse.IdentifierNode); ok && (identifier.Ident == "default" || identifier.Ident == "required") {
+				for _, arg := range cmd.Args[1:] {
+					if field, ok := arg.(*parse.FieldNode); ok {
+						t.optional = append(t.optional, field.Ident)
+					}
+				}
+				if i > 0 && len(node.Cmds[i-1].Args) == 1 {
+					if field, ok := node.Cmds[i-1].Args[0].(*parse.FieldNode); ok {
+						t.optional = append(t.optional, field.Ident)
+					}
+				}
+			}
+			for _, arg := range cmd.Args {
+				if pipe, ok := arg.(*parse.PipeNode); ok {
+					t.addOptional(pipe)
+				}
+			}
+		}
+	}
+}
+
+// execute renders the template with values, the missing variables given to
+// default or required being empty
+func (t *configTemplate) execute(w io.Writer, values map[string]interface{}) error {
+	values = copyValues(values)
+	for _, path := range t.optional {
+		current := values
+		for i, segment := range path {
+			value, exists := current[segment]
+			if i == len(path)-1 {
+				if !exists {
+					current[segment] = ""
+				}
+				break
+			}
+			child, ok := value.(map[string]interface{})
+			if exists && !ok {
+				break
+			}
+			child = copyValues(child)
+			current[segment] = child
+			current = child
+		}
+	}
+	return t.Execute(w, values)
+}
+
+// copyValues returns a shallow copy of values
+func copyValues(values map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		result[key] = value
+	}
+	return result
+}
+
+// templateFuncs returns the functions of config templates. Paths and git
+// commands are relative to configFolder, the folder of the config file.
+func templateFuncs(configFolder string) template.FuncMap {
+	return template.FuncMap{
+		"env":      os.Getenv,
+		"default":  defaultValue,
+		"required": required,
+		"file": func(path string) (string, error) {
+			content, err := ioutil.ReadFile(utils.ResolveDir(configFolder, path))
+			if err != nil {
+				return "", stacktrace.Propagate(err, "Cannot read file %q", path)
+			}
+			return strings.TrimSpace(string(content)), nil
+		},
+		"sha256file": func(path string) (string, error) {
+			return utils.HashFile(utils.ResolveDir(configFolder, path))
+		},
+		"hashDir": func(path string) (string, error) {
+			hash, err := utils.HashBuildContext(utils.ResolveDir(configFolder, path), "")
+			return strings.TrimPrefix(hash, "sha256:"), err
+		},
+		"gitSha": func() (string, error) {
+			return git(configFolder, "rev-parse", "HEAD")
+		},
+		"gitBranch": func() (string, error) {
+			return git(configFolder, "rev-parse", "--abbrev-ref", "HEAD")
+		},
+		"gitTag": func() string {
+			// Not an error when HEAD is not tagged, so that a default can be used
+			tag, _ := git(configFolder, "describe", "--tags", "--exact-match")
+			return tag
+		},
+		"now": func() time.Time {
+			return time.Now().UTC()
+		},
+		"date": func(layout string, t time.Time) string {
+			return t.Format(layout)
+		},
+		"lower":   strings.ToLower,
+		"replace": func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+		"trunc":   trunc,
+	}
+}
+
+// defaultValue returns value, or defaultValue when value is empty
+func defaultValue(defaultValue string, value interface{}) string {
+	if s := toString(value); s != "" {
+		return s
+	}
+	return defaultValue
+}
+
+// required returns value, or fails with message when value is empty
+func required(message string, value interface{}) (string, error) {
+	if toString(value) == "" {
+		return "", stacktrace.NewError("%s", message)
+	}
+	return toString(value), nil
+}
+
+// trunc keeps the first length characters of s
+func trunc(length int, s string) string {
+	runes := []rune(s)
+	if length < 0 || length >= len(runes) {
+		return s
+	}
+	return string(runes[:length])
+}
+
+// toString formats a variable, nil is empty
+func toString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return fmt.Sprint(value)
+}
+
+// git runs a git command in dir and returns its trimmed output
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	if err != nil {
+		return "", stacktrace.Propagate(err, "Cannot run git %s in %q", strings.Join(args, " "), dir)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
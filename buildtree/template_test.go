@@ -0,0 +1,147 @@
+package buildtree
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anduintransaction/doriath/utils"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type TemplateTestSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (s *TemplateTestSuite) SetupTest() {
+	s.dir = s.T().TempDir()
+}
+
+// render renders a config template in the test folder
+func (s *TemplateTestSuite) render(content string, variables map[string]string) (string, error) {
+	tmpl, err := newConfigTemplate(s.dir, content)
+	if err != nil {
+		return "", err
+	}
+	values := make(map[string]interface{})
+	for name, value := range variables {
+		values[name] = value
+	}
+	b := &strings.Builder{}
+	err = tmpl.execute(b, values)
+	return b.String(), err
+}
+
+func (s *TemplateTestSuite) requireRender(expected, content string, variables map[string]string) {
+	rendered, err := s.render(content, variables)
+	require.Nil(s.T(), err, "%s must be rendered", content)
+	require.Equal(s.T(), expected, rendered, content)
+}
+
+func (s *TemplateTestSuite) writeFile(name, content string) {
+	path := filepath.Join(s.dir, name)
+	require.Nil(s.T(), os.MkdirAll(filepath.Dir(path), 0755))
+	require.Nil(s.T(), ioutil.WriteFile(path, []byte(content), 0644))
+}
+
+func (s *TemplateTestSuite) git(args ...string) {
+	cmd := exec.Command("git", append([]string{"-c", "user.name=doriath", "-c", "user.email=doriath@anduin", "-c", "commit.gpgsign=false", "-c", "tag.gpgsign=false"}, args...)...)
+	cmd.Dir = s.dir
+	output, err := cmd.CombinedOutput()
+	require.Nil(s.T(), err, string(output))
+}
+
+func (s *TemplateTestSuite) TestNoEscaping() {
+	s.requireRender("1.0+build&co <b>", "{{.tag}}", map[string]string{"tag": "1.0+build&co <b>"})
+}
+
+func (s *TemplateTestSuite) TestEnvDefaultRequired() {
+	s.T().Setenv("DORIATH_TEMPLATE_TEST", "elrond")
+	s.requireRender("elrond", `{{env "DORIATH_TEMPLATE_TEST"}}`, nil)
+	s.requireRender("", `{{env "DORIATH_TEMPLATE_MISSING"}}`, nil)
+	s.requireRender("dev", `{{env "DORIATH_TEMPLATE_MISSING" | default "dev"}}`, nil)
+	s.requireRender("elrond", `{{env "DORIATH_TEMPLATE_TEST" | default "dev"}}`, nil)
+	s.requireRender("dev", `{{.tag | default "dev"}}`, map[string]string{"tag": ""})
+	s.requireRender("dev", `{{.tag | default "dev"}}`, nil)
+	s.requireRender("dev dev", `{{default "dev" .versions.node}} {{if true}}{{lower (.branch | default "DEV")}}{{end}}`, nil)
+	_, err := s.render(`{{.tag | default "dev"}} {{.other}}`, nil)
+	require.NotNil(s.T(), err, "variables which are not given to default must still be required")
+	_, err = s.render(`{{.tag | required "tag is required"}}`, nil)
+	require.NotNil(s.T(), err)
+	require.Contains(s.T(), err.Error(), "tag is required", "required must fail on variables which are not set")
+	s.requireRender("elrond", `{{env "DORIATH_TEMPLATE_TEST" | required "name is required"}}`, nil)
+	_, err = s.render(`{{env "DORIATH_TEMPLATE_MISSING" | required "name is required"}}`, nil)
+	require.NotNil(s.T(), err)
+	require.Contains(s.T(), err.Error(), "name is required")
+}
+
+func (s *TemplateTestSuite) TestFiles() {
+	s.writeFile("VERSION", "1.2.3\n")
+	s.writeFile("context/Dockerfile", "FROM scratch\n")
+	s.writeFile("context/app.txt", "arwen")
+	s.requireRender("1.2.3", `{{file "VERSION"}}`, nil)
+	s.requireRender("1.2.3", `{{file "`+filepath.Join(s.dir, "VERSION")+`"}}`, nil)
+	fileHash, err := utils.HashFile(filepath.Join(s.dir, "VERSION"))
+	require.Nil(s.T(), err)
+	s.requireRender(fileHash, `{{sha256file "VERSION"}}`, nil)
+	s.requireRender(fileHash[:8], `{{sha256file "VERSION" | trunc 8}}`, nil)
+	contextHash, err := utils.HashBuildContext(filepath.Join(s.dir, "context"), "")
+	require.Nil(s.T(), err)
+	s.requireRender(strings.TrimPrefix(contextHash, "sha256:"), `{{hashDir "context"}}`, nil)
+	for _, content := range []string{`{{file "missing"}}`, `{{sha256file "missing"}}`, `{{hashDir "missing"}}`} {
+		_, err := s.render(content, nil)
+		require.NotNil(s.T(), err, "%s must fail", content)
+	}
+}
+
+func (s *TemplateTestSuite) TestGit() {
+	s.git("init", "-q", "-b", "main")
+	s.writeFile("VERSION", "1.0")
+	s.git("add", "VERSION")
+	s.git("commit", "-q", "-m", "Initial commit")
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = s.dir
+	sha, err := cmd.Output()
+	require.Nil(s.T(), err)
+	s.requireRender(strings.TrimSpace(string(sha)), "{{gitSha}}", nil)
+	s.requireRender(string(sha[:8]), "{{gitSha | trunc 8}}", nil)
+	s.requireRender("main", "{{gitBranch}}", nil)
+	s.requireRender("dev", `{{gitTag | default "dev"}}`, nil)
+	s.git("tag", "v1.0")
+	s.requireRender("v1.0", "{{gitTag}}", nil)
+
+	s.dir = s.T().TempDir()
+	_, err = s.render("{{gitSha}}", nil)
+	require.NotNil(s.T(), err, "gitSha must fail outside of a git repository")
+}
+
+func (s *TemplateTestSuite) TestDateAndStrings() {
+	rendered, err := s.render(`{{now | date "2006-01-02"}}`, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), time.Now().UTC().Format("2006-01-02"), rendered)
+	rendered, err = s.render(`{{now.Unix}}`, nil)
+	require.Nil(s.T(), err)
+	require.NotEmpty(s.T(), rendered)
+	s.requireRender("feature-elrond", `{{.branch | lower | replace "/" "-"}}`, map[string]string{"branch": "Feature/Elrond"})
+	s.requireRender("elr", `{{.name | trunc 3}}`, map[string]string{"name": "elrond"})
+	s.requireRender("elrond", `{{.name | trunc 20}}`, map[string]string{"name": "elrond"})
+}
+
+func (s *TemplateTestSuite) TestConfigFolder() {
+	s.writeFile("teams/elves/VERSION", "2.0\n")
+	s.writeFile("teams/elves/doriath.yml", "build:\n  - name: anduin/elrond\n    tag: \"{{file \"VERSION\"}}\"\n    from: provided\n")
+	s.writeFile("doriath.yml", "include: teams/*/doriath.yml\n")
+	buildTree, err := ReadBuildTreeFromFile(filepath.Join(s.dir, "doriath.yml"), nil, nil)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "2.0", buildTree.allNodes["anduin/elrond"].tag, "files must be relative to the config file")
+}
+
+func TestTemplate(t *testing.T) {
+	suite.Run(t, new(TemplateTestSuite))
+}
@@ -0,0 +1,180 @@
+package buildtree
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// checkSourceKeys checks that every key of a config file is a field of the
+// config before it is rendered, so that errors give positions in the file.
+// Keys written with templates, and files which are not valid yaml before
+// rendering, are left to checkRenderedKeys.
+func checkSourceKeys(path string, fileContent []byte) error {
+	root := &yamlv3.Node{}
+	if yamlv3.Unmarshal(fileContent, root) != nil {
+		return nil
+	}
+	return unknownKeyError(path, root, true)
+}
+
+// checkRenderedKeys checks the keys of a rendered config file. Templates may
+// have moved lines, so positions are not reported.
+func checkRenderedKeys(path string, document []byte) error {
+	root := &yamlv3.Node{}
+	err := yamlv3.Unmarshal(document, root)
+	if err != nil {
+		return err
+	}
+	return unknownKeyError(path, root, false)
+}
+
+// unknownKeyError returns the first unknown key of a document, with its
+// position if withPosition is set
+func unknownKeyError(path string, root *yamlv3.Node, withPosition bool) error {
+	if len(root.Content) == 0 {
+		return nil
+	}
+	unknown := unknownKeys(root.Content[0], reflect.TypeOf(config{}), "")
+	if len(unknown) == 0 {
+		return nil
+	}
+	unknownKey := unknown[0]
+	unknownKey.File = displayPath(path)
+	if !withPosition {
+		unknownKey.Line, unknownKey.Column = 0, 0
+	}
+	return stacktrace.Propagate(unknownKey, "Unknown key %q", unknownKey.Key)
+}
+
+// unknownKeys returns the keys of node which are not fields of t, in the
+// order of the document
+func unknownKeys(node *yamlv3.Node, t reflect.Type, prefix string) []ErrUnknownKey {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if node.Kind == yamlv3.AliasNode {
+		node = node.Alias
+	}
+	unknown := []ErrUnknownKey{}
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yamlv3.MappingNode {
+			// Wrong types are reported when decoding
+			return unknown
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Kind != yamlv3.ScalarNode || strings.Contains(key.Value, "{{") {
+				// Written with a template, checked once rendered
+				continue
+			}
+			if key.Value == "<<" {
+				unknown = append(unknown, unknownKeys(value, t, prefix)...)
+				continue
+			}
+			field, ok := fields[key.Value]
+			if !ok {
+				unknown = append(unknown, ErrUnknownKey{Key: prefix + key.Value, Line: key.Line, Column: key.Column})
+				continue
+			}
+			unknown = append(unknown, unknownKeys(value, field, prefix+key.Value+".")...)
+		}
+	case reflect.Slice:
+		if node.Kind != yamlv3.SequenceNode {
+			return unknown
+		}
+		for i, item := range node.Content {
+			itemPrefix := fmt.Sprintf("%s[%d].", strings.TrimSuffix(prefix, "."), i)
+			unknown = append(unknown, unknownKeys(item, t.Elem(), itemPrefix)...)
+		}
+	case reflect.Map:
+		if node.Kind != yamlv3.MappingNode {
+			return unknown
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			unknown = append(unknown, unknownKeys(node.Content[i+1], t.Elem(), prefix+node.Content[i].Value+".")...)
+		}
+	}
+	return unknown
+}
+
+// yamlFields returns the types of the fields of a struct by their yaml key
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		options := strings.Split(field.Tag.Get("yaml"), ",")
+		name := options[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// checkIncludedConfig checks that a file other than the main config file does
+// not set settings which are only read from the main config file
+func checkIncludedConfig(buildConfig *config, file string) error {
+	settings := []struct {
+		key string
+		set bool
+	}{
+		{"builder", buildConfig.Builder != ""},
+		{"retry", buildConfig.Retry != retryConfig{}},
+		{"request_timeout", buildConfig.RequestTimeout != 0},
+		{"isolated_docker_config", buildConfig.IsolatedDockerConfig != nil},
+	}
+	for _, setting := range settings {
+		if setting.set {
+			return stacktrace.Propagate(ErrIncludedSetting{setting.key, file}, "%q can only be set in the main config file, not in %q", setting.key, file)
+		}
+	}
+	return nil
+}
+
+// checkBuildNodeConfig checks the settings of a build entry which cannot be
+// checked by decoding
+func checkBuildNodeConfig(buildNodeConfig *buildNodeConfig, file string) error {
+	if buildNodeConfig.Name == "" {
+		return stacktrace.NewError("Missing name of an image in %q", file)
+	}
+	if buildNodeConfig.From != "provided" {
+		return nil
+	}
+	hooks := []struct{ name, command string }{
+		{"pre_build", buildNodeConfig.PreBuild},
+		{"post_build", buildNodeConfig.PostBuild},
+	}
+	for _, hook := range hooks {
+		if hook.command != "" {
+			name := buildNodeConfig.Name
+			return stacktrace.Propagate(ErrProvidedImageHook{name, hook.name}, "Provided image %q cannot have %s", name, hook.name)
+		}
+	}
+	return nil
+}
+
+// assertBuildRoot checks that the build context of a node is a folder
+func (t *BuildTree) assertBuildRoot(node *buildNode) error {
+	if t.isProvided(node) {
+		return nil
+	}
+	info, err := os.Stat(node.buildRoot)
+	if err != nil || !info.IsDir() {
+		return stacktrace.Propagate(ErrMissingBuildContext{node.name, node.buildRoot}, "Build context of %q is not a folder: %q", node.name, node.buildRoot)
+	}
+	return nil
+}
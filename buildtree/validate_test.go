@@ -0,0 +1,171 @@
+package buildtree
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/palantir/stacktrace"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ValidateTestSuite struct {
+	suite.Suite
+}
+
+func (s *ValidateTestSuite) requireUnknownKey(expected ErrUnknownKey, config string) {
+	_, err := ReadBuildTree(strings.NewReader(config), nil, nil)
+	unknownKey, ok := stacktrace.RootCause(err).(ErrUnknownKey)
+	require.True(s.T(), ok, "unknown keys must be reported, got %v", err)
+	require.Equal(s.T(), expected, unknownKey)
+}
+
+func (s *ValidateTestSuite) TestUnknownKeys() {
+	s.requireUnknownKey(ErrUnknownKey{"build[1].push_lastest", "<input>", 8, 5}, `build:
+  - name: anduin/base
+    tag: "1.0"
+    from: provided
+  - name: anduin/elrond
+    tag: "1.0"
+    from: provided
+    push_lastest: true
+`)
+	s.requireUnknownKey(ErrUnknownKey{"retry.attempt", "<input>", 2, 3}, "retry:\n  attempt: 3\n")
+	s.requireUnknownKey(ErrUnknownKey{"variables[0].requried", "<input>", 3, 5}, "variables:\n  - name: tag\n    requried: true\n")
+	s.requireUnknownKey(ErrUnknownKey{"credentials[0].passwd", "<input>", 1, 27}, "credentials: [{name: foo, passwd: bar}]\n")
+	s.requireUnknownKey(ErrUnknownKey{"depends", "<input>", 1, 1}, "depends: anduin/base\n")
+
+	config := `build:
+  - &image
+    name: anduin/base
+    tag: "1.0"
+    from: provided
+  - <<: *image
+    name: anduin/elrond
+    labels:
+      any.key: value
+`
+	buildTree, err := ReadBuildTree(strings.NewReader(config), nil, nil)
+	require.Nil(s.T(), err, "merge keys and maps must be allowed, got %v", err)
+	require.Equal(s.T(), "1.0", buildTree.allNodes["anduin/elrond"].tag)
+	s.requireUnknownKey(ErrUnknownKey{"build[1].depends", "<input>", 8, 5}, strings.Replace(config, "labels:\n      any.key: value", "depends: anduin/base", 1))
+}
+
+func (s *ValidateTestSuite) TestUnknownKeyPositions() {
+	config := `build:
+  - name: anduin/elrond
+    tag: "1.0"
+    from: provided
+    labels:
+      notes: "{{.notes}}"
+    push_lastest: true
+`
+	_, err := ReadBuildTree(strings.NewReader(config), map[string]string{"notes": "first\n\nsecond\n\nthird"}, nil)
+	require.Equal(s.T(), ErrUnknownKey{"build[0].push_lastest", "<input>", 7, 5}, stacktrace.RootCause(err), "positions must be in the file before rendering")
+
+	config = "build:\n  - name: anduin/elrond\n    tag: \"1.0\"\n    from: provided\n    {{.key}}: true\n"
+	_, err = ReadBuildTree(strings.NewReader(config), map[string]string{"key": "push_lastest"}, nil)
+	require.Equal(s.T(), ErrUnknownKey{"build[0].push_lastest", "<input>", 0, 0}, stacktrace.RootCause(err), "keys written with templates must be checked once rendered")
+
+	config = "build:\n{{- if true}}\n  - name: anduin/elrond\n    tag: \"1.0\"\n    from: provided\n    depends: anduin/base\n{{- end}}\n"
+	_, err = ReadBuildTree(strings.NewReader(config), nil, nil)
+	unknownKey, ok := stacktrace.RootCause(err).(ErrUnknownKey)
+	require.True(s.T(), ok, "files which are not yaml before rendering must be checked once rendered, got %v", err)
+	require.Equal(s.T(), "build[0].depends", unknownKey.Key)
+	require.Contains(s.T(), unknownKey.Error(), "once rendered")
+}
+
+func (s *ValidateTestSuite) TestSemanticChecks() {
+	_, err := ReadBuildTree(strings.NewReader("build:\n  - tag: \"1.0\"\n    from: provided\n"), nil, nil)
+	require.NotNil(s.T(), err, "images must be named")
+	_, err = ReadBuildTree(strings.NewReader("credentials:\n  - username: anduin\n"), nil, nil)
+	require.NotNil(s.T(), err, "credentials must be named")
+
+	config := `build:
+  - name: ubuntu
+    tag: "16.04"
+    from: provided
+  - name: anduin/ubuntu
+    alias: ubuntu
+    tag: "1.0"
+    from: provided
+`
+	_, err = ReadBuildTree(strings.NewReader(config), nil, nil)
+	duplicate, ok := stacktrace.RootCause(err).(ErrDuplicateImage)
+	require.True(s.T(), ok, "an alias cannot be the name of another image, got %v", err)
+	require.Equal(s.T(), "ubuntu", duplicate.Name)
+
+	_, err = ReadBuildTree(strings.NewReader("build:\n  - name: ubuntu\n    tag: \"16.04\"\n    from: provided\n    post_build: ./notify.sh\n"), nil, nil)
+	require.Equal(s.T(), ErrProvidedImageHook{"ubuntu", "post_build"}, stacktrace.RootCause(err))
+
+	_, err = ReadBuildTree(strings.NewReader("credentials:\n  - name: anduin.corp\n    password: s3cr3t-conflict\n    password_file: password.txt\n"), nil, nil)
+	require.Equal(s.T(), ErrConflictingPassword{"anduin.corp"}, stacktrace.RootCause(err))
+}
+
+func (s *ValidateTestSuite) TestMissingBuildContext() {
+	dir := s.T().TempDir()
+	configFile := filepath.Join(dir, "doriath.yml")
+	require.Nil(s.T(), ioutil.WriteFile(configFile, []byte("root_dir: .\nbuild:\n  - name: anduin/elrond\n    tag: \"1.0\"\n    from: ./elrond\n"), 0644))
+	buildTree, err := ReadBuildTreeFromFile(configFile, nil, nil)
+	require.Nil(s.T(), err)
+	err = buildTree.Prepare(SkipDirtyCheck())
+	require.Equal(s.T(), ErrMissingBuildContext{"anduin/elrond", filepath.Join(dir, "elrond")}, stacktrace.RootCause(err))
+}
+
+func (s *ValidateTestSuite) TestSchema() {
+	content, err := ioutil.ReadFile(filepath.Join("..", "doriath.schema.json"))
+	require.Nil(s.T(), err)
+	schema := make(map[string]interface{})
+	require.Nil(s.T(), json.Unmarshal(content, &schema), "schema must be valid JSON")
+	s.requireSchemaFields(schema, schema, reflect.TypeOf(config{}), "config")
+}
+
+// requireSchemaFields checks that the properties of a schema are the yaml
+// fields of t, recursively
+func (s *ValidateTestSuite) requireSchemaFields(root, schema map[string]interface{}, t reflect.Type, path string) {
+	if ref, ok := schema["$ref"].(string); ok {
+		definitions := root["definitions"].(map[string]interface{})
+		schema = definitions[strings.TrimPrefix(ref, "#/definitions/")].(map[string]interface{})
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		properties, ok := schema["properties"].(map[string]interface{})
+		require.True(s.T(), ok, "%s must have properties", path)
+		require.Equal(s.T(), false, schema["additionalProperties"], "%s must not allow unknown keys", path)
+		fields := yamlFields(t)
+		names := []string{}
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		schemaNames := []string{}
+		for name := range properties {
+			schemaNames = append(schemaNames, name)
+		}
+		sort.Strings(schemaNames)
+		require.Equal(s.T(), names, schemaNames, "properties of %s", path)
+		for name, field := range fields {
+			s.requireSchemaFields(root, properties[name].(map[string]interface{}), field, path+"."+name)
+		}
+	case reflect.Slice:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			s.requireSchemaFields(root, items, t.Elem(), path+"[]")
+		}
+	case reflect.Map:
+		if values, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+			s.requireSchemaFields(root, values, t.Elem(), path+".*")
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	suite.Run(t, new(ValidateTestSuite))
+}
@@ -0,0 +1,551 @@
+package buildtree
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/anduintransaction/doriath/utils"
+	"github.com/joho/godotenv"
+	"github.com/palantir/stacktrace"
+	yaml "gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// Variable is a variable declared in the variables section of a config file
+type Variable struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	// Default is used when the variable is not set, nil when there is none
+	Default  *string `yaml:"default"`
+	Required bool    `yaml:"required"`
+	// Pattern is a regular expression which must match the whole value
+	Pattern string `yaml:"pattern"`
+	// Secret masks the value in doriath output
+	Secret bool `yaml:"secret"`
+	// File is the config file declaring the variable
+	File string `yaml:"-"`
+	// Value is the value of the variable, from the command line, the variable
+	// files or the default, and IsSet tells if there is one
+	Value string `yaml:"-"`
+	IsSet bool   `yaml:"-"`
+	// implicit tells that the variable is only listed in secret_variables,
+	// it is masked but neither defaulted nor validated
+	implicit bool
+}
+
+// VariableEnvPrefix is the prefix of the environment variables setting config
+// variables, DORIATH_VAR_tag sets the tag variable
+const VariableEnvPrefix = "DORIATH_VAR_"
+
+// VariableValue is the value of a config variable and where it comes from
+type VariableValue struct {
+	// Name is the dotted path of the value, like versions.node
+	Name   string
+	Value  string
+	Source string
+}
+
+// variableValues holds the variables of config templates, which may be nested
+// maps, and the source of each value
+type variableValues struct {
+	values map[string]interface{}
+	// sources holds the source of each value by dotted path
+	sources map[string]string
+}
+
+func newVariableValues() *variableValues {
+	return &variableValues{
+		values:  make(map[string]interface{}),
+		sources: make(map[string]string),
+	}
+}
+
+// set sets the value at a path, replacing the values it overrides
+func (v *variableValues) set(path []string, value interface{}, source string) {
+	values := v.values
+	for i, segment := range path[:len(path)-1] {
+		child, ok := values[segment].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			values[segment] = child
+			v.removeSources(strings.Join(path[:i+1], "."))
+		}
+		values = child
+	}
+	name := strings.Join(path, ".")
+	v.removeSources(name)
+	values[path[len(path)-1]] = value
+	v.setSources(name, value, source)
+}
+
+// merge sets the values of a map at a path, nested maps are merged
+// recursively
+func (v *variableValues) merge(path []string, values map[string]interface{}, source string) {
+	for key, value := range values {
+		childPath := append(append([]string{}, path...), key)
+		child, isMap := value.(map[string]interface{})
+		if _, exists := v.lookupMap(childPath); isMap && exists {
+			v.merge(childPath, child, source)
+			continue
+		}
+		v.set(childPath, value, source)
+	}
+}
+
+// setDefaults sets the values of a map at a path which are not set yet,
+// nested maps are merged recursively, and returns the dotted paths of the
+// values set
+func (v *variableValues) setDefaults(path []string, values map[string]interface{}, source string) []string {
+	names := []string{}
+	for _, key := range sortedStringKeys(values) {
+		childPath := append(append([]string{}, path...), key)
+		current, exists := v.lookup(childPath)
+		child, isMap := values[key].(map[string]interface{})
+		if _, currentIsMap := current.(map[string]interface{}); isMap && currentIsMap {
+			names = append(names, v.setDefaults(childPath, child, source)...)
+			continue
+		}
+		if !exists {
+			v.set(childPath, values[key], source)
+			names = append(names, strings.Join(childPath, "."))
+		}
+	}
+	return names
+}
+
+func sortedStringKeys(values map[string]interface{}) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *variableValues) setSources(name string, value interface{}, source string) {
+	if child, ok := value.(map[string]interface{}); ok && len(child) > 0 {
+		for key, childValue := range child {
+			v.setSources(name+"."+key, childValue, source)
+		}
+		return
+	}
+	v.sources[name] = source
+}
+
+func (v *variableValues) removeSources(name string) {
+	for path := range v.sources {
+		if path == name || strings.HasPrefix(path, name+".") {
+			delete(v.sources, path)
+		}
+	}
+}
+
+// lookup returns the value at a path
+func (v *variableValues) lookup(path []string) (interface{}, bool) {
+	var value interface{} = v.values
+	for _, segment := range path {
+		values, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = values[segment]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func (v *variableValues) lookupMap(path []string) (map[string]interface{}, bool) {
+	value, _ := v.lookup(path)
+	values, ok := value.(map[string]interface{})
+	return values, ok
+}
+
+// list returns every value with its source, sorted by name
+func (v *variableValues) list() []*VariableValue {
+	result := []*VariableValue{}
+	for name, source := range v.sources {
+		value, _ := v.lookup(strings.Split(name, "."))
+		if _, ok := value.(map[string]interface{}); ok {
+			value = ""
+		}
+		result = append(result, &VariableValue{name, toString(value), source})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// Variables returns the values of the variables of the config files, with
+// their source
+func (t *BuildTree) Variables() []*VariableValue {
+	return t.variables.list()
+}
+
+// ReadVariableValues returns the values of variables set by variable files,
+// environment variables and variableMap, without the defaults of config files
+func ReadVariableValues(variableMap map[string]string, variableFiles []string) ([]*VariableValue, error) {
+	variables, err := readVariables(variableMap, variableFiles)
+	if err != nil {
+		return nil, err
+	}
+	return variables.list(), nil
+}
+
+// readVariables reads the variables of config templates. Variable files are
+// read in order, then DORIATH_VAR_ environment variables and variableMap take
+// precedence. Nested maps are merged and names of variableMap are dotted
+// paths.
+func readVariables(variableMap map[string]string, variableFiles []string) (*variableValues, error) {
+	variables := newVariableValues()
+	for _, variableFile := range variableFiles {
+		values, err := readVariableFile(variableFile)
+		if err != nil {
+			return nil, err
+		}
+		variables.merge(nil, values, "file "+variableFile)
+	}
+	environ := os.Environ()
+	sort.Strings(environ)
+	for _, env := range environ {
+		if !strings.HasPrefix(env, VariableEnvPrefix) {
+			continue
+		}
+		segments := strings.SplitN(strings.TrimPrefix(env, VariableEnvPrefix), "=", 2)
+		if segments[0] != "" {
+			variables.set([]string{segments[0]}, segments[1], "env "+VariableEnvPrefix+segments[0])
+		}
+	}
+	names := make([]string, 0, len(variableMap))
+	for name := range variableMap {
+		names = append(names, name)
+	}
+	// Parents are set before their children
+	sort.Strings(names)
+	for _, name := range names {
+		variables.set(strings.Split(name, "."), variableMap[name], "--variable")
+	}
+	return variables, nil
+}
+
+// readVariableFile reads a variable file, in YAML, JSON or dotenv format
+// depending on its extension
+func readVariableFile(path string) (map[string]interface{}, error) {
+	extension := strings.ToLower(filepath.Ext(path))
+	if extension != ".yml" && extension != ".yaml" && extension != ".json" {
+		values, err := godotenv.Read(path)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "Cannot read variable file %q", path)
+		}
+		result := make(map[string]interface{})
+		for key, value := range values {
+			result[key] = value
+		}
+		return result, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot read variable file %q", path)
+	}
+	var values interface{}
+	if extension == ".json" {
+		err = json.Unmarshal(content, &values)
+	} else {
+		err = yaml.Unmarshal(content, &values)
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot decode variable file %q", path)
+	}
+	if values == nil {
+		return make(map[string]interface{}), nil
+	}
+	result, ok := normalizeVariable(values).(map[string]interface{})
+	if !ok {
+		return nil, stacktrace.NewError("Variable file %q must hold a map", path)
+	}
+	return result, nil
+}
+
+// normalizeVariable turns the maps decoded by yaml into maps with string keys
+func normalizeVariable(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{})
+		for key, child := range value {
+			result[fmt.Sprint(key)] = normalizeVariable(child)
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{})
+		for key, child := range value {
+			result[key] = normalizeVariable(child)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(value))
+		for i, child := range value {
+			result[i] = normalizeVariable(child)
+		}
+		return result
+	}
+	return value
+}
+
+// warnSecretVariables warns once that secret_variables is deprecated
+var warnSecretVariables sync.Once
+
+// readVariableDeclarations reads the variables section of a config file
+// before it is rendered. Templates are not rendered in the section. The
+// deprecated secret_variables list sets Secret on the declarations it names,
+// and declares the others implicitly.
+func readVariableDeclarations(path string, fileContent []byte) ([]*Variable, error) {
+	declarations := &struct {
+		Variables       []*Variable `yaml:"variables"`
+		SecretVariables []string    `yaml:"secret_variables"`
+	}{}
+	block, err := topLevelBlock(path, fileContent, "variables", "secret_variables")
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.Unmarshal(block, declarations)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot decode variables of %q", displayPath(path))
+	}
+	for _, variable := range declarations.Variables {
+		if variable.Name == "" {
+			return nil, stacktrace.NewError("Missing name of variable in %q", displayPath(path))
+		}
+		if variable.Pattern != "" {
+			_, err := regexp.Compile(variable.Pattern)
+			if err != nil {
+				return nil, stacktrace.Propagate(err, "Invalid pattern of variable %q in %q", variable.Name, displayPath(path))
+			}
+		}
+		variable.File = displayPath(path)
+	}
+	if len(declarations.SecretVariables) > 0 {
+		warnSecretVariables.Do(func() {
+			utils.Warn("secret_variables in %q is deprecated, declare the variables with secret: true instead", displayPath(path))
+		})
+	}
+	for _, name := range declarations.SecretVariables {
+		declared := false
+		for _, variable := range declarations.Variables {
+			if variable.Name == name {
+				variable.Secret, declared = true, true
+			}
+		}
+		if !declared {
+			declarations.Variables = append(declarations.Variables, &Variable{Name: name, Secret: true, File: displayPath(path), implicit: true})
+		}
+	}
+	return declarations.Variables, nil
+}
+
+// applyVariableDeclarations sets the defaults of declared variables which are
+// not set, then validates their values
+func applyVariableDeclarations(declarations []*Variable, variables *variableValues) error {
+	for _, variable := range declarations {
+		path := strings.Split(variable.Name, ".")
+		_, set := variables.lookup(path)
+		variables.resolve(variable)
+		if variable.implicit {
+			continue
+		}
+		if !set {
+			// Optional variables without default are empty
+			variables.set(path, variable.Value, "default of "+variable.File)
+		}
+		if variable.Required && variable.Value == "" {
+			return stacktrace.Propagate(ErrMissingVariable{variable.Name, variable.File, 0}, "Variable %q is required", variable.Name)
+		}
+		if variable.IsSet && variable.Pattern != "" && !regexp.MustCompile("^(?:"+variable.Pattern+")$").MatchString(variable.Value) {
+			return stacktrace.Propagate(ErrInvalidVariable{variable.Name, variable.File, variable.Pattern}, "Invalid value %q of variable %q", variable.Value, variable.Name)
+		}
+	}
+	return nil
+}
+
+// resolve sets the value of a declared variable, from variables or from its
+// default, registering it as a secret if needed
+func (v *variableValues) resolve(variable *Variable) {
+	value, ok := v.lookup(strings.Split(variable.Name, "."))
+	variable.Value, variable.IsSet = toString(value), ok
+	if !ok && variable.Default != nil {
+		variable.Value, variable.IsSet = *variable.Default, true
+	}
+	if variable.Secret {
+		utils.AddSecret(variable.Value)
+	}
+}
+
+// ReadVariables returns the variables declared in build files and in the files
+// they include, with their values. Includes are read without rendering the
+// files, so that variables can be listed when they are not set.
+func ReadVariables(buildFiles []string, variableMap map[string]string, variableFiles []string) ([]*Variable, error) {
+	variables, err := readVariables(variableMap, variableFiles)
+	if err != nil {
+		return nil, err
+	}
+	loaded := make(utils.StringSet)
+	declared := make(utils.StringSet)
+	result := []*Variable{}
+	var load func(path string) error
+	load = func(path string) error {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return stacktrace.Propagate(err, "Cannot resolve build file %q", path)
+		}
+		if loaded.Exists(absPath) {
+			return nil
+		}
+		loaded.Add(absPath)
+		fileContent, err := readFile(path)
+		if err != nil {
+			return err
+		}
+		declarations, err := readVariableDeclarations(path, fileContent)
+		if err != nil {
+			return err
+		}
+		for _, variable := range declarations {
+			if variable.implicit || declared.Exists(variable.Name) {
+				continue
+			}
+			declared.Add(variable.Name)
+			variables.resolve(variable)
+			result = append(result, variable)
+		}
+		includes := &struct {
+			Include stringList `yaml:"include"`
+		}{}
+		block, err := topLevelBlock(path, fileContent, "include")
+		if err != nil {
+			return err
+		}
+		err = yaml.Unmarshal(block, includes)
+		if err != nil {
+			return stacktrace.Propagate(err, "Cannot decode include of %q", path)
+		}
+		matches, err := globIncludes(filepath.Dir(path), includes.Include)
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			err = load(match)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, buildFile := range buildFiles {
+		err = load(buildFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// templateActionRegex matches the template actions of a line
+var templateActionRegex = regexp.MustCompile(`{{.*?}}`)
+
+// topLevelBlock returns the lines of top level keys of a config file before
+// it is rendered, so that they can be decoded alone. Keys are found by parsing
+// the file with its template actions replaced, lines only holding actions,
+// like {{if}} or {{end}}, are left out.
+func topLevelBlock(path string, content []byte, keys ...string) ([]byte, error) {
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	actionOnly := make([]bool, len(lines))
+	stripped := &bytes.Buffer{}
+	for i, line := range lines {
+		actionOnly[i] = templateActionRegex.Match(line) && len(bytes.TrimSpace(templateActionRegex.ReplaceAll(line, nil))) == 0
+		if actionOnly[i] {
+			// Line numbers are kept
+			stripped.WriteString("\n")
+			continue
+		}
+		stripped.Write(templateActionRegex.ReplaceAllFunc(line, func(action []byte) []byte {
+			return bytes.Repeat([]byte("x"), len(action))
+		}))
+	}
+	found := false
+	for i, line := range lines {
+		for _, key := range keys {
+			found = found || (!actionOnly[i] && bytes.HasPrefix(line, []byte(key+":")))
+		}
+	}
+	root := &yamlv3.Node{}
+	err := yamlv3.Unmarshal(stripped.Bytes(), root)
+	if err != nil {
+		if !found {
+			return nil, nil
+		}
+		return nil, stacktrace.Propagate(err, "Cannot read %s of %q before rendering, template actions must only be values or whole lines", strings.Join(keys, ", "), displayPath(path))
+	}
+	if len(root.Content) == 0 || root.Content[0].Kind != yamlv3.MappingNode {
+		return nil, nil
+	}
+	mapping := root.Content[0]
+	block := &bytes.Buffer{}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		key := mapping.Content[i]
+		wanted := false
+		for _, k := range keys {
+			wanted = wanted || key.Value == k
+		}
+		if !wanted {
+			continue
+		}
+		if mapping.Style&yamlv3.FlowStyle != 0 {
+			return nil, stacktrace.NewError("Cannot read %s of %q before rendering, the top level of the file must not be in flow style", key.Value, displayPath(path))
+		}
+		end := len(lines)
+		if i+2 < len(mapping.Content) {
+			end = mapping.Content[i+2].Line - 1
+		}
+		for j := key.Line - 1; j < end; j++ {
+			if !actionOnly[j] {
+				block.Write(lines[j])
+			}
+		}
+	}
+	return block.Bytes(), nil
+}
+
+// missingKeyRegex matches the template errors of missing variables
+var missingKeyRegex = regexp.MustCompile(`^template: [^:]*:(\d+):\d+: executing .*map has no entry for key "([^"]*)"`)
+
+// missingVariableError turns the template error of a missing variable into an
+// ErrMissingVariable
+func missingVariableError(path string, err error) error {
+	match := missingKeyRegex.FindStringSubmatch(err.Error())
+	if match == nil {
+		return err
+	}
+	line, _ := strconv.Atoi(match[1])
+	return ErrMissingVariable{match[2], displayPath(path), line}
+}
+
+// displayPath returns the path of a config file for messages
+func displayPath(path string) string {
+	if path == "" {
+		return "<input>"
+	}
+	return path
+}
@@ -0,0 +1,236 @@
+package buildtree
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anduintransaction/doriath/utils"
+	"github.com/palantir/stacktrace"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type VariablesTestSuite struct {
+	suite.Suite
+	configFile string
+}
+
+func (s *VariablesTestSuite) SetupTest() {
+	s.configFile = filepath.Join("../test-resources", "variables", "doriath.yml")
+}
+
+func (s *VariablesTestSuite) TestDefaults() {
+	buildTree, err := ReadBuildTreeFromFile(s.configFile, map[string]string{"elrondTag": "1.0"}, nil)
+	require.Nil(s.T(), err, "build tree must be readable")
+	require.Equal(s.T(), "1.0", buildTree.allNodes["registry.anduin.local/anduin/elrond"].tag)
+	require.Equal(s.T(), "2.0", buildTree.allNodes["registry.anduin.local/anduin/arwen"].tag, "defaults must be used")
+	require.Equal(s.T(), "", buildTree.credentials["registry.anduin.local"].Password, "optional variables must be empty")
+
+	buildTree, err = ReadBuildTreeFromFile(s.configFile, map[string]string{"elrondTag": "1.0", "registry": "quay.io", "registryPassword": "s3cr3t-declared"}, nil)
+	require.Nil(s.T(), err, "build tree must be readable")
+	require.NotNil(s.T(), buildTree.allNodes["quay.io/anduin/arwen"], "declarations of the main file must be used by included files")
+	require.Equal(s.T(), utils.SecretMask, utils.Mask("s3cr3t-declared"), "secret variables must be masked")
+}
+
+func (s *VariablesTestSuite) TestValidation() {
+	_, err := ReadBuildTreeFromFile(s.configFile, nil, nil)
+	missing, ok := stacktrace.RootCause(err).(ErrMissingVariable)
+	require.True(s.T(), ok, "required variables must be checked, got %v", err)
+	require.Equal(s.T(), ErrMissingVariable{"elrondTag", s.configFile, 0}, missing)
+
+	_, err = ReadBuildTreeFromFile(s.configFile, map[string]string{"elrondTag": "1.0-beta"}, nil)
+	invalid, ok := stacktrace.RootCause(err).(ErrInvalidVariable)
+	require.True(s.T(), ok, "patterns must match the whole value, got %v", err)
+	require.Equal(s.T(), "elrondTag", invalid.Name)
+
+	_, err = ReadBuildTree(strings.NewReader("variables:\n  - name: tag\n    pattern: \"[\"\n"), nil, nil)
+	require.NotNil(s.T(), err, "invalid patterns must be detected")
+	_, err = ReadBuildTree(strings.NewReader("variables:\n  - description: tag\n"), nil, nil)
+	require.NotNil(s.T(), err, "names must be required")
+
+	_, err = ReadBuildTree(strings.NewReader("secret_variables:\n  name: token\n"), nil, nil)
+	require.NotNil(s.T(), err, "malformed secret_variables must be an error")
+}
+
+func (s *VariablesTestSuite) TestSecretVariables() {
+	config := `variables:
+  - name: password
+    secret: true
+  - name: token
+    required: true
+secret_variables: [token, apiKey]
+build:
+  - name: anduin/elrond
+    tag: "1.0"
+    from: provided
+    labels:
+      password: "{{.password}}"
+      token: "{{.token}}"
+      key: "{{.apiKey}}"
+`
+	variables := map[string]string{"password": "s3cr3t-alias-password", "token": "s3cr3t-alias-token", "apiKey": "s3cr3t-alias-key"}
+	_, err := ReadBuildTree(strings.NewReader(config), variables, nil)
+	require.Nil(s.T(), err, "secret_variables can be used with secret declarations, got %v", err)
+	require.Equal(s.T(), "**** **** ****", utils.Mask("s3cr3t-alias-password s3cr3t-alias-token s3cr3t-alias-key"))
+
+	_, err = ReadBuildTree(strings.NewReader(config), map[string]string{"apiKey": "s3cr3t-alias-key"}, nil)
+	require.Equal(s.T(), ErrMissingVariable{"token", "<input>", 0}, stacktrace.RootCause(err), "declarations listed in secret_variables must still be validated")
+
+	dir := s.T().TempDir()
+	configFile := filepath.Join(dir, "doriath.yml")
+	require.Nil(s.T(), ioutil.WriteFile(configFile, []byte(config), 0644))
+	declared, err := ReadVariables([]string{configFile}, nil, nil)
+	require.Nil(s.T(), err)
+	require.Len(s.T(), declared, 2, "variables only listed in secret_variables are not declared")
+	require.True(s.T(), declared[1].Secret, "secret_variables must mark declarations as secret")
+}
+
+func (s *VariablesTestSuite) TestMissingVariable() {
+	config := `root_dir: .
+build:
+  - name: anduin/elrond
+    tag: "{{.elrondTag}}"
+    from: provided
+`
+	_, err := ReadBuildTree(strings.NewReader(config), nil, nil)
+	missing, ok := stacktrace.RootCause(err).(ErrMissingVariable)
+	require.True(s.T(), ok, "missing variables must be reported, got %v", err)
+	require.Equal(s.T(), ErrMissingVariable{"elrondTag", "<input>", 4}, missing)
+
+	buildTree, err := ReadBuildTree(strings.NewReader(strings.Replace(config, `{{.elrondTag}}`, `{{.elrondTag | default "latest"}}`, 1)), nil, nil)
+	require.Nil(s.T(), err, "variables given to default need not be set, got %v", err)
+	require.Equal(s.T(), "latest", buildTree.allNodes["anduin/elrond"].tag)
+	require.Empty(s.T(), buildTree.Variables(), "variables given to default must not be set")
+	require.Contains(s.T(), missing.Error(), `"<input>" line 4`)
+}
+
+func (s *VariablesTestSuite) TestReadVariables() {
+	variables, err := ReadVariables([]string{s.configFile}, map[string]string{"registryPassword": "s3cr3t-listed"}, nil)
+	require.Nil(s.T(), err, "variables must be readable without their values")
+	names := []string{}
+	for _, variable := range variables {
+		names = append(names, variable.Name)
+	}
+	require.Equal(s.T(), []string{"arwenTag", "elrondTag", "registry", "registryPassword"}, names)
+	require.Equal(s.T(), "2.0", variables[0].Value)
+	require.Equal(s.T(), filepath.Join("../test-resources", "variables", "elves", "doriath.yml"), variables[0].File)
+	require.False(s.T(), variables[1].IsSet)
+	require.True(s.T(), variables[1].Required)
+	require.Equal(s.T(), "Tag of elrond", variables[1].Description)
+	require.True(s.T(), variables[3].IsSet)
+	require.Equal(s.T(), utils.SecretMask, utils.Mask("s3cr3t-listed"))
+}
+
+func (s *VariablesTestSuite) TestVariableFiles() {
+	varsFolder := filepath.Join("../test-resources", "vars")
+	yamlFile := filepath.Join(varsFolder, "versions.yml")
+	jsonFile := filepath.Join(varsFolder, "versions.json")
+	envFile := filepath.Join(varsFolder, "matrix.env")
+	dotenvFile := filepath.Join(varsFolder, "vars")
+	s.T().Setenv(VariableEnvPrefix+"team", "hobbits")
+	variables, err := readVariables(map[string]string{"versions.go": "1.19"}, []string{dotenvFile, yamlFile, jsonFile, envFile})
+	require.Nil(s.T(), err, "variable files must be readable")
+	expected := []*VariableValue{
+		{"team", "hobbits", "env DORIATH_VAR_team"},
+		{"ubuntuTag", "18.04", "file " + yamlFile},
+		{"versions.go", "1.19", "--variable"},
+		{"versions.node", "20", "file " + jsonFile},
+		{"versions.python", "3.11", "file " + jsonFile},
+	}
+	require.Equal(s.T(), expected, variables.list(), "files must be merged in order, then env and --variable")
+
+	config := `build:
+  - name: anduin/node
+    tag: "{{.versions.node}}-{{.versions.go}}"
+    from: provided
+`
+	buildTree, err := ReadBuildTree(strings.NewReader(config), nil, []string{yamlFile})
+	require.Nil(s.T(), err, "nested variables must be usable")
+	require.Equal(s.T(), "18-1.18", buildTree.allNodes["anduin/node"].tag)
+	_, err = ReadBuildTree(strings.NewReader(config), map[string]string{"versions": "none"}, []string{yamlFile})
+	require.NotNil(s.T(), err, "--variable must replace maps")
+
+	buildTree, err = ReadBuildTree(strings.NewReader("variables:\n  - name: versions.rust\n    default: \"1.70\"\n"), nil, []string{yamlFile})
+	require.Nil(s.T(), err)
+	values := buildTree.Variables()
+	require.Equal(s.T(), &VariableValue{"versions.rust", "1.70", "default of <input>"}, values[len(values)-1], "defaults must be listed")
+
+	_, err = readVariables(nil, []string{filepath.Join(varsFolder, "missing.yml")})
+	require.NotNil(s.T(), err, "missing variable files must be an error")
+	listFile := filepath.Join(s.T().TempDir(), "list.yml")
+	require.Nil(s.T(), ioutil.WriteFile(listFile, []byte("- a\n- b\n"), 0644))
+	_, err = readVariables(nil, []string{listFile})
+	require.NotNil(s.T(), err, "variable files must hold a map")
+}
+
+func (s *VariablesTestSuite) TestTopLevelBlock() {
+	content := `# comment
+variables:
+- name: a
+  default: "{{"
+
+  # comment
+include: other.yml
+build:
+  variables: nested
+`
+	requireBlock := func(expected, content string, keys ...string) {
+		block, err := topLevelBlock("", []byte(content), keys...)
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), expected, string(block))
+	}
+	requireBlock("variables:\n- name: a\n  default: \"{{\"\n\n  # comment\n", content, "variables")
+	requireBlock("include: other.yml\n", content, "include")
+	requireBlock("", content, "pull")
+
+	content = `{{- if .prod}}
+pull: [alpine]
+{{- end}}
+variables:
+{{- if .prod}}
+  - name: a
+    default: "{{.b}}"
+{{end}}
+{{.key}}: value
+build:
+  - name: anduin/{{.a}}
+`
+	requireBlock("variables:\n  - name: a\n    default: \"{{.b}}\"\n", content, "variables")
+	requireBlock("pull: [alpine]\n", content, "pull")
+
+	content = "variables: [\n  {name: a},\n{name: b}]\nbuild: []\n"
+	requireBlock("variables: [\n  {name: a},\n{name: b}]\n", content, "variables")
+	requireBlock("", "{variables: [{name: a}]", "include")
+}
+
+func (s *VariablesTestSuite) TestTemplatedDeclarations() {
+	config := `{{- if true}}
+pull: [alpine]
+{{- end}}
+variables: [{name: tag, default: "1.0"},
+{name: registry, default: quay.io}]
+{{- if true}}
+build:
+  - name: "{{.registry}}/anduin/elrond"
+    tag: "{{.tag}}"
+    from: provided
+{{- end}}
+`
+	buildTree, err := ReadBuildTree(strings.NewReader(config), nil, nil)
+	require.Nil(s.T(), err, "declarations must be read around template actions and in flow style, got %v", err)
+	require.Equal(s.T(), "1.0", buildTree.allNodes["quay.io/anduin/elrond"].tag)
+
+	_, err = ReadBuildTree(strings.NewReader("{variables: [{name: tag, default: \"1.0\"}], build: []}\n"), nil, nil)
+	require.NotNil(s.T(), err, "declarations of flow style documents must be rejected")
+	require.Contains(s.T(), err.Error(), "flow style")
+
+	_, err = ReadBuildTree(strings.NewReader("variables:\n  - name: tag\n    default: \"1.0\"\nbuild: {{.build}\n"), nil, nil)
+	require.NotNil(s.T(), err, "declarations of files which cannot be parsed must be rejected")
+	require.Contains(s.T(), err.Error(), "before rendering")
+}
+
+func TestVariables(t *testing.T) {
+	suite.Run(t, new(VariablesTestSuite))
+}
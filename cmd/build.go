@@ -21,42 +21,43 @@
 package cmd
 
 import (
-	"os"
-
 	"github.com/anduintransaction/doriath/buildtree"
 	"github.com/anduintransaction/doriath/utils"
 	"github.com/spf13/cobra"
 )
 
+var buildJobs = 1
+
 // buildCmd represents the build command
 var buildCmd = &cobra.Command{
 	Use:   "build",
 	Short: "Build all new images",
 	Long:  "Build all new images",
 	Run: func(cmd *cobra.Command, args []string) {
-		t, err := buildtree.ReadBuildTreeFromFile(cfgFile, variableMap, variableFiles)
+		t, err := readBuildTree()
 		if err != nil {
 			utils.Error(err)
-			os.Exit(1)
+			utils.Exit(1)
 		}
 		err = t.Prepare()
 		if err != nil {
 			utils.Error(err)
-			os.Exit(1)
+			utils.Exit(1)
 		}
 		err = t.Pull()
 		if err != nil {
 			utils.Error(err)
-			os.Exit(1)
+			utils.Exit(1)
 		}
-		err = t.Build()
+		err = t.Build(buildtree.WithJobs(buildJobs))
 		if err != nil {
 			utils.Error(err)
-			os.Exit(1)
+			utils.Exit(1)
 		}
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(buildCmd)
+	buildCmd.Flags().IntVarP(&buildJobs, "jobs", "j", 1, "Number of images processed in parallel")
 }
@@ -21,9 +21,6 @@
 package cmd
 
 import (
-	"os"
-
-	"github.com/anduintransaction/doriath/buildtree"
 	"github.com/anduintransaction/doriath/utils"
 	"github.com/spf13/cobra"
 )
@@ -34,10 +31,10 @@ var cleanCmd = &cobra.Command{
 	Short: "Clean all local docker images defined in doriath.yml config file",
 	Long:  "Clean all local docker images defined in doriath.yml config file",
 	Run: func(cmd *cobra.Command, args []string) {
-		t, err := buildtree.ReadBuildTreeFromFile(cfgFile, variableMap, variableFiles)
+		t, err := readBuildTree()
 		if err != nil {
 			utils.Error(err)
-			os.Exit(1)
+			utils.Exit(1)
 		}
 		t.Clean()
 	},
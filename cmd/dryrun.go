@@ -21,8 +21,6 @@
 package cmd
 
 import (
-	"os"
-
 	"github.com/anduintransaction/doriath/buildtree"
 	"github.com/anduintransaction/doriath/utils"
 	"github.com/spf13/cobra"
@@ -39,10 +37,10 @@ var dryrunCmd = &cobra.Command{
 	Short: "Check your project for build steps and possible error",
 	Long:  "Check your project for build steps and possible error",
 	Run: func(cmd *cobra.Command, args []string) {
-		t, err := buildtree.ReadBuildTreeFromFile(cfgFile, variableMap, variableFiles)
+		t, err := readBuildTree()
 		if err != nil {
 			utils.Error(err)
-			os.Exit(1)
+			utils.Exit(1)
 		}
 		opts := []buildtree.PrepareOptFn{}
 		if printSkipDirtyCheck {
@@ -51,7 +49,7 @@ var dryrunCmd = &cobra.Command{
 		err = t.Prepare(opts...)
 		if err != nil {
 			utils.Error(err)
-			os.Exit(1)
+			utils.Exit(1)
 		}
 		t.PrintTree(dryrunNoColor)
 	},
@@ -15,41 +15,61 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
-	"os"
 
-	"github.com/anduintransaction/doriath/buildtree"
 	"github.com/anduintransaction/doriath/utils"
 	"github.com/spf13/cobra"
 )
 
+var findlatestReference string
+var findlatestJSON bool
+
 // findlatestCmd represents the findlatest command
 var findlatestCmd = &cobra.Command{
 	Use:   "findlatest image-name",
 	Short: "Find latest tag from an image name",
 	Long: `Find latest tag from an image name.
 
-This command will find the tag with the same hash as 'latest' tag. If there is no
-such tag, an error will be thrown.
+This command will find the tag with the same digest as 'latest' tag, or as the
+tag given with --reference. If there is no such tag, an error will be thrown.
+
+With --json, all matching tags are printed as a JSON object:
 
-Currently, only images hosted in gcr.io are supported by this command.
+{"image": "anduin/elrond", "reference": "latest", "digest": "sha256:...", "tags": ["1.0"]}
 `,
 	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		t, err := buildtree.ReadBuildTreeFromFile(cfgFile, variableMap, variableFiles)
+		t, err := readBuildTree()
 		if err != nil {
 			utils.Error(err)
-			os.Exit(1)
+			utils.Exit(1)
 		}
-		tag, err := t.FindLatestTag(args[0])
+		digest, tags, err := t.FindMatchingTags(args[0], findlatestReference)
 		if err != nil {
 			utils.Error(err)
-			os.Exit(1)
+			utils.Exit(1)
+		}
+		if findlatestJSON {
+			output, _ := json.Marshal(map[string]interface{}{
+				"image":     args[0],
+				"reference": findlatestReference,
+				"digest":    digest,
+				"tags":      tags,
+			})
+			fmt.Println(string(output))
+			return
+		}
+		if len(tags) == 0 {
+			utils.Error(fmt.Errorf("cannot find a tag with the same digest as %q", findlatestReference))
+			utils.Exit(1)
 		}
-		fmt.Println(tag)
+		fmt.Println(tags[0])
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(findlatestCmd)
+	findlatestCmd.Flags().StringVarP(&findlatestReference, "reference", "r", "latest", "Tag whose digest is looked for")
+	findlatestCmd.Flags().BoolVar(&findlatestJSON, "json", false, "Print all matching tags as JSON")
 }
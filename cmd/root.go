@@ -24,14 +24,21 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"text/tabwriter"
 
+	"github.com/anduintransaction/doriath/buildtree"
+	"github.com/anduintransaction/doriath/utils"
 	"github.com/spf13/cobra"
 )
 
-var cfgFile string
+var cfgFiles []string
 var variableArray []string
 var variableFiles []string
 var variableMap map[string]string
+var builderName string
+var isolatedDockerConfig bool
+var printVars bool
+var profileName string
 
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
@@ -43,7 +50,7 @@ var RootCmd = &cobra.Command{
 			segments := strings.SplitN(variable, "=", 2)
 			if len(segments) != 2 {
 				fmt.Fprintf(os.Stderr, "Invalid variable: %s\n", variable)
-				os.Exit(2)
+				utils.Exit(2)
 			}
 			variableMap[segments[0]] = segments[1]
 		}
@@ -54,14 +61,61 @@ var RootCmd = &cobra.Command{
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
 	if err := RootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(-1)
+		fmt.Println(utils.Mask(err.Error()))
+		utils.Exit(-1)
 	}
 }
 
+// readBuildTree reads the build tree from the config file and applies the
+// global flags overriding the config
+func readBuildTree() (*buildtree.BuildTree, error) {
+	var readOpts []buildtree.ReadOptFn
+	if profileName != "" {
+		readOpts = append(readOpts, buildtree.UseProfile(profileName))
+	}
+	t, err := buildtree.ReadBuildTreeFromFiles(cfgFiles, variableMap, variableFiles, readOpts...)
+	if printVars {
+		var values []*buildtree.VariableValue
+		if err == nil {
+			values = t.Variables()
+		} else {
+			// The config files could not be read, defaults are unknown
+			values, _ = buildtree.ReadVariableValues(variableMap, variableFiles)
+		}
+		printVariableValues(values)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if builderName != "" {
+		err = t.UseBuilder(builderName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if RootCmd.PersistentFlags().Changed("isolated-docker-config") {
+		t.IsolateDockerConfig(isolatedDockerConfig)
+	}
+	return t, nil
+}
+
+// printVariableValues prints variables and their source on stderr
+func printVariableValues(values []*buildtree.VariableValue) {
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVALUE\tSOURCE")
+	for _, value := range values {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", value.Name, utils.Mask(fmt.Sprintf("%q", value.Value)), value.Source)
+	}
+	w.Flush()
+}
+
 func init() {
-	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "doriath.yml", fmt.Sprint("config file (default is 'doriath.yml' in current folder)"))
+	RootCmd.PersistentFlags().StringArrayVar(&cfgFiles, "config", []string{"doriath.yml"}, "config file, can be given several times to merge the build, pull and credentials of several files")
 	variableMap = make(map[string]string)
 	RootCmd.PersistentFlags().StringArrayVar(&variableArray, "variable", []string{}, "variables to pass to config file")
-	RootCmd.PersistentFlags().StringArrayVar(&variableFiles, "variableFile", []string{}, "variable files")
+	RootCmd.PersistentFlags().StringArrayVar(&variableFiles, "variableFile", []string{}, "variable files, in YAML (.yml, .yaml), JSON (.json) or dotenv format")
+	RootCmd.PersistentFlags().StringVar(&profileName, "profile", "", "profile of the config files to apply, overlaying build, pull, credentials and variables")
+	RootCmd.PersistentFlags().BoolVar(&printVars, "print-vars", false, "print the variables of the config files and where their values come from")
+	RootCmd.PersistentFlags().StringVar(&builderName, "builder", "", "builder used to build images: "+strings.Join(utils.BuilderNames(), ", ")+" (overrides the config file)")
+	RootCmd.PersistentFlags().BoolVar(&isolatedDockerConfig, "isolated-docker-config", false, "log into registries in a temporary docker config removed on exit, default in CI (overrides the config file)")
 }
@@ -21,8 +21,6 @@
 package cmd
 
 import (
-	"os"
-
 	"github.com/anduintransaction/doriath/buildtree"
 	"github.com/anduintransaction/doriath/utils"
 	"github.com/spf13/cobra"
@@ -34,24 +32,25 @@ var trybuildCmd = &cobra.Command{
 	Short: "Try build new images locally, then delete them",
 	Long:  "Try build new images locally, then delete them",
 	Run: func(cmd *cobra.Command, args []string) {
-		t, err := buildtree.ReadBuildTreeFromFile(cfgFile, variableMap, variableFiles)
+		t, err := readBuildTree()
 		if err != nil {
 			utils.Error(err)
-			os.Exit(1)
+			utils.Exit(1)
 		}
 		err = t.Prepare()
 		if err != nil {
 			utils.Error(err)
-			os.Exit(1)
+			utils.Exit(1)
 		}
-		err = t.TryBuild()
+		err = t.TryBuild(buildtree.WithJobs(buildJobs))
 		if err != nil {
 			utils.Error(err)
-			os.Exit(1)
+			utils.Exit(1)
 		}
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(trybuildCmd)
+	trybuildCmd.Flags().IntVarP(&buildJobs, "jobs", "j", 1, "Number of images processed in parallel")
 }
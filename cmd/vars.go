@@ -0,0 +1,65 @@
+// Copyright © 2017 Anduin Transactions Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/anduintransaction/doriath/buildtree"
+	"github.com/anduintransaction/doriath/utils"
+	"github.com/spf13/cobra"
+)
+
+// varsCmd represents the vars command
+var varsCmd = &cobra.Command{
+	Use:   "vars",
+	Short: "List the variables declared in the config files",
+	Long: `List the variables declared in the variables section of the config files and
+of the files they include, with their current value. Values of secret variables
+are masked.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		variables, err := buildtree.ReadVariables(cfgFiles, variableMap, variableFiles)
+		if err != nil {
+			utils.Error(err)
+			utils.Exit(1)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tVALUE\tREQUIRED\tDESCRIPTION")
+		for _, variable := range variables {
+			value := "<not set>"
+			if variable.IsSet {
+				value = fmt.Sprintf("%q", variable.Value)
+			}
+			required := ""
+			if variable.Required {
+				required = "yes"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", variable.Name, utils.Mask(value), required, variable.Description)
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(varsCmd)
+}
@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Defaults of ACR credentials
+const (
+	DefaultAzureAuthority = "https://login.microsoftonline.com"
+	// ACRTokenUsername is the username of ACR registries authenticated with an
+	// ACR refresh token
+	ACRTokenUsername = "00000000-0000-0000-0000-000000000000"
+)
+
+// azureManagementScope is the scope of the Azure AD access tokens exchanged
+// for ACR refresh tokens
+const azureManagementScope = "https://management.azure.com/.default"
+
+// ACRProvider gets an ACR refresh token from the oauth2/exchange endpoint of an
+// Azure Container Registry, exchanging an Azure AD refresh token, or an access
+// token of a service principal. The registry exchanges the ACR refresh token
+// for ACR access tokens itself.
+type ACRProvider struct {
+	// Registry is the URL of the registry, like https://anduin.azurecr.io
+	Registry string
+	// TenantID, ClientID and ClientSecret are the service principal,
+	// defaulting to AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+	// RefreshToken is an Azure AD refresh token used instead of the service
+	// principal when set
+	RefreshToken string
+	// Authority replaces the Azure AD authority when set
+	Authority string
+	// Retry retries failed requests, DefaultRetryPolicy when nil
+	Retry *RetryPolicy
+
+	now func() time.Time
+}
+
+// Credential implements CredentialProvider
+func (p *ACRProvider) Credential() (string, string, time.Time, error) {
+	registryURL, err := url.Parse(p.Registry)
+	if err != nil || registryURL.Host == "" {
+		return "", "", time.Time{}, stacktrace.NewError("Invalid ACR registry %q", p.Registry)
+	}
+	tenantID := p.TenantID
+	if tenantID == "" {
+		tenantID = os.Getenv("AZURE_TENANT_ID")
+	}
+	now := p.timeNow()
+	form := url.Values{}
+	form.Set("service", registryURL.Host)
+	if tenantID != "" {
+		form.Set("tenant", tenantID)
+	}
+	var expiresAt time.Time
+	if p.RefreshToken != "" {
+		AddSecret(p.RefreshToken)
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", p.RefreshToken)
+	} else {
+		token, err := p.servicePrincipalToken(tenantID)
+		if err != nil {
+			return "", "", time.Time{}, err
+		}
+		form.Set("grant_type", "access_token")
+		form.Set("access_token", token.AccessToken)
+		expiresAt = token.expiresAt(now)
+	}
+	exchangeURL := strings.TrimSuffix(p.Registry, "/") + "/oauth2/exchange"
+	body, err := providerRequest(p.Retry, func() (*http.Request, error) {
+		return newFormRequest(exchangeURL, form)
+	}, oauth2Error(exchangeURL))
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	var result struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		// The body is not printed, it holds the token
+		return "", "", time.Time{}, stacktrace.Propagate(err, "Cannot decode token response of %s", exchangeURL)
+	}
+	if result.RefreshToken == "" {
+		return "", "", time.Time{}, stacktrace.NewError("Empty refresh token from %s", exchangeURL)
+	}
+	AddSecret(result.RefreshToken)
+	if tokenExpiry := jwtExpiry(result.RefreshToken); !tokenExpiry.IsZero() {
+		expiresAt = tokenExpiry
+	}
+	return ACRTokenUsername, result.RefreshToken, expiresAt, nil
+}
+
+// servicePrincipalToken gets an Azure AD access token with the client
+// credentials of a service principal
+func (p *ACRProvider) servicePrincipalToken(tenantID string) (*oauth2Token, error) {
+	clientID := p.ClientID
+	if clientID == "" {
+		clientID = os.Getenv("AZURE_CLIENT_ID")
+	}
+	clientSecret := p.ClientSecret
+	if clientSecret == "" {
+		clientSecret = os.Getenv("AZURE_CLIENT_SECRET")
+	}
+	if tenantID == "" || clientID == "" || clientSecret == "" {
+		return nil, stacktrace.NewError("Missing tenant, client ID or client secret of the service principal for %s", p.Registry)
+	}
+	AddSecret(clientSecret)
+	authority := p.Authority
+	if authority == "" {
+		authority = DefaultAzureAuthority
+	}
+	tokenURL := strings.TrimSuffix(authority, "/") + "/" + url.PathEscape(tenantID) + "/oauth2/v2.0/token"
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", clientID)
+	form.Set("client_secret", clientSecret)
+	form.Set("scope", azureManagementScope)
+	body, err := providerRequest(p.Retry, func() (*http.Request, error) {
+		return newFormRequest(tokenURL, form)
+	}, oauth2Error(tokenURL))
+	if err != nil {
+		return nil, err
+	}
+	return decodeOAuth2Token(tokenURL, body)
+}
+
+func (p *ACRProvider) timeNow() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+	return time.Now()
+}
+
+// jwtExpiry reads the exp claim of a JWT without verifying it, zero if the
+// token is not a JWT
+func jwtExpiry(token string) time.Time {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segments[1], "="))
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
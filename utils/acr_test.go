@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/anduintransaction/doriath/utils/registrytest"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ACRTestSuite struct {
+	suite.Suite
+	aad      *registrytest.OAuth2
+	registry *registrytest.Registry
+}
+
+func (s *ACRTestSuite) SetupTest() {
+	for _, name := range []string{"AZURE_TENANT_ID", "AZURE_CLIENT_ID", "AZURE_CLIENT_SECRET"} {
+		s.T().Setenv(name, "")
+	}
+	s.aad = registrytest.NewOAuth2("s3cr3t-aad-access-token")
+	s.aad.ClientID = "doriath"
+	s.aad.ClientSecret = "s3cr3t-client-secret"
+	s.registry = registrytest.NewRegistry()
+	s.registry.BasicAuth = true
+	s.registry.Username = ACRTokenUsername
+	s.registry.Password = "s3cr3t-acr-refresh-token"
+	s.registry.ExchangeToken = "s3cr3t-aad-access-token"
+	s.registry.PutImage("anduin/elrond", "1.0", nil)
+}
+
+func (s *ACRTestSuite) TearDownTest() {
+	s.aad.Close()
+	s.registry.Close()
+}
+
+func (s *ACRTestSuite) TestServicePrincipal() {
+	s.T().Setenv("AZURE_CLIENT_SECRET", "s3cr3t-client-secret")
+	provider := &ACRProvider{Registry: s.registry.URL, TenantID: "anduin", ClientID: "doriath", Authority: s.aad.URL}
+	username, password, expiresAt, err := provider.Credential()
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), ACRTokenUsername, username)
+	require.Equal(s.T(), "s3cr3t-acr-refresh-token", password)
+	require.WithinDuration(s.T(), time.Now().Add(time.Hour), expiresAt, time.Minute)
+	require.Equal(s.T(), []string{"/anduin/oauth2/v2.0/token client_credentials"}, s.aad.Requests())
+	require.Equal(s.T(), []string{"POST exchange access_token"}, s.registry.TokenRequests())
+	require.Equal(s.T(), SecretMask+" "+SecretMask, Mask("s3cr3t-client-secret s3cr3t-aad-access-token"))
+
+	provider.ClientID = "gandalf"
+	_, _, _, err = provider.Credential()
+	require.NotNil(s.T(), err)
+	require.Contains(s.T(), err.Error(), "invalid_client")
+
+	provider = &ACRProvider{Registry: s.registry.URL, Authority: s.aad.URL}
+	_, _, _, err = provider.Credential()
+	require.NotNil(s.T(), err, "missing service principal must be an error")
+	require.Len(s.T(), s.aad.Requests(), 2)
+}
+
+func (s *ACRTestSuite) TestRefreshToken() {
+	s.registry.ExchangeToken = "s3cr3t-aad-refresh-token"
+	provider := &ACRProvider{Registry: s.registry.URL, RefreshToken: "s3cr3t-aad-refresh-token", Authority: s.aad.URL}
+	registry, err := NewRegistry(&DockerCredential{Registry: s.registry.URL, Provider: CacheCredentialProvider(provider)})
+	require.Nil(s.T(), err)
+	for i := 0; i < 2; i++ {
+		exists, _, err := registry.TagExists("anduin/elrond", "1.0")
+		require.Nil(s.T(), err)
+		require.True(s.T(), exists)
+	}
+	require.Equal(s.T(), []string{"POST exchange refresh_token"}, s.registry.TokenRequests(), "the ACR token must be reused")
+	require.Empty(s.T(), s.aad.Requests())
+
+	provider.RefreshToken = "s3cr3t-expired-refresh-token"
+	_, _, _, err = provider.Credential()
+	require.NotNil(s.T(), err)
+	require.Contains(s.T(), err.Error(), "invalid_grant")
+}
+
+func (s *ACRTestSuite) TestJWTExpiry() {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp": %d}`, 1552521600)))
+	require.Equal(s.T(), time.Unix(1552521600, 0), jwtExpiry("header."+payload+".signature"))
+	require.True(s.T(), jwtExpiry("opaque-token").IsZero())
+	require.True(s.T(), jwtExpiry("header.!!!.signature").IsZero())
+}
+
+func TestACR(t *testing.T) {
+	suite.Run(t, new(ACRTestSuite))
+}
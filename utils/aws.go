@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// AWSCredentials are the keys signing AWS requests
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// LoadAWSCredentials reads AWS credentials like the AWS CLI does: from the
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN variables, or
+// from a profile of the shared credentials file. The profile defaults to
+// AWS_PROFILE, then "default". The variables are ignored when a profile is
+// given.
+func LoadAWSCredentials(profile string) (*AWSCredentials, error) {
+	if profile == "" {
+		accessKeyID := os.Getenv("AWS_ACCESS_KEY_ID")
+		secretAccessKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if accessKeyID != "" && secretAccessKey != "" {
+			return &AWSCredentials{
+				AccessKeyID:     accessKeyID,
+				SecretAccessKey: secretAccessKey,
+				SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			}, nil
+		}
+		profile = os.Getenv("AWS_PROFILE")
+		if profile == "" {
+			profile = "default"
+		}
+	}
+	filename := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if filename == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "Cannot find AWS credentials file")
+		}
+		filename = filepath.Join(home, ".aws", "credentials")
+	}
+	values, err := readAWSProfile(filename, profile)
+	if err != nil {
+		return nil, err
+	}
+	credentials := &AWSCredentials{
+		AccessKeyID:     values["aws_access_key_id"],
+		SecretAccessKey: values["aws_secret_access_key"],
+		SessionToken:    values["aws_session_token"],
+	}
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return nil, stacktrace.NewError("Missing AWS credentials in profile %q of %q", profile, filename)
+	}
+	return credentials, nil
+}
+
+// readAWSProfile reads the keys of a profile section of an AWS INI file
+func readAWSProfile(filename, profile string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot read AWS credentials file %q", filename)
+	}
+	defer file.Close()
+	values := make(map[string]string)
+	found := false
+	inProfile := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inProfile = strings.TrimSpace(line[1:len(line)-1]) == profile
+			found = found || inProfile
+			continue
+		}
+		if !inProfile {
+			continue
+		}
+		segments := strings.SplitN(line, "=", 2)
+		if len(segments) == 2 {
+			values[strings.ToLower(strings.TrimSpace(segments[0]))] = strings.TrimSpace(segments[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot read AWS credentials file %q", filename)
+	}
+	if !found {
+		return nil, stacktrace.NewError("Cannot find AWS profile %q in %q", profile, filename)
+	}
+	return values, nil
+}
+
+const (
+	awsDateFormat       = "20060102T150405Z"
+	awsSigningAlgorithm = "AWS4-HMAC-SHA256"
+)
+
+// signAWSRequest signs a request with AWS Signature Version 4, signing the
+// host and every header already set on the request
+func signAWSRequest(request *http.Request, body []byte, credentials *AWSCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format(awsDateFormat)
+	request.Header.Set("X-Amz-Date", amzDate)
+	if credentials.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		trimmed := make([]string, 0, len(values))
+		for _, value := range values {
+			trimmed = append(trimmed, strings.Join(strings.Fields(value), " "))
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := &strings.Builder{}
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := request.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		path,
+		strings.Replace(request.URL.Query().Encode(), "+", "%20", -1),
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+	scope := strings.Join([]string{amzDate[:8], region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{awsSigningAlgorithm, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+	key := []byte("AWS4" + credentials.SecretAccessKey)
+	for _, part := range []string{amzDate[:8], region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	request.Header.Set("Authorization", awsSigningAlgorithm+" Credential="+credentials.AccessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type AWSTestSuite struct {
+	suite.Suite
+	oldEnv map[string]string
+}
+
+var awsEnv = []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE", "AWS_SHARED_CREDENTIALS_FILE", "AWS_REGION", "AWS_DEFAULT_REGION"}
+
+// clearAWSEnv unsets the AWS variables, returning their values
+func clearAWSEnv() map[string]string {
+	oldEnv := make(map[string]string)
+	for _, key := range awsEnv {
+		if value, ok := os.LookupEnv(key); ok {
+			oldEnv[key] = value
+		}
+		os.Unsetenv(key)
+	}
+	return oldEnv
+}
+
+// restoreAWSEnv restores the AWS variables cleared by clearAWSEnv
+func restoreAWSEnv(oldEnv map[string]string) {
+	for _, key := range awsEnv {
+		if value, ok := oldEnv[key]; ok {
+			os.Setenv(key, value)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func (s *AWSTestSuite) SetupTest() {
+	s.oldEnv = clearAWSEnv()
+}
+
+func (s *AWSTestSuite) TearDownTest() {
+	restoreAWSEnv(s.oldEnv)
+}
+
+// exampleCredentials are the credentials of the AWS Signature Version 4 test
+// suite
+var exampleCredentials = &AWSCredentials{
+	AccessKeyID:     "AKIDEXAMPLE",
+	SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+}
+
+func (s *AWSTestSuite) TestSignAWSRequest() {
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	request, err := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	require.Nil(s.T(), err)
+	signAWSRequest(request, nil, exampleCredentials, "us-east-1", "service", now)
+	require.Equal(s.T(), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31", request.Header.Get("Authorization"))
+	require.Equal(s.T(), "20150830T123600Z", request.Header.Get("X-Amz-Date"))
+
+	request, err = http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	require.Nil(s.T(), err)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(request, nil, exampleCredentials, "us-east-1", "iam", now)
+	require.Equal(s.T(), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7", request.Header.Get("Authorization"))
+
+	sessionCredentials := *exampleCredentials
+	sessionCredentials.SessionToken = "session"
+	request, err = http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	require.Nil(s.T(), err)
+	signAWSRequest(request, nil, &sessionCredentials, "us-east-1", "service", now)
+	require.Equal(s.T(), "session", request.Header.Get("X-Amz-Security-Token"))
+	require.Contains(s.T(), request.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date;x-amz-security-token,")
+}
+
+func (s *AWSTestSuite) TestLoadAWSCredentials() {
+	credentialsFile := filepath.Join(s.T().TempDir(), "credentials")
+	err := ioutil.WriteFile(credentialsFile, []byte(`# shared credentials
+[default]
+aws_access_key_id = AKIDDEFAULT
+aws_secret_access_key = default-secret
+
+[ci]
+aws_access_key_id=AKIDCI
+aws_secret_access_key=ci-secret
+aws_session_token=ci-session
+
+[empty]
+region = eu-west-1
+`), 0600)
+	require.Nil(s.T(), err)
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+
+	credentials, err := LoadAWSCredentials("")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), &AWSCredentials{AccessKeyID: "AKIDDEFAULT", SecretAccessKey: "default-secret"}, credentials)
+	os.Setenv("AWS_PROFILE", "ci")
+	credentials, err = LoadAWSCredentials("")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), &AWSCredentials{AccessKeyID: "AKIDCI", SecretAccessKey: "ci-secret", SessionToken: "ci-session"}, credentials)
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDENV")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+	credentials, err = LoadAWSCredentials("")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), &AWSCredentials{AccessKeyID: "AKIDENV", SecretAccessKey: "env-secret"}, credentials, "variables must be used first")
+	credentials, err = LoadAWSCredentials("default")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "AKIDDEFAULT", credentials.AccessKeyID, "a given profile must be used over the variables")
+
+	_, err = LoadAWSCredentials("empty")
+	require.NotNil(s.T(), err)
+	_, err = LoadAWSCredentials("missing")
+	require.NotNil(s.T(), err)
+}
+
+func TestAWS(t *testing.T) {
+	suite.Run(t, new(AWSTestSuite))
+}
@@ -0,0 +1,342 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Builder names
+const (
+	BuilderDocker  = "docker"
+	BuilderBuildx  = "buildx"
+	BuilderPodman  = "podman"
+	BuilderBuildah = "buildah"
+	BuilderEngine  = "engine"
+)
+
+// Builder builds, tags, pushes and removes images. Output of long running
+// operations is sent to out, or stdout and stderr if out is nil.
+type Builder interface {
+	// Name returns the name of the builder
+	Name() string
+	// Detect checks if the builder can be used on this machine
+	Detect() error
+	// Build builds an image and returns its ID
+	Build(opts *DockerBuildOptions, out io.Writer) (string, error)
+	// Push pushes an image and returns the digest of its manifest. Images with
+	// platforms are built again for every platform and pushed as a
+	// multi-platform image.
+	Push(opts *DockerBuildOptions, out io.Writer) (string, error)
+	// Tag adds newTag to the image name:tag
+	Tag(name, tag, newTag string) error
+	// Remove removes an image, an image which does not exist is not an error
+	Remove(name, tag string, out io.Writer) error
+	// ExistsLocally checks if an image exists on this machine
+	ExistsLocally(fullname string) (bool, error)
+	// Pull pulls an image if it does not exist on this machine
+	Pull(fullname string, out io.Writer) error
+	// Login logins to a registry, an empty host means the default registry
+	Login(host, username, password string) error
+}
+
+// BuilderNames returns the names of all supported builders
+func BuilderNames() []string {
+	return []string{BuilderDocker, BuilderBuildx, BuilderPodman, BuilderBuildah, BuilderEngine}
+}
+
+// NewBuilder creates a builder from its name, an empty name means docker
+func NewBuilder(name string) (Builder, error) {
+	switch name {
+	case "", BuilderDocker:
+		return &cliBuilder{name: BuilderDocker, binary: "docker", build: []string{"build"}}, nil
+	case BuilderBuildx:
+		return &cliBuilder{name: BuilderBuildx, binary: "docker", build: []string{"buildx", "build", "--load"}}, nil
+	case BuilderPodman:
+		return &cliBuilder{name: BuilderPodman, binary: "podman", build: []string{"build"}, manifestPush: true}, nil
+	case BuilderBuildah:
+		return &cliBuilder{name: BuilderBuildah, binary: "buildah", build: []string{"build"}, manifestPush: true}, nil
+	case BuilderEngine:
+		builder, err := newEngineBuilder()
+		if err != nil {
+			return nil, err
+		}
+		return builder, nil
+	default:
+		return nil, stacktrace.NewError("Unknown builder %q, supported builders are %s", name, strings.Join(BuilderNames(), ", "))
+	}
+}
+
+// DockerBuildOptions holds the options to build a docker image
+type DockerBuildOptions struct {
+	Name      string
+	Tag       string
+	BuildRoot string
+	// Dockerfile is the path of the dockerfile, empty means BuildRoot/Dockerfile
+	Dockerfile string
+	Target     string
+	BuildArgs  map[string]string
+	Labels     map[string]string
+	Platforms  []string
+	// Context stops the build or the push when it is done, nil means never
+	Context context.Context
+}
+
+// FullName returns the name and tag of the image
+func (o *DockerBuildOptions) FullName() string {
+	return o.Name + ":" + o.Tag
+}
+
+func (o *DockerBuildOptions) context() context.Context {
+	if o.Context == nil {
+		return context.Background()
+	}
+	return o.Context
+}
+
+// buildArgs returns the build arguments shared by all builders, except the tag
+// and the build root
+func (o *DockerBuildOptions) buildArgs() []string {
+	args := []string{}
+	if o.Dockerfile != "" {
+		args = append(args, "-f", o.Dockerfile)
+	}
+	if o.Target != "" {
+		args = append(args, "--target", o.Target)
+	}
+	args = append(args, keyValueArgs("--build-arg", o.BuildArgs)...)
+	args = append(args, keyValueArgs("--label", o.Labels)...)
+	return args
+}
+
+func keyValueArgs(flag string, values map[string]string) []string {
+	args := []string{}
+	for _, pair := range SortedKeyValues(values) {
+		args = append(args, flag, pair)
+	}
+	return args
+}
+
+// imageNotFoundMessages are the error messages of the command line builders
+// when an image does not exist
+var imageNotFoundMessages = []string{"no such image", "image not known"}
+
+// cliBuilder runs the command line of docker, docker buildx, podman or buildah
+type cliBuilder struct {
+	name   string
+	binary string
+	// build is the sub command used to build an image
+	build []string
+	// manifestPush builds multi-platform images into a manifest list which is
+	// pushed with "manifest push", instead of using docker buildx
+	manifestPush bool
+}
+
+func (b *cliBuilder) Name() string {
+	return b.name
+}
+
+func (b *cliBuilder) Detect() error {
+	_, err := exec.LookPath(b.binary)
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot find %s command", b.binary)
+	}
+	if b.name == BuilderBuildx {
+		err = exec.Command(b.binary, "buildx", "version").Run()
+		return stacktrace.Propagate(err, "Cannot find docker buildx plugin")
+	}
+	return nil
+}
+
+func (b *cliBuilder) Build(opts *DockerBuildOptions, out io.Writer) (string, error) {
+	imageID, err := readTempFile(func(iidFile string) error {
+		args := append([]string{}, b.build...)
+		args = append(args, "-t", opts.FullName(), "--iidfile", iidFile)
+		args = append(args, opts.buildArgs()...)
+		args = append(args, opts.BuildRoot)
+		return b.run(opts.context(), out, args...)
+	})
+	return imageID, stacktrace.Propagate(err, "Cannot build image %s", opts.FullName())
+}
+
+func (b *cliBuilder) Push(opts *DockerBuildOptions, out io.Writer) (string, error) {
+	var digest string
+	var err error
+	switch {
+	case len(opts.Platforms) == 0 && b.manifestPush:
+		digest, err = readTempFile(func(digestFile string) error {
+			return b.run(opts.context(), out, "push", "--digestfile", digestFile, opts.FullName())
+		})
+	case len(opts.Platforms) == 0:
+		// docker push has no digest file but prints "<tag>: digest: <digest> size: <size>"
+		output := &bytes.Buffer{}
+		stdout, stderr, flush := commandWriters(out)
+		cmd := exec.CommandContext(opts.context(), b.binary, "push", opts.FullName())
+		cmd.Stdout, cmd.Stderr = io.MultiWriter(stdout, output), stderr
+		err = cmd.Run()
+		flush()
+		if match := pushDigestRegex.FindStringSubmatch(output.String()); match != nil {
+			digest = match[1]
+		}
+	case !b.manifestPush:
+		var metadata string
+		metadata, err = readTempFile(func(metadataFile string) error {
+			args := []string{"buildx", "build", "--platform", strings.Join(opts.Platforms, ","), "-t", opts.FullName()}
+			args = append(args, opts.buildArgs()...)
+			args = append(args, "--metadata-file", metadataFile, "--push", opts.BuildRoot)
+			return b.run(opts.context(), out, args...)
+		})
+		if err == nil {
+			digest, err = buildxMetadataDigest(metadata)
+		}
+	default:
+		digest, err = b.pushManifest(opts, out)
+	}
+	return digest, stacktrace.Propagate(err, "Cannot push image %s", opts.FullName())
+}
+
+// pushManifest builds every platform of an image into a manifest list and
+// pushes it
+func (b *cliBuilder) pushManifest(opts *DockerBuildOptions, out io.Writer) (string, error) {
+	// A manifest list left by a previous run would keep its old images
+	b.runQuiet("manifest", "rm", opts.FullName())
+	args := append([]string{}, b.build...)
+	args = append(args, "--platform", strings.Join(opts.Platforms, ","), "--manifest", opts.FullName())
+	args = append(args, opts.buildArgs()...)
+	args = append(args, opts.BuildRoot)
+	err := b.run(opts.context(), out, args...)
+	if err != nil {
+		return "", err
+	}
+	return readTempFile(func(digestFile string) error {
+		return b.run(opts.context(), out, "manifest", "push", "--all", "--digestfile", digestFile, opts.FullName(), "docker://"+opts.FullName())
+	})
+}
+
+func (b *cliBuilder) Tag(name, tag, newTag string) error {
+	_, err := b.runQuiet("tag", name+":"+tag, name+":"+newTag)
+	return stacktrace.Propagate(err, "Cannot tag image %s:%s as %s", name, tag, newTag)
+}
+
+func (b *cliBuilder) Remove(name, tag string, out io.Writer) error {
+	cmd := exec.Command(b.binary, "rmi", name+":"+tag)
+	errOutput := &bytes.Buffer{}
+	stdout, _, flush := commandWriters(out)
+	defer flush()
+	cmd.Stdout = stdout
+	cmd.Stderr = errOutput
+	err := cmd.Run()
+	if err == nil || isImageNotFound(errOutput.String()) {
+		return nil
+	}
+	return stacktrace.Propagate(err, "Cannot remove image %s:%s: %s", name, tag, strings.TrimSpace(errOutput.String()))
+}
+
+func (b *cliBuilder) ExistsLocally(fullname string) (bool, error) {
+	cmd := exec.Command(b.binary, "images", "-q", fullname)
+	errOutput := &bytes.Buffer{}
+	cmd.Stderr = errOutput
+	output, err := cmd.Output()
+	if err != nil {
+		if isImageNotFound(errOutput.String()) {
+			return false, nil
+		}
+		return false, stacktrace.Propagate(err, "Cannot check image on local: %s", fullname)
+	}
+	return len(bytes.TrimSpace(output)) > 0, nil
+}
+
+func (b *cliBuilder) Pull(fullname string, out io.Writer) error {
+	existed, err := b.ExistsLocally(fullname)
+	if err != nil {
+		return err
+	}
+	if existed {
+		return nil
+	}
+	return stacktrace.Propagate(b.run(context.Background(), out, "pull", fullname), "Cannot pull image %s", fullname)
+}
+
+// Login sends the password on the standard input, so that it does not appear
+// in the process list
+func (b *cliBuilder) Login(host, username, password string) error {
+	args := []string{"login", "-u", username, "--password-stdin"}
+	if host != "" {
+		args = append(args, host)
+	}
+	cmd := exec.Command(b.binary, args...)
+	cmd.Stdin = strings.NewReader(password)
+	errOutput := &bytes.Buffer{}
+	cmd.Stderr = errOutput
+	err := cmd.Run()
+	return stacktrace.Propagate(err, "Cannot login: %s", strings.TrimSpace(errOutput.String()))
+}
+
+// run runs the builder command until ctx is done, sending its output to out
+func (b *cliBuilder) run(ctx context.Context, out io.Writer, args ...string) error {
+	cmd := exec.CommandContext(ctx, b.binary, args...)
+	stdout, stderr, flush := commandWriters(out)
+	defer flush()
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	return cmd.Run()
+}
+
+// runQuiet runs the builder command, returning its error output
+func (b *cliBuilder) runQuiet(args ...string) (string, error) {
+	cmd := exec.Command(b.binary, args...)
+	errOutput := &bytes.Buffer{}
+	cmd.Stderr = errOutput
+	err := cmd.Run()
+	return strings.TrimSpace(errOutput.String()), err
+}
+
+var pushDigestRegex = regexp.MustCompile(`digest: (sha256:[0-9a-f]{64})`)
+
+func buildxMetadataDigest(metadata string) (string, error) {
+	var result struct {
+		Digest string `json:"containerimage.digest"`
+	}
+	err := json.Unmarshal([]byte(metadata), &result)
+	if err != nil {
+		return "", stacktrace.Propagate(err, "Cannot decode buildx metadata: %s", metadata)
+	}
+	return result.Digest, nil
+}
+
+// readTempFile calls fn with the path of a temporary file and returns what fn
+// wrote in it. It is used for the --iidfile and --digestfile flags.
+func readTempFile(fn func(path string) error) (string, error) {
+	f, err := ioutil.TempFile("", "doriath")
+	if err != nil {
+		return "", stacktrace.Propagate(err, "Cannot create temporary file")
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	err = fn(f.Name())
+	if err != nil {
+		return "", err
+	}
+	content, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return "", stacktrace.Propagate(err, "Cannot read %q", f.Name())
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+func isImageNotFound(errOutput string) bool {
+	errOutput = strings.ToLower(errOutput)
+	for _, message := range imageNotFoundMessages {
+		if strings.Contains(errOutput, message) {
+			return true
+		}
+	}
+	return false
+}
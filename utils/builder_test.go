@@ -0,0 +1,182 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// fakeBuilderScript records its arguments, one command per line, and the
+// standard input of login commands. It writes fake IDs and digests to the
+// --iidfile, --digestfile and --metadata-file paths, and fails with an image
+// not found error for "rmi missing:1"
+const fakeBuilderScript = `#!/bin/sh
+line=""
+for arg in "$@"; do
+  case "$prev" in
+    --iidfile) echo "sha256:image" > "$arg"; arg=FILE ;;
+    --digestfile) echo "sha256:pushed" > "$arg"; arg=FILE ;;
+    --metadata-file) echo '{"containerimage.digest": "sha256:buildx"}' > "$arg"; arg=FILE ;;
+  esac
+  prev="$arg"
+  line="$line $arg"
+done
+echo "${line# }" >> "$FAKE_BUILDER_LOG"
+if [ "$1" = "login" ]; then
+  read password
+  echo "stdin: $password" >> "$FAKE_BUILDER_LOG"
+fi
+if [ "$1" = "push" ] && [ "$2" != "--digestfile" ]; then
+  echo "1.0: digest: sha256:0000000000000000000000000000000000000000000000000000000000000000 size: 528"
+fi
+if [ "$1 $2" = "rmi missing:1" ]; then
+  echo "Error: No such image: missing:1" >&2
+  exit 1
+fi
+if [ "$1 $2" = "rmi used:1" ]; then
+  echo "Error: image is being used by running container" >&2
+  exit 1
+fi
+`
+
+type BuilderTestSuite struct {
+	suite.Suite
+	binDir  string
+	logFile string
+	oldPath string
+}
+
+func (s *BuilderTestSuite) SetupTest() {
+	binDir, err := ioutil.TempDir("", "doriath-builder")
+	require.Nil(s.T(), err)
+	s.binDir = binDir
+	s.logFile = filepath.Join(binDir, "commands.log")
+	for _, binary := range []string{"docker", "podman", "buildah"} {
+		err = ioutil.WriteFile(filepath.Join(binDir, binary), []byte(fakeBuilderScript), 0755)
+		require.Nil(s.T(), err)
+	}
+	s.oldPath = os.Getenv("PATH")
+	os.Setenv("PATH", binDir+string(os.PathListSeparator)+s.oldPath)
+	os.Setenv("FAKE_BUILDER_LOG", s.logFile)
+}
+
+func (s *BuilderTestSuite) TearDownTest() {
+	os.Setenv("PATH", s.oldPath)
+	os.Unsetenv("FAKE_BUILDER_LOG")
+	os.RemoveAll(s.binDir)
+}
+
+func (s *BuilderTestSuite) commands() []string {
+	content, err := ioutil.ReadFile(s.logFile)
+	require.Nil(s.T(), err)
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+func (s *BuilderTestSuite) builder(name string) Builder {
+	builder, err := NewBuilder(name)
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), builder.Detect())
+	return builder
+}
+
+var testBuildOptions = &DockerBuildOptions{
+	Name:       "anduin/elrond",
+	Tag:        "1.0",
+	BuildRoot:  "/src/elrond",
+	Dockerfile: "/src/elrond/Dockerfile.prod",
+	Target:     "prod",
+	BuildArgs:  map[string]string{"B": "2", "A": "1"},
+	Labels:     map[string]string{"team": "rivendell"},
+}
+
+func (s *BuilderTestSuite) TestDockerBuilder() {
+	builder := s.builder("")
+	require.Equal(s.T(), BuilderDocker, builder.Name())
+	imageID, err := builder.Build(testBuildOptions, ioutil.Discard)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "sha256:image", imageID)
+	require.Nil(s.T(), builder.Tag("anduin/elrond", "1.0", "latest"))
+	digest, err := builder.Push(testBuildOptions, ioutil.Discard)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "sha256:0000000000000000000000000000000000000000000000000000000000000000", digest)
+	multiPlatform := *testBuildOptions
+	multiPlatform.Platforms = []string{"linux/amd64", "linux/arm64"}
+	digest, err = builder.Push(&multiPlatform, ioutil.Discard)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "sha256:buildx", digest)
+	require.Equal(s.T(), []string{
+		"build -t anduin/elrond:1.0 --iidfile FILE -f /src/elrond/Dockerfile.prod --target prod --build-arg A=1 --build-arg B=2 --label team=rivendell /src/elrond",
+		"tag anduin/elrond:1.0 anduin/elrond:latest",
+		"push anduin/elrond:1.0",
+		"buildx build --platform linux/amd64,linux/arm64 -t anduin/elrond:1.0 -f /src/elrond/Dockerfile.prod --target prod --build-arg A=1 --build-arg B=2 --label team=rivendell --metadata-file FILE --push /src/elrond",
+	}, s.commands())
+}
+
+func (s *BuilderTestSuite) TestBuildxBuilder() {
+	builder := s.builder(BuilderBuildx)
+	_, err := builder.Build(&DockerBuildOptions{Name: "anduin/elrond", Tag: "1.0", BuildRoot: "/src/elrond"}, ioutil.Discard)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), []string{
+		"buildx version",
+		"buildx build --load -t anduin/elrond:1.0 --iidfile FILE /src/elrond",
+	}, s.commands())
+}
+
+func (s *BuilderTestSuite) TestManifestPush() {
+	for _, name := range []string{BuilderPodman, BuilderBuildah} {
+		os.Remove(s.logFile)
+		builder := s.builder(name)
+		multiPlatform := *testBuildOptions
+		multiPlatform.Platforms = []string{"linux/amd64", "linux/arm64"}
+		digest, err := builder.Push(&multiPlatform, ioutil.Discard)
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), "sha256:pushed", digest)
+		require.Equal(s.T(), []string{
+			"manifest rm anduin/elrond:1.0",
+			"build --platform linux/amd64,linux/arm64 --manifest anduin/elrond:1.0 -f /src/elrond/Dockerfile.prod --target prod --build-arg A=1 --build-arg B=2 --label team=rivendell /src/elrond",
+			"manifest push --all --digestfile FILE anduin/elrond:1.0 docker://anduin/elrond:1.0",
+		}, s.commands(), "unexpected commands for %s", name)
+	}
+}
+
+func (s *BuilderTestSuite) TestLogin() {
+	for _, name := range []string{BuilderDocker, BuilderPodman} {
+		os.Remove(s.logFile)
+		builder := s.builder(name)
+		require.Nil(s.T(), builder.Login("registry.anduin.io", "frodo", "mellon"))
+		require.Nil(s.T(), builder.Login("", "sam", "potatoes"))
+		commands := s.commands()
+		require.Equal(s.T(), []string{
+			"login -u frodo --password-stdin registry.anduin.io",
+			"stdin: mellon",
+			"login -u sam --password-stdin",
+			"stdin: potatoes",
+		}, commands)
+		for _, command := range commands {
+			if strings.HasPrefix(command, "login") {
+				require.NotContains(s.T(), command, "mellon", "password must not be in the arguments")
+				require.NotContains(s.T(), command, "potatoes", "password must not be in the arguments")
+			}
+		}
+	}
+}
+
+func (s *BuilderTestSuite) TestRemove() {
+	builder := s.builder(BuilderPodman)
+	require.Nil(s.T(), builder.Remove("missing", "1", ioutil.Discard), "missing image must not be an error")
+	require.NotNil(s.T(), builder.Remove("used", "1", ioutil.Discard))
+}
+
+func (s *BuilderTestSuite) TestUnknownBuilder() {
+	_, err := NewBuilder("kaniko")
+	require.NotNil(s.T(), err)
+}
+
+func TestBuilder(t *testing.T) {
+	suite.Run(t, new(BuilderTestSuite))
+}
@@ -1,12 +1,13 @@
 package utils
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
-	"time"
 
 	"github.com/fatih/color"
 	"github.com/palantir/stacktrace"
@@ -36,38 +37,59 @@ func ResolveDir(rootDir, path string) string {
 
 // Info .
 func Info(msg string, args ...interface{}) {
-	color.New(color.FgBlue).Printf(appendNewLine(msg), args...)
+	color.New(color.FgBlue).Print(format(msg, args...))
 }
 
 // Info2 .
 func Info2(msg string, args ...interface{}) {
-	color.New(color.FgCyan).Printf(appendNewLine(msg), args...)
+	color.New(color.FgCyan).Print(format(msg, args...))
+}
+
+// Info2To is the same as Info2 but writes to out, or stdout if out is nil
+func Info2To(out io.Writer, msg string, args ...interface{}) {
+	if out == nil {
+		Info2(msg, args...)
+		return
+	}
+	color.New(color.FgCyan).Fprint(out, format(msg, args...))
 }
 
 // Warn .
 func Warn(msg string, args ...interface{}) {
-	color.New(color.FgYellow).Printf(appendNewLine(msg), args...)
+	color.New(color.FgYellow).Print(format(msg, args...))
 }
 
 // Success .
 func Success(msg string, args ...interface{}) {
-	color.New(color.FgGreen).Printf(appendNewLine(msg), args...)
+	color.New(color.FgGreen).Print(format(msg, args...))
 }
 
 // Error .
 func Error(err error) {
 	debug := os.Getenv("DEBUG")
 	if debug == "true" || debug == "1" {
-		color.New(color.FgRed).Fprintln(os.Stderr, err)
+		color.New(color.FgRed).Fprintln(os.Stderr, Mask(fmt.Sprint(err)))
 	} else {
-		color.New(color.FgRed).Fprintln(os.Stderr, stacktrace.RootCause(err))
+		color.New(color.FgRed).Fprintln(os.Stderr, Mask(fmt.Sprint(stacktrace.RootCause(err))))
 	}
 }
 
+// IsCI checks if doriath runs in a continuous integration, which sets the CI
+// variable
+func IsCI() bool {
+	ci := os.Getenv("CI")
+	return ci != "" && ci != "false" && ci != "0"
+}
+
 // Fatal .
 func Fatal(err error) {
 	Error(err)
-	os.Exit(1)
+	Exit(1)
+}
+
+// format formats a log message, masking secrets
+func format(msg string, args ...interface{}) string {
+	return Mask(fmt.Sprintf(appendNewLine(msg), args...))
 }
 
 func appendNewLine(msg string) string {
@@ -77,16 +99,6 @@ func appendNewLine(msg string) string {
 	return msg + "\n"
 }
 
-// DetectRequirement detects requirement for doriath
-func DetectRequirement() error {
-	return detectDocker()
-}
-
-func detectDocker() error {
-	cmd := exec.Command("docker")
-	return stacktrace.Propagate(cmd.Run(), "Cannot find docker command")
-}
-
 // StringSet is a set of string
 type StringSet map[string]struct{}
 
@@ -108,21 +120,20 @@ func (s StringSet) Exists(value string) bool {
 
 // RunShellCommand runs a command under bash shell
 func RunShellCommand(command string) error {
-	cmd := exec.Command("sh", "-c", command)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	return RunShellCommandWithOutput(command, nil)
 }
 
-// RetryWithFixedDelay .
-func RetryWithFixedDelay(delay time.Duration, retries int, f func() error) error {
-	var err error
-	for i := 0; i < retries; i++ {
-		err = f()
-		if err == nil {
-			return nil
-		}
-		time.Sleep(delay)
-	}
-	return err
+// RunShellCommandWithOutput runs a command under bash shell, sending its output to out
+func RunShellCommandWithOutput(command string, out io.Writer) error {
+	return RunShellCommandContext(context.Background(), command, out)
+}
+
+// RunShellCommandContext runs a command under bash shell until ctx is done,
+// sending its output to out
+func RunShellCommandContext(ctx context.Context, command string, out io.Writer) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	stdout, stderr, flush := commandWriters(out)
+	defer flush()
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	return cmd.Run()
 }
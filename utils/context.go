@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+// ContextHashLabel is the image label storing the hash of the build context
+const ContextHashLabel = "doriath.context-hash"
+
+// HashBuildContext computes a deterministic hash of the files docker would send
+// as build context, honouring the .dockerignore file of buildRoot. dockerfile
+// is the path of the dockerfile, empty for the Dockerfile of buildRoot.
+func HashBuildContext(buildRoot, dockerfile string) (string, error) {
+	h := sha256.New()
+	err := walkBuildContext(buildRoot, dockerfile, func(path, rel string, info os.FileInfo) error {
+		switch {
+		case info.IsDir():
+			fmt.Fprintf(h, "d %s\n", rel)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return stacktrace.Propagate(err, "Cannot read link %q", path)
+			}
+			fmt.Fprintf(h, "l %s %s\n", rel, target)
+		case info.Mode().IsRegular():
+			fileHash, err := HashFile(path)
+			if err != nil {
+				return err
+			}
+			// Only the executable bit is used, other permission bits depend on
+			// the umask of the machine doing the checkout
+			fmt.Fprintf(h, "f %s %t %s\n", rel, info.Mode()&0111 != 0, fileHash)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// walkBuildContext calls fn, in lexical order, for every file and directory
+// docker would send as build context, with the dockerfile at path dockerfile,
+// empty for the Dockerfile of buildRoot. rel is the slash separated path of
+// the file relative to buildRoot.
+func walkBuildContext(buildRoot, dockerfile string, fn func(path, rel string, info os.FileInfo) error) error {
+	dockerIgnore, err := ReadDockerIgnore(buildRoot)
+	if err != nil {
+		return err
+	}
+	dockerfileRel := "Dockerfile"
+	if dockerfile != "" {
+		rel, err := filepath.Rel(buildRoot, dockerfile)
+		if err != nil {
+			return stacktrace.Propagate(err, "Cannot resolve %q in build context %q", dockerfile, buildRoot)
+		}
+		dockerfileRel = filepath.ToSlash(rel)
+	}
+	return filepath.Walk(buildRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return stacktrace.Propagate(err, "Cannot walk build context %q", buildRoot)
+		}
+		rel, err := filepath.Rel(buildRoot, path)
+		if err != nil {
+			return stacktrace.Propagate(err, "Cannot resolve %q in build context %q", path, buildRoot)
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		// docker always sends the dockerfile and .dockerignore
+		if rel != dockerfileRel && rel != ".dockerignore" && dockerIgnore.Matches(rel) {
+			if info.IsDir() && dockerIgnore.CanSkipDir(rel) && !strings.HasPrefix(dockerfileRel, rel+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return fn(path, rel, info)
+	})
+}
+
+// HashStrings computes a sha256 hash of a list of strings
+func HashStrings(values ...string) string {
+	h := sha256.New()
+	for _, value := range values {
+		fmt.Fprintf(h, "%d:%s\n", len(value), value)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// SortedKeyValues returns the key=value pairs of a map, sorted by key
+func SortedKeyValues(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+values[key])
+	}
+	return pairs
+}
+
+// HashFile computes the sha256 hash of a file content
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", stacktrace.Propagate(err, "Cannot open %q", path)
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", stacktrace.Propagate(err, "Cannot read %q", path)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
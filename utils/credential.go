@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// CredentialProvider gets registry credentials expiring over time, like the
+// tokens of cloud registries
+type CredentialProvider interface {
+	// Credential returns a username, a password and when they expire. A zero
+	// expiry means they never expire.
+	Credential() (username, password string, expiresAt time.Time, err error)
+}
+
+// credentialRefreshMargin is how long before expiring provided credentials
+// are refreshed, so that they do not expire during a request or a push
+const credentialRefreshMargin = 5 * time.Minute
+
+// cachedCredentialProvider reuses the credential of a provider until it is
+// about to expire
+type cachedCredentialProvider struct {
+	provider  CredentialProvider
+	now       func() time.Time
+	lock      sync.Mutex
+	username  string
+	password  string
+	expiresAt time.Time
+	cached    bool
+}
+
+// CacheCredentialProvider caches the credential of a provider, getting a new
+// one shortly before it expires
+func CacheCredentialProvider(provider CredentialProvider) CredentialProvider {
+	return &cachedCredentialProvider{provider: provider, now: time.Now}
+}
+
+func (p *cachedCredentialProvider) Credential() (string, string, time.Time, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.cached && (p.expiresAt.IsZero() || p.now().Before(p.expiresAt.Add(-credentialRefreshMargin))) {
+		return p.username, p.password, p.expiresAt, nil
+	}
+	username, password, expiresAt, err := p.provider.Credential()
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	p.username, p.password, p.expiresAt, p.cached = username, password, expiresAt, true
+	return username, password, expiresAt, nil
+}
+
+// BasicAuth returns the username and password of a credential, from its
+// provider if it has one. Provided passwords are masked in doriath output.
+func (c *DockerCredential) BasicAuth() (string, string, error) {
+	if c.Provider == nil {
+		return c.Username, c.Password, nil
+	}
+	username, password, _, err := c.Provider.Credential()
+	if err != nil {
+		return "", "", err
+	}
+	AddCredentialSecret(username, password)
+	return username, password, nil
+}
+
+// providerRequest sends a request of a credential provider, retrying network
+// errors and retryable statuses, and returns the body of a 200 response. Other
+// responses are turned into errors by failure.
+func providerRequest(retry *RetryPolicy, newRequest func() (*http.Request, error), failure func(statusCode int, body []byte) error) ([]byte, error) {
+	client, err := registryClient(&DockerCredential{}, DefaultRegistryTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if retry == nil {
+		retry = DefaultRetryPolicy()
+	}
+	var body []byte
+	err = retry.Do(func() error {
+		request, err := newRequest()
+		if err != nil {
+			return err
+		}
+		response, err := client.Do(request)
+		if err != nil {
+			wrapped := stacktrace.Propagate(err, "Cannot send %s %s", request.Method, request.URL)
+			if isRetryableNetworkError(err) {
+				return Retryable(wrapped, 0)
+			}
+			return wrapped
+		}
+		defer response.Body.Close()
+		body, err = ioutil.ReadAll(response.Body)
+		if err != nil {
+			return Retryable(stacktrace.Propagate(err, "Cannot read response of %s %s", request.Method, request.URL), 0)
+		}
+		if isRetryableStatus(response.StatusCode) {
+			return retryStatusError(request.Method, request.URL.String(), response.StatusCode, response.Header)
+		}
+		if response.StatusCode != http.StatusOK {
+			return failure(response.StatusCode, body)
+		}
+		return nil
+	})
+	return body, err
+}
+
+// oauth2Token is the response of an OAuth2 token endpoint
+type oauth2Token struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// expiresAt returns the expiry of a token received at now, zero when unknown
+func (t *oauth2Token) expiresAt(now time.Time) time.Time {
+	if t.ExpiresIn <= 0 {
+		return time.Time{}
+	}
+	return now.Add(time.Duration(t.ExpiresIn) * time.Second)
+}
+
+// decodeOAuth2Token decodes the response of an OAuth2 token endpoint, masking
+// its tokens
+func decodeOAuth2Token(tokenURL string, body []byte) (*oauth2Token, error) {
+	token := &oauth2Token{}
+	err := json.Unmarshal(body, token)
+	if err != nil {
+		// The body is not printed, it may hold tokens
+		return nil, stacktrace.Propagate(err, "Cannot decode token response of %s", tokenURL)
+	}
+	AddSecret(token.AccessToken, token.RefreshToken)
+	if token.AccessToken == "" {
+		return nil, stacktrace.NewError("Empty access token from %s", tokenURL)
+	}
+	return token, nil
+}
+
+// oauth2Error returns the error of a failed request to an OAuth2 endpoint,
+// from the error and error_description fields of the response
+func oauth2Error(tokenURL string) func(statusCode int, body []byte) error {
+	return func(statusCode int, body []byte) error {
+		var result struct {
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+		}
+		if json.Unmarshal(body, &result) == nil && result.Error != "" {
+			return stacktrace.NewError("Cannot get token from %s: %s: %s", tokenURL, result.Error, result.ErrorDescription)
+		}
+		return stacktrace.NewError("Cannot get token from %s, unexpected status code %d: %s", tokenURL, statusCode, string(body))
+	}
+}
+
+// newFormRequest creates a POST request sending a form
+func newFormRequest(endpoint string, form url.Values) (*http.Request, error) {
+	request, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot create request %s", endpoint)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return request, nil
+}
@@ -0,0 +1,280 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/palantir/stacktrace"
+)
+
+// DockerConfig holds the credentials of the docker config file, usually
+// ~/.docker/config.json, written by docker login
+type DockerConfig struct {
+	Auths       map[string]*dockerConfigAuth `json:"auths"`
+	CredsStore  string                       `json:"credsStore"`
+	CredHelpers map[string]string            `json:"credHelpers"`
+}
+
+type dockerConfigAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// dockerCredentialHelperToken is the username returned by credential helpers
+// when the secret is an identity token
+const dockerCredentialHelperToken = "<token>"
+
+// DockerConfigDir returns the docker config directory, $DOCKER_CONFIG or ~/.docker
+func DockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker")
+}
+
+// ReadDockerConfig reads config.json in a docker config directory. A missing
+// file gives an empty config.
+func ReadDockerConfig(dir string) (*DockerConfig, error) {
+	config := &DockerConfig{}
+	if dir == "" {
+		return config, nil
+	}
+	filename := filepath.Join(dir, "config.json")
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot read docker config %q", filename)
+	}
+	err = json.Unmarshal(content, config)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot decode docker config %q", filename)
+	}
+	return config, nil
+}
+
+// Credential returns the credential of a registry, like docker does: from the
+// credential helper of the registry, the credential store, or the auths
+// section. It returns nil when the registry has no credential. The secrets of
+// the credential are masked in doriath output.
+func (c *DockerConfig) Credential(registryName string) (*DockerCredential, error) {
+	credential, err := c.findCredential(registryName)
+	if credential != nil {
+		AddCredentialSecret(credential.Username, credential.Password)
+		AddSecret(credential.IdentityToken)
+	}
+	return credential, err
+}
+
+func (c *DockerConfig) findCredential(registryName string) (*DockerCredential, error) {
+	host := ""
+	if registryName != DefaultRegistryName {
+		host = registryHost(registryName)
+	}
+	serverAddress, auth := c.findAuth(host)
+	if serverAddress == "" {
+		serverAddress = host
+		if host == "" {
+			serverAddress = DefaultRegistryServer
+		}
+	}
+	credential := &DockerCredential{}
+	if host != "" {
+		credential.Registry = "https://" + host
+		if isLoopbackHost(host) {
+			// Like docker, registries on the loopback interface are reached without TLS
+			credential.Registry = "http://" + host
+		}
+	}
+	helper := c.CredHelpers[host]
+	if host == "" {
+		for key, value := range c.CredHelpers {
+			if registryHost(key) == "" {
+				helper = value
+			}
+		}
+	}
+	if helper == "" {
+		helper = c.CredsStore
+	}
+	if helper != "" {
+		found, err := dockerCredentialHelperGet(helper, serverAddress, credential)
+		if err != nil || found {
+			return credential, err
+		}
+	}
+	if auth == nil {
+		return nil, nil
+	}
+	credential.Username, credential.Password = auth.Username, auth.Password
+	if auth.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "Invalid auth for %q in docker config", serverAddress)
+		}
+		segments := strings.SplitN(string(decoded), ":", 2)
+		if len(segments) != 2 {
+			return nil, stacktrace.NewError("Invalid auth for %q in docker config", serverAddress)
+		}
+		credential.Username, credential.Password = segments[0], segments[1]
+	}
+	credential.IdentityToken = auth.IdentityToken
+	if credential.Username == "" && credential.Password == "" && credential.IdentityToken == "" {
+		return nil, nil
+	}
+	return credential, nil
+}
+
+func isLoopbackHost(host string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if hostname == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(hostname)
+	return ip != nil && ip.IsLoopback()
+}
+
+// findAuth returns the key and the entry of auths matching a registry host
+func (c *DockerConfig) findAuth(host string) (string, *dockerConfigAuth) {
+	for key, auth := range c.Auths {
+		if registryHost(key) == host {
+			return key, auth
+		}
+	}
+	return "", nil
+}
+
+// dockerCredentialHelperGet runs docker-credential-<helper> get, filling
+// credential. It returns false when the helper has no credential for the
+// server.
+func dockerCredentialHelperGet(helper, serverAddress string, credential *DockerCredential) (bool, error) {
+	binary := "docker-credential-" + helper
+	cmd := exec.Command(binary, "get")
+	cmd.Stdin = strings.NewReader(serverAddress)
+	errOutput := &bytes.Buffer{}
+	cmd.Stderr = errOutput
+	output, err := cmd.Output()
+	if err != nil {
+		// Helpers print the message on stdout or stderr depending on the version
+		message := string(output) + errOutput.String()
+		if strings.Contains(message, "credentials not found") {
+			return false, nil
+		}
+		return false, stacktrace.Propagate(err, "Cannot get credential of %q from %s: %s", serverAddress, binary, strings.TrimSpace(message))
+	}
+	var result struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	err = json.Unmarshal(output, &result)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "Cannot decode output of %s", binary)
+	}
+	if result.Username == dockerCredentialHelperToken {
+		credential.IdentityToken = result.Secret
+	} else {
+		credential.Username, credential.Password = result.Username, result.Secret
+	}
+	return true, nil
+}
+
+// dockerConfigShared are the entries of a docker config directory shared with
+// temporary docker configs: CLI plugins like buildx, and buildx builders
+var dockerConfigShared = []string{"cli-plugins", "buildx"}
+
+// TempDockerConfig is a temporary docker config directory isolating the logins
+// of a doriath run from other runs
+type TempDockerConfig struct {
+	Dir    string
+	oldEnv map[string]string
+	once   sync.Once
+}
+
+// tempDockerConfigEnv are the variables pointing docker, podman and buildah
+// to the temporary docker config
+var tempDockerConfigEnv = []string{"DOCKER_CONFIG", "REGISTRY_AUTH_FILE"}
+
+// NewTempDockerConfig creates a temporary docker config holding credentials by
+// registry name, sharing the CLI plugins and buildx builders of configDir. Child
+// processes use it until it is removed, which happens at the latest on exit.
+func NewTempDockerConfig(configDir string, credentials map[string]*DockerCredential) (*TempDockerConfig, error) {
+	dir, err := ioutil.TempDir("", "doriath-docker-config")
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot create temporary docker config")
+	}
+	c := &TempDockerConfig{Dir: dir, oldEnv: make(map[string]string)}
+	for _, key := range tempDockerConfigEnv {
+		if value, ok := os.LookupEnv(key); ok {
+			c.oldEnv[key] = value
+		}
+	}
+	AtExit(c.Remove)
+	auths := make(map[string]*dockerConfigAuth)
+	for registryName, credential := range credentials {
+		server := registryName
+		if registryName == DefaultRegistryName {
+			server = DefaultRegistryServer
+		}
+		auth := &dockerConfigAuth{IdentityToken: credential.IdentityToken}
+		if credential.Username != "" || credential.Password != "" {
+			auth.Auth = base64.StdEncoding.EncodeToString([]byte(credential.Username + ":" + credential.Password))
+		}
+		auths[server] = auth
+	}
+	content, err := json.MarshalIndent(map[string]interface{}{"auths": auths}, "", "  ")
+	if err != nil {
+		c.Remove()
+		return nil, stacktrace.Propagate(err, "Cannot encode temporary docker config")
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "config.json"), content, 0600)
+	if err != nil {
+		c.Remove()
+		return nil, stacktrace.Propagate(err, "Cannot write temporary docker config")
+	}
+	for _, name := range dockerConfigShared {
+		target := filepath.Join(configDir, name)
+		if _, err := os.Stat(target); err != nil {
+			continue
+		}
+		err = os.Symlink(target, filepath.Join(dir, name))
+		if err != nil {
+			c.Remove()
+			return nil, stacktrace.Propagate(err, "Cannot link %q in temporary docker config", target)
+		}
+	}
+	os.Setenv("DOCKER_CONFIG", dir)
+	os.Setenv("REGISTRY_AUTH_FILE", filepath.Join(dir, "config.json"))
+	return c, nil
+}
+
+// Remove removes the temporary docker config and restores the environment
+func (c *TempDockerConfig) Remove() {
+	c.once.Do(func() {
+		for _, key := range tempDockerConfigEnv {
+			if value, ok := c.oldEnv[key]; ok {
+				os.Setenv(key, value)
+			} else {
+				os.Unsetenv(key)
+			}
+		}
+		os.RemoveAll(c.Dir)
+	})
+}
@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// fakeCredentialHelper answers get requests for a few servers and records the
+// requested server in $FAKE_HELPER_LOG
+const fakeCredentialHelper = `#!/bin/sh
+read server
+echo "$server" >> "$FAKE_HELPER_LOG"
+case "$server" in
+  gcr.io) echo '{"ServerURL":"gcr.io","Username":"_json_key","Secret":"gandalf"}' ;;
+  https://ghcr.io) echo '{"ServerURL":"https://ghcr.io","Username":"<token>","Secret":"refresh"}' ;;
+  https://index.docker.io/v1/) echo '{"ServerURL":"https://index.docker.io/v1/","Username":"frodo","Secret":"ring"}' ;;
+  broken.io) echo "helper exploded" >&2; exit 2 ;;
+  *) echo "credentials not found in native keychain"; exit 1 ;;
+esac
+`
+
+type DockerConfigTestSuite struct {
+	suite.Suite
+	dir     string
+	logFile string
+	oldPath string
+}
+
+func (s *DockerConfigTestSuite) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "doriath-docker-config")
+	require.Nil(s.T(), err)
+	s.logFile = filepath.Join(s.dir, "helper.log")
+	err = ioutil.WriteFile(filepath.Join(s.dir, "docker-credential-fake"), []byte(fakeCredentialHelper), 0755)
+	require.Nil(s.T(), err)
+	os.Setenv("FAKE_HELPER_LOG", s.logFile)
+	s.oldPath = os.Getenv("PATH")
+	os.Setenv("PATH", s.dir+string(os.PathListSeparator)+s.oldPath)
+}
+
+func (s *DockerConfigTestSuite) TearDownTest() {
+	os.Setenv("PATH", s.oldPath)
+	os.RemoveAll(s.dir)
+}
+
+func (s *DockerConfigTestSuite) readConfig(content string) *DockerConfig {
+	err := ioutil.WriteFile(filepath.Join(s.dir, "config.json"), []byte(content), 0600)
+	require.Nil(s.T(), err)
+	config, err := ReadDockerConfig(s.dir)
+	require.Nil(s.T(), err)
+	return config
+}
+
+func (s *DockerConfigTestSuite) TestAuths() {
+	config := s.readConfig(`{
+  "auths": {
+    "https://index.docker.io/v1/": {"auth": "ZnJvZG86cmluZw=="},
+    "quay.io": {"auth": "c2FtOnBvdGF0bzpzdGV3"},
+    "localhost:5000": {"username": "merry", "password": "pippin"},
+    "harbor.io": {"identitytoken": "refresh"},
+    "empty.io": {}
+  }
+}`)
+	credential, err := config.Credential(DefaultRegistryName)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), &DockerCredential{Username: "frodo", Password: "ring"}, credential)
+	credential, err = config.Credential("quay.io")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), &DockerCredential{Registry: "https://quay.io", Username: "sam", Password: "potato:stew"}, credential)
+	credential, err = config.Credential("localhost:5000")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), &DockerCredential{Registry: "http://localhost:5000", Username: "merry", Password: "pippin"}, credential)
+	credential, err = config.Credential("harbor.io")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), &DockerCredential{Registry: "https://harbor.io", IdentityToken: "refresh"}, credential)
+	credential, err = config.Credential("empty.io")
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), credential)
+	credential, err = config.Credential("gcr.io")
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), credential)
+}
+
+func (s *DockerConfigTestSuite) TestCredentialHelpers() {
+	config := s.readConfig(`{
+  "auths": {
+    "https://ghcr.io": {},
+    "quay.io": {"auth": "c2FtOnBvdGF0bw=="}
+  },
+  "credsStore": "fake",
+  "credHelpers": {"gcr.io": "fake", "ecr.io": "missing"}
+}`)
+	credential, err := config.Credential("gcr.io")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), &DockerCredential{Registry: "https://gcr.io", Username: "_json_key", Password: "gandalf"}, credential)
+	credential, err = config.Credential("ghcr.io")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), &DockerCredential{Registry: "https://ghcr.io", IdentityToken: "refresh"}, credential)
+	credential, err = config.Credential(DefaultRegistryName)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), &DockerCredential{Username: "frodo", Password: "ring"}, credential)
+	credential, err = config.Credential("quay.io")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), &DockerCredential{Registry: "https://quay.io", Username: "sam", Password: "potato"}, credential, "auths must be used when the store has no credential")
+	credential, err = config.Credential("other.io")
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), credential)
+	_, err = config.Credential("broken.io")
+	require.NotNil(s.T(), err)
+	_, err = config.Credential("ecr.io")
+	require.NotNil(s.T(), err, "missing helper must be an error")
+	log, err := ioutil.ReadFile(s.logFile)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "gcr.io\nhttps://ghcr.io\nhttps://index.docker.io/v1/\nquay.io\nother.io\nbroken.io\n", string(log))
+}
+
+func (s *DockerConfigTestSuite) TestMissingConfig() {
+	config, err := ReadDockerConfig(s.dir)
+	require.Nil(s.T(), err)
+	credential, err := config.Credential(DefaultRegistryName)
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), credential)
+}
+
+func (s *DockerConfigTestSuite) TestTempDockerConfig() {
+	err := os.Mkdir(filepath.Join(s.dir, "cli-plugins"), 0755)
+	require.Nil(s.T(), err)
+	oldDockerConfig, hadDockerConfig := os.LookupEnv("DOCKER_CONFIG")
+	os.Setenv("REGISTRY_AUTH_FILE", "/run/containers/auth.json")
+	defer os.Unsetenv("REGISTRY_AUTH_FILE")
+
+	tempConfig, err := NewTempDockerConfig(s.dir, map[string]*DockerCredential{
+		DefaultRegistryName: {Username: "frodo", Password: "ring"},
+		"ghcr.io":           {Registry: "https://ghcr.io", IdentityToken: "refresh"},
+	})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), tempConfig.Dir, os.Getenv("DOCKER_CONFIG"))
+	require.Equal(s.T(), filepath.Join(tempConfig.Dir, "config.json"), os.Getenv("REGISTRY_AUTH_FILE"))
+	config, err := ReadDockerConfig(tempConfig.Dir)
+	require.Nil(s.T(), err)
+	credential, err := config.Credential(DefaultRegistryName)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), &DockerCredential{Username: "frodo", Password: "ring"}, credential)
+	credential, err = config.Credential("ghcr.io")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), &DockerCredential{Registry: "https://ghcr.io", IdentityToken: "refresh"}, credential)
+	target, err := os.Readlink(filepath.Join(tempConfig.Dir, "cli-plugins"))
+	require.Nil(s.T(), err, "CLI plugins must be shared")
+	require.Equal(s.T(), filepath.Join(s.dir, "cli-plugins"), target)
+	_, err = os.Lstat(filepath.Join(tempConfig.Dir, "buildx"))
+	require.True(s.T(), os.IsNotExist(err), "missing entries must not be linked")
+
+	tempConfig.Remove()
+	tempConfig.Remove()
+	_, err = os.Stat(tempConfig.Dir)
+	require.True(s.T(), os.IsNotExist(err), "temporary docker config must be removed")
+	dockerConfig, hasDockerConfig := os.LookupEnv("DOCKER_CONFIG")
+	require.Equal(s.T(), hadDockerConfig, hasDockerConfig)
+	require.Equal(s.T(), oldDockerConfig, dockerConfig)
+	require.Equal(s.T(), "/run/containers/auth.json", os.Getenv("REGISTRY_AUTH_FILE"))
+}
+
+func (s *DockerConfigTestSuite) TestExitHandlers() {
+	calls := []string{}
+	AtExit(func() { calls = append(calls, "first") })
+	AtExit(func() { calls = append(calls, "second") })
+	runExitHandlers()
+	runExitHandlers()
+	require.Equal(s.T(), []string{"second", "first"}, calls, "handlers must run once, most recent first")
+}
+
+func TestDockerConfig(t *testing.T) {
+	suite.Run(t, new(DockerConfigTestSuite))
+}
@@ -0,0 +1,539 @@
+package utils
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/palantir/stacktrace"
+)
+
+var (
+	dockerfileDirectiveRegex = regexp.MustCompile(`^#\s*([a-zA-Z][a-zA-Z0-9]*)\s*=\s*(.+?)\s*$`)
+	dockerfileHeredocRegex   = regexp.MustCompile(`<<-?["']?([a-zA-Z_][a-zA-Z0-9_]*)["']?`)
+)
+
+var dockerfilePlatformArgs = StringSet{
+	"BUILDPLATFORM":  {},
+	"BUILDOS":        {},
+	"BUILDARCH":      {},
+	"BUILDVARIANT":   {},
+	"TARGETPLATFORM": {},
+	"TARGETOS":       {},
+	"TARGETARCH":     {},
+	"TARGETVARIANT":  {},
+}
+
+// Dockerfile is the structured content of a dockerfile
+type Dockerfile struct {
+	// Args holds the values of the global ARG instructions, declared before the
+	// first FROM, after applying build args
+	Args   map[string]string
+	Stages []*DockerfileStage
+}
+
+// DockerfileStage is a build stage, started by a FROM instruction
+type DockerfileStage struct {
+	Index int
+	// Name is the stage name given by "FROM ... AS name", in lower case
+	Name     string
+	Platform string
+	// From is the base of the stage after ARG substitution: an image reference,
+	// the name of a previous stage or scratch
+	From string
+	// CopyFrom holds the sources of the COPY --from flags of the stage: image
+	// references, stage names or stage indexes
+	CopyFrom []string
+}
+
+type dockerfileInstruction struct {
+	line    int
+	command string
+	args    string
+}
+
+// ReadDockerfile reads and parses a dockerfile. buildArgs override the default
+// values of ARG instructions.
+func ReadDockerfile(filename string, buildArgs map[string]string) (*Dockerfile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot open dockerfile %q", filename)
+	}
+	defer f.Close()
+	dockerfile, err := ParseDockerfile(f, buildArgs)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot parse dockerfile %q", filename)
+	}
+	return dockerfile, nil
+}
+
+// ParseDockerfile parses the content of a dockerfile. buildArgs override the
+// default values of ARG instructions.
+func ParseDockerfile(r io.Reader, buildArgs map[string]string) (*Dockerfile, error) {
+	instructions, escape, err := splitDockerfileInstructions(r)
+	if err != nil {
+		return nil, err
+	}
+	dockerfile := &Dockerfile{
+		Args:   make(map[string]string),
+		Stages: []*DockerfileStage{},
+	}
+	var stage *DockerfileStage
+	var stageArgs map[string]string
+	for _, instruction := range instructions {
+		switch instruction.command {
+		case "ARG":
+			scope := dockerfile.Args
+			if stage != nil {
+				scope = stageArgs
+			}
+			words, err := processDockerfileWords(instruction.args, escape, mapLookup(scope))
+			if err != nil {
+				return nil, stacktrace.Propagate(err, "Invalid ARG instruction at line %d", instruction.line)
+			}
+			for _, word := range words {
+				segments := strings.SplitN(word, "=", 2)
+				name := segments[0]
+				value, hasValue := "", len(segments) == 2
+				if hasValue {
+					value = segments[1]
+				}
+				if buildArg, ok := buildArgs[name]; ok {
+					value, hasValue = buildArg, true
+				}
+				if stage != nil && !hasValue {
+					// A global ARG declared again inside a stage keeps its value
+					value = dockerfile.Args[name]
+				}
+				scope[name] = value
+			}
+		case "FROM":
+			stage, err = parseDockerfileFrom(instruction, len(dockerfile.Stages), escape, dockerfile.Args)
+			if err != nil {
+				return nil, err
+			}
+			stageArgs = make(map[string]string)
+			dockerfile.Stages = append(dockerfile.Stages, stage)
+		default:
+			if stage == nil {
+				return nil, stacktrace.NewError("Instruction %s at line %d must come after FROM", instruction.command, instruction.line)
+			}
+			if instruction.command == "COPY" {
+				copyFrom, err := parseDockerfileCopyFrom(instruction, escape, stageArgs)
+				if err != nil {
+					return nil, err
+				}
+				if copyFrom != "" {
+					stage.CopyFrom = append(stage.CopyFrom, copyFrom)
+				}
+			}
+		}
+	}
+	if len(dockerfile.Stages) == 0 {
+		return nil, stacktrace.NewError("No FROM instruction found")
+	}
+	return dockerfile, nil
+}
+
+// Stage finds a stage by its name or index, only looking at stages before the
+// given position
+func (d *Dockerfile) Stage(nameOrIndex string, before int) *DockerfileStage {
+	if index, err := strconv.Atoi(nameOrIndex); err == nil {
+		if index >= 0 && index < before && index < len(d.Stages) {
+			return d.Stages[index]
+		}
+		return nil
+	}
+	name := strings.ToLower(nameOrIndex)
+	for i := 0; i < before && i < len(d.Stages); i++ {
+		if d.Stages[i].Name != "" && d.Stages[i].Name == name {
+			return d.Stages[i]
+		}
+	}
+	return nil
+}
+
+// Images returns the images used to build target, as base of a stage or as
+// source of a COPY --from flag. Stage references and scratch are skipped. An
+// empty target means every stage of the dockerfile.
+func (d *Dockerfile) Images(target string) ([]*DockerImageInfo, error) {
+	stages := d.Stages
+	if target != "" {
+		var err error
+		stages, err = d.stagesFor(target)
+		if err != nil {
+			return nil, err
+		}
+	}
+	images := []*DockerImageInfo{}
+	found := make(StringSet)
+	addImage := func(stage *DockerfileStage, reference string, isCopy bool) error {
+		if reference == "scratch" || found.Exists(reference) {
+			return nil
+		}
+		_, err := strconv.Atoi(reference)
+		isIndex := err == nil
+		// Only COPY --from accepts the index of a previous stage
+		if isIndex && isCopy {
+			return nil
+		}
+		if !isIndex && d.Stage(reference, stage.Index) != nil {
+			return nil
+		}
+		imageInfo, err := ExtractDockerImageInfo(reference)
+		if err != nil {
+			return err
+		}
+		found.Add(reference)
+		images = append(images, imageInfo)
+		return nil
+	}
+	for _, stage := range stages {
+		err := addImage(stage, stage.From, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, copyFrom := range stage.CopyFrom {
+			err = addImage(stage, copyFrom, true)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return images, nil
+}
+
+// stagesFor returns the stages needed to build target, in dockerfile order
+func (d *Dockerfile) stagesFor(target string) ([]*DockerfileStage, error) {
+	targetStage := d.Stage(target, len(d.Stages))
+	if targetStage == nil {
+		return nil, stacktrace.NewError("Cannot find target stage %q", target)
+	}
+	needed := make(map[int]bool)
+	var visit func(stage *DockerfileStage)
+	visit = func(stage *DockerfileStage) {
+		if needed[stage.Index] {
+			return
+		}
+		needed[stage.Index] = true
+		if _, err := strconv.Atoi(stage.From); err != nil {
+			if base := d.Stage(stage.From, stage.Index); base != nil {
+				visit(base)
+			}
+		}
+		for _, copyFrom := range stage.CopyFrom {
+			if source := d.Stage(copyFrom, stage.Index); source != nil {
+				visit(source)
+			}
+		}
+	}
+	visit(targetStage)
+	stages := []*DockerfileStage{}
+	for _, stage := range d.Stages {
+		if needed[stage.Index] {
+			stages = append(stages, stage)
+		}
+	}
+	return stages, nil
+}
+
+func parseDockerfileFrom(instruction *dockerfileInstruction, index int, escape rune, globalArgs map[string]string) (*DockerfileStage, error) {
+	lookup := func(name string) (string, bool) {
+		if value, ok := globalArgs[name]; ok {
+			return value, true
+		}
+		// Platform args are set by the builder, keep them as is
+		if dockerfilePlatformArgs.Exists(name) {
+			return "${" + name + "}", true
+		}
+		return "", false
+	}
+	words, err := processDockerfileWords(instruction.args, escape, lookup)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Invalid FROM instruction at line %d", instruction.line)
+	}
+	stage := &DockerfileStage{
+		Index: index,
+	}
+	args := []string{}
+	for _, word := range words {
+		if strings.HasPrefix(word, "--") && len(args) == 0 {
+			if strings.HasPrefix(word, "--platform=") {
+				stage.Platform = strings.TrimPrefix(word, "--platform=")
+			}
+			continue
+		}
+		args = append(args, word)
+	}
+	switch {
+	case len(args) == 1:
+	case len(args) == 3 && strings.EqualFold(args[1], "AS"):
+		stage.Name = strings.ToLower(args[2])
+	default:
+		return nil, stacktrace.NewError("Invalid FROM instruction at line %d: %q", instruction.line, instruction.args)
+	}
+	if args[0] == "" {
+		return nil, stacktrace.NewError("Empty image in FROM instruction at line %d: %q", instruction.line, instruction.args)
+	}
+	stage.From = args[0]
+	return stage, nil
+}
+
+func parseDockerfileCopyFrom(instruction *dockerfileInstruction, escape rune, stageArgs map[string]string) (string, error) {
+	words, err := processDockerfileWords(instruction.args, escape, mapLookup(stageArgs))
+	if err != nil {
+		return "", stacktrace.Propagate(err, "Invalid COPY instruction at line %d", instruction.line)
+	}
+	for _, word := range words {
+		if !strings.HasPrefix(word, "--") {
+			break
+		}
+		if strings.HasPrefix(word, "--from=") {
+			return strings.TrimPrefix(word, "--from="), nil
+		}
+	}
+	return "", nil
+}
+
+// splitDockerfileInstructions reads the parser directives and the logical lines
+// of a dockerfile, joining line continuations and skipping comments and heredocs
+func splitDockerfileInstructions(r io.Reader) ([]*dockerfileInstruction, rune, error) {
+	escape := '\\'
+	instructions := []*dockerfileInstruction{}
+	lookForDirectives := true
+	heredocs := []string{}
+	var current *dockerfileInstruction
+	var currentLine strings.Builder
+	lineNumber := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if len(heredocs) > 0 {
+			if strings.TrimLeft(line, "\t") == heredocs[0] {
+				heredocs = heredocs[1:]
+			}
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if lookForDirectives {
+			if matches := dockerfileDirectiveRegex.FindStringSubmatch(trimmed); matches != nil {
+				if strings.ToLower(matches[1]) == "escape" {
+					if matches[2] != "\\" && matches[2] != "`" {
+						return nil, escape, stacktrace.NewError("Invalid escape directive %q, must be \\ or `", matches[2])
+					}
+					escape = rune(matches[2][0])
+				}
+				continue
+			}
+			lookForDirectives = false
+		}
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if current == nil {
+			current = &dockerfileInstruction{
+				line: lineNumber,
+			}
+			currentLine.Reset()
+		}
+		trimmedRight := strings.TrimRightFunc(line, unicode.IsSpace)
+		if strings.HasSuffix(trimmedRight, string(escape)) {
+			currentLine.WriteString(strings.TrimSuffix(trimmedRight, string(escape)))
+			continue
+		}
+		currentLine.WriteString(line)
+		content := strings.TrimSpace(currentLine.String())
+		if idx := strings.IndexFunc(content, unicode.IsSpace); idx >= 0 {
+			current.command = strings.ToUpper(content[:idx])
+			current.args = strings.TrimSpace(content[idx:])
+		} else {
+			current.command = strings.ToUpper(content)
+		}
+		switch current.command {
+		case "RUN", "COPY", "ADD":
+			for _, matches := range dockerfileHeredocRegex.FindAllStringSubmatch(current.args, -1) {
+				heredocs = append(heredocs, matches[1])
+			}
+		}
+		instructions = append(instructions, current)
+		current = nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, escape, stacktrace.Propagate(err, "Cannot read dockerfile")
+	}
+	if current != nil {
+		return nil, escape, stacktrace.NewError("Unterminated line continuation at line %d", current.line)
+	}
+	return instructions, escape, nil
+}
+
+func mapLookup(values map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := values[name]
+		return value, ok
+	}
+}
+
+// processDockerfileWords splits the arguments of an instruction into words the
+// way docker does: quotes are removed, escapes are applied and variables are
+// substituted, except inside single quotes
+func processDockerfileWords(s string, escape rune, lookup func(string) (string, bool)) ([]string, error) {
+	runes := []rune(s)
+	words := []string{}
+	word := &strings.Builder{}
+	inWord := false
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == escape:
+			inWord = true
+			if i+1 < len(runes) {
+				i++
+				word.WriteRune(runes[i])
+			}
+		case c == '\'':
+			inWord = true
+			end := indexRune(runes, '\'', i+1)
+			if end < 0 {
+				return nil, stacktrace.NewError("Unterminated single quote in %q", s)
+			}
+			word.WriteString(string(runes[i+1 : end]))
+			i = end
+		case c == '"':
+			inWord = true
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				switch {
+				case runes[i] == escape && i+1 < len(runes) && (runes[i+1] == '"' || runes[i+1] == '$' || runes[i+1] == escape):
+					i++
+					word.WriteRune(runes[i])
+				case runes[i] == '$':
+					value, next, err := expandDockerfileVariable(runes, i, escape, lookup)
+					if err != nil {
+						return nil, err
+					}
+					word.WriteString(value)
+					i = next - 1
+				default:
+					word.WriteRune(runes[i])
+				}
+			}
+			if i >= len(runes) {
+				return nil, stacktrace.NewError("Unterminated double quote in %q", s)
+			}
+		case c == '$':
+			inWord = true
+			value, next, err := expandDockerfileVariable(runes, i, escape, lookup)
+			if err != nil {
+				return nil, err
+			}
+			word.WriteString(value)
+			i = next - 1
+		default:
+			inWord = true
+			word.WriteRune(c)
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// expandDockerfileVariable expands the variable starting with the $ at position
+// start, returning its value and the position right after the variable.
+// $NAME, ${NAME}, ${NAME:-default} and ${NAME:+alternative} are supported.
+func expandDockerfileVariable(runes []rune, start int, escape rune, lookup func(string) (string, bool)) (string, int, error) {
+	i := start + 1
+	if i >= len(runes) {
+		return "$", i, nil
+	}
+	if runes[i] != '{' {
+		end := i
+		for end < len(runes) && isVariableNameRune(runes[end]) {
+			end++
+		}
+		if end == i {
+			return "$", i, nil
+		}
+		value, _ := lookup(string(runes[i:end]))
+		return value, end, nil
+	}
+	i++
+	nameEnd := i
+	for nameEnd < len(runes) && isVariableNameRune(runes[nameEnd]) {
+		nameEnd++
+	}
+	name := string(runes[i:nameEnd])
+	if name == "" || nameEnd >= len(runes) {
+		return "", 0, stacktrace.NewError("Invalid variable in %q", string(runes))
+	}
+	value, ok := lookup(name)
+	if runes[nameEnd] == '}' {
+		return value, nameEnd + 1, nil
+	}
+	if runes[nameEnd] != ':' || nameEnd+1 >= len(runes) || (runes[nameEnd+1] != '-' && runes[nameEnd+1] != '+') {
+		return "", 0, stacktrace.NewError("Unsupported variable modifier in %q", string(runes))
+	}
+	modifier := runes[nameEnd+1]
+	wordStart := nameEnd + 2
+	depth := 1
+	end := wordStart
+	for ; end < len(runes); end++ {
+		if runes[end] == escape {
+			end++
+			continue
+		}
+		if runes[end] == '{' {
+			depth++
+		} else if runes[end] == '}' {
+			depth--
+			if depth == 0 {
+				break
+			}
+		}
+	}
+	if end >= len(runes) {
+		return "", 0, stacktrace.NewError("Unterminated variable in %q", string(runes))
+	}
+	words, err := processDockerfileWords(string(runes[wordStart:end]), escape, lookup)
+	if err != nil {
+		return "", 0, err
+	}
+	word := strings.Join(words, " ")
+	isSet := ok && value != ""
+	switch {
+	case modifier == '-' && !isSet:
+		value = word
+	case modifier == '+' && isSet:
+		value = word
+	case modifier == '+':
+		value = ""
+	}
+	return value, end + 1, nil
+}
+
+func isVariableNameRune(c rune) bool {
+	return c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+func indexRune(runes []rune, r rune, from int) int {
+	for i := from; i < len(runes); i++ {
+		if runes[i] == r {
+			return i
+		}
+	}
+	return -1
+}
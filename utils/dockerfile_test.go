@@ -0,0 +1,182 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type DockerfileTestSuite struct {
+	suite.Suite
+}
+
+func (s *DockerfileTestSuite) parse(content string, buildArgs map[string]string) *Dockerfile {
+	dockerfile, err := ParseDockerfile(strings.NewReader(content), buildArgs)
+	require.Nil(s.T(), err, "dockerfile must be parsable")
+	return dockerfile
+}
+
+func (s *DockerfileTestSuite) imageNames(dockerfile *Dockerfile) []string {
+	return s.targetImageNames(dockerfile, "")
+}
+
+func (s *DockerfileTestSuite) targetImageNames(dockerfile *Dockerfile, target string) []string {
+	images, err := dockerfile.Images(target)
+	require.Nil(s.T(), err)
+	names := []string{}
+	for _, image := range images {
+		names = append(names, image.FullName+":"+image.Tag)
+	}
+	return names
+}
+
+func (s *DockerfileTestSuite) TestFlagsAndAlias() {
+	dockerfile := s.parse(`
+FROM --platform=$BUILDPLATFORM golang:1.21 AS Builder
+RUN go build -o /app .
+
+FROM alpine:3.18
+COPY --from=builder /app /app
+`, nil)
+	require.Equal(s.T(), 2, len(dockerfile.Stages))
+	require.Equal(s.T(), "builder", dockerfile.Stages[0].Name)
+	require.Equal(s.T(), "${BUILDPLATFORM}", dockerfile.Stages[0].Platform)
+	require.Equal(s.T(), "golang:1.21", dockerfile.Stages[0].From)
+	require.Equal(s.T(), []string{"builder"}, dockerfile.Stages[1].CopyFrom)
+	require.Equal(s.T(), []string{"golang:1.21", "alpine:3.18"}, s.imageNames(dockerfile))
+}
+
+func (s *DockerfileTestSuite) TestArgSubstitution() {
+	content := `
+ARG BASE=ubuntu
+ARG TAG="16.04"
+ARG SUFFIX
+FROM ${BASE}:${TAG}${SUFFIX:+-$SUFFIX}
+ARG TAG
+ARG HELPER=busybox:${TAG}
+COPY --from=$HELPER /bin/sh /bin/sh
+`
+	dockerfile := s.parse(content, nil)
+	require.Equal(s.T(), []string{"ubuntu:16.04", "busybox:16.04"}, s.imageNames(dockerfile))
+
+	dockerfile = s.parse(content, map[string]string{"TAG": "18.04", "SUFFIX": "slim"})
+	require.Equal(s.T(), []string{"ubuntu:18.04-slim", "busybox:18.04"}, s.imageNames(dockerfile))
+}
+
+func (s *DockerfileTestSuite) TestLineContinuationAndComments() {
+	dockerfile := s.parse(`# syntax=docker/dockerfile:1
+FROM \
+  # the base image
+  ubuntu:16.04 \
+  AS base
+RUN apt-get update && \
+    apt-get install -y curl
+`, nil)
+	require.Equal(s.T(), 1, len(dockerfile.Stages))
+	require.Equal(s.T(), "base", dockerfile.Stages[0].Name)
+	require.Equal(s.T(), "ubuntu:16.04", dockerfile.Stages[0].From)
+}
+
+func (s *DockerfileTestSuite) TestEscapeDirective() {
+	dockerfile := s.parse("# escape=`\nFROM mcr.microsoft.com/windows/servercore:ltsc2022 `\n  AS base\nCOPY C:\\app C:\\app\n", nil)
+	require.Equal(s.T(), "base", dockerfile.Stages[0].Name)
+	require.Equal(s.T(), []string{"mcr.microsoft.com/windows/servercore:ltsc2022"}, s.imageNames(dockerfile))
+}
+
+func (s *DockerfileTestSuite) TestHeredoc() {
+	dockerfile := s.parse(`FROM ubuntu:16.04
+RUN <<EOT
+FROM this-is-not-an-instruction
+EOT
+COPY --from=alpine:3.18 /etc/alpine-release /
+`, nil)
+	require.Equal(s.T(), []string{"ubuntu:16.04", "alpine:3.18"}, s.imageNames(dockerfile))
+}
+
+func (s *DockerfileTestSuite) TestStageReferences() {
+	dockerfile := s.parse(`FROM scratch AS empty
+FROM ubuntu:16.04 AS base
+FROM base
+COPY --from=0 / /
+COPY --from=empty / /
+`, nil)
+	require.Equal(s.T(), []string{"ubuntu:16.04"}, s.imageNames(dockerfile))
+}
+
+func (s *DockerfileTestSuite) TestTarget() {
+	dockerfile := s.parse(`FROM golang:1.21 AS builder
+FROM alpine:3.18 AS assets
+FROM ubuntu:16.04 AS prod
+COPY --from=builder /app /app
+FROM prod AS debug
+COPY --from=assets / /
+`, nil)
+	require.Equal(s.T(), []string{"golang:1.21", "ubuntu:16.04"}, s.targetImageNames(dockerfile, "prod"))
+	require.Equal(s.T(), []string{"golang:1.21", "alpine:3.18", "ubuntu:16.04"}, s.targetImageNames(dockerfile, "debug"))
+	_, err := dockerfile.Images("missing")
+	require.NotNil(s.T(), err, "unknown target must fail")
+}
+
+func (s *DockerfileTestSuite) TestInvalidDockerfile() {
+	_, err := ParseDockerfile(strings.NewReader("RUN echo 1\n"), nil)
+	require.NotNil(s.T(), err, "instructions before FROM must fail")
+	_, err = ParseDockerfile(strings.NewReader("ARG A=1\n"), nil)
+	require.NotNil(s.T(), err, "dockerfile without FROM must fail")
+	_, err = ParseDockerfile(strings.NewReader("FROM ubuntu AS\n"), nil)
+	require.NotNil(s.T(), err, "FROM without stage name must fail")
+}
+
+func (s *DockerfileTestSuite) TestExtractDockerImageInfo() {
+	cases := map[string]*DockerImageInfo{
+		"ubuntu": {
+			FullName:     "ubuntu",
+			ShortName:    "ubuntu",
+			RegistryName: DefaultRegistryName,
+			Tag:          "latest",
+		},
+		"anduin/doriath:1.0": {
+			FullName:     "anduin/doriath",
+			ShortName:    "anduin/doriath",
+			RegistryName: DefaultRegistryName,
+			Tag:          "1.0",
+		},
+		"gcr.io/anduintransact/doriath:1.1": {
+			FullName:     "gcr.io/anduintransact/doriath",
+			ShortName:    "anduintransact/doriath",
+			RegistryName: "gcr.io",
+			Tag:          "1.1",
+		},
+		"localhost:5000/doriath:2": {
+			FullName:     "localhost:5000/doriath",
+			ShortName:    "doriath",
+			RegistryName: "localhost:5000",
+			Tag:          "2",
+		},
+		"golang:1.21@sha256:abcdef": {
+			FullName:     "golang",
+			ShortName:    "golang",
+			RegistryName: DefaultRegistryName,
+			Tag:          "1.21",
+			Digest:       "sha256:abcdef",
+		},
+		"us-docker.pkg.dev/project/repo/image@sha256:abcdef": {
+			FullName:     "us-docker.pkg.dev/project/repo/image",
+			ShortName:    "project/repo/image",
+			RegistryName: "us-docker.pkg.dev",
+			Digest:       "sha256:abcdef",
+		},
+	}
+	for reference, expected := range cases {
+		imageInfo, err := ExtractDockerImageInfo(reference)
+		require.Nil(s.T(), err, "%q must be valid", reference)
+		require.Equal(s.T(), expected, imageInfo, "unexpected image info for %q", reference)
+	}
+	_, err := ExtractDockerImageInfo("ubuntu@latest")
+	require.NotNil(s.T(), err)
+}
+
+func TestDockerfile(t *testing.T) {
+	suite.Run(t, new(DockerfileTestSuite))
+}
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+// DockerIgnore matches paths against the patterns of a .dockerignore file
+type DockerIgnore struct {
+	patterns     []*dockerIgnorePattern
+	hasExclusion bool
+}
+
+type dockerIgnorePattern struct {
+	exclusion bool
+	regexp    *regexp.Regexp
+}
+
+// ReadDockerIgnore reads the .dockerignore file of a build context. A missing
+// file gives an empty DockerIgnore.
+func ReadDockerIgnore(buildRoot string) (*DockerIgnore, error) {
+	filename := filepath.Join(buildRoot, ".dockerignore")
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return &DockerIgnore{}, nil
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot open %q", filename)
+	}
+	defer f.Close()
+	return ParseDockerIgnore(f)
+}
+
+// ParseDockerIgnore parses the content of a .dockerignore file
+func ParseDockerIgnore(r io.Reader) (*DockerIgnore, error) {
+	d := &DockerIgnore{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern := &dockerIgnorePattern{}
+		if strings.HasPrefix(line, "!") {
+			pattern.exclusion = true
+			d.hasExclusion = true
+			line = strings.TrimSpace(line[1:])
+		}
+		line = filepath.ToSlash(filepath.Clean(line))
+		line = strings.TrimPrefix(line, "/")
+		if line == "" || line == "." {
+			continue
+		}
+		re, err := regexp.Compile(dockerIgnorePatternToRegexp(line))
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "Invalid .dockerignore pattern %q", line)
+		}
+		pattern.regexp = re
+		d.patterns = append(d.patterns, pattern)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot read .dockerignore")
+	}
+	return d, nil
+}
+
+// Matches checks if a slash separated path, relative to the build context, is
+// ignored. Like docker, a path is ignored when it or one of its parent
+// directories matches the last matching pattern.
+func (d *DockerIgnore) Matches(path string) bool {
+	matched := false
+	for _, pattern := range d.patterns {
+		if pattern.exclusion != matched {
+			continue
+		}
+		if pattern.matches(path) {
+			matched = !pattern.exclusion
+		}
+	}
+	return matched
+}
+
+// CanSkipDir checks if a directory and all of its content are ignored
+func (d *DockerIgnore) CanSkipDir(path string) bool {
+	return !d.hasExclusion && d.Matches(path)
+}
+
+func (p *dockerIgnorePattern) matches(path string) bool {
+	if p.regexp.MatchString(path) {
+		return true
+	}
+	for {
+		idx := strings.LastIndex(path, "/")
+		if idx < 0 {
+			return false
+		}
+		path = path[:idx]
+		if p.regexp.MatchString(path) {
+			return true
+		}
+	}
+}
+
+func dockerIgnorePatternToRegexp(pattern string) string {
+	b := &strings.Builder{}
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					// "**/" matches zero or more directories
+					i++
+					b.WriteString("(.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				b.WriteString("\\[")
+				continue
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
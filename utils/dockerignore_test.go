@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type DockerIgnoreTestSuite struct {
+	suite.Suite
+}
+
+func (s *DockerIgnoreTestSuite) TestMatches() {
+	dockerIgnore, err := ParseDockerIgnore(strings.NewReader(`
+# comment
+node_modules
+*.log
+**/*.tmp
+docs/[ab]*.md
+build
+!build/keep.txt
+`))
+	require.Nil(s.T(), err)
+	cases := map[string]bool{
+		"node_modules":             true,
+		"node_modules/lodash/a.js": true,
+		"src/node_modules":         false,
+		"error.log":                true,
+		"logs/error.log":           false,
+		"a.tmp":                    true,
+		"deep/inside/a.tmp":        true,
+		"docs/api.md":              true,
+		"docs/cli.md":              false,
+		"build/output.bin":         true,
+		"build/keep.txt":           false,
+		"Dockerfile":               false,
+		"src/main.go":              false,
+	}
+	for path, expected := range cases {
+		require.Equal(s.T(), expected, dockerIgnore.Matches(path), "unexpected match result for %q", path)
+	}
+}
+
+func (s *DockerIgnoreTestSuite) TestHashBuildContext() {
+	buildRoot, err := ioutil.TempDir("", "doriath-context")
+	require.Nil(s.T(), err)
+	defer os.RemoveAll(buildRoot)
+	require.Nil(s.T(), ioutil.WriteFile(filepath.Join(buildRoot, "Dockerfile"), []byte("FROM ubuntu:16.04\n"), 0644))
+	require.Nil(s.T(), ioutil.WriteFile(filepath.Join(buildRoot, ".dockerignore"), []byte("*.log\n"), 0644))
+	hash, err := HashBuildContext(buildRoot, "")
+	require.Nil(s.T(), err)
+
+	require.Nil(s.T(), ioutil.WriteFile(filepath.Join(buildRoot, "debug.log"), []byte("ignored"), 0644))
+	hashWithIgnoredFile, err := HashBuildContext(buildRoot, "")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), hash, hashWithIgnoredFile, "ignored files must not change the hash")
+
+	require.Nil(s.T(), ioutil.WriteFile(filepath.Join(buildRoot, "Dockerfile"), []byte("FROM ubuntu:18.04\n"), 0644))
+	hashWithChangedDockerfile, err := HashBuildContext(buildRoot, "")
+	require.Nil(s.T(), err)
+	require.NotEqual(s.T(), hash, hashWithChangedDockerfile, "changing the Dockerfile must change the hash")
+
+	dockerfile := filepath.Join(buildRoot, "docker", "app.Dockerfile")
+	require.Nil(s.T(), os.MkdirAll(filepath.Dir(dockerfile), 0755))
+	require.Nil(s.T(), ioutil.WriteFile(filepath.Join(buildRoot, ".dockerignore"), []byte("*.log\ndocker\n"), 0644))
+	require.Nil(s.T(), ioutil.WriteFile(dockerfile, []byte("FROM ubuntu:16.04\n"), 0644))
+	hash, err = HashBuildContext(buildRoot, dockerfile)
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), ioutil.WriteFile(dockerfile, []byte("FROM ubuntu:18.04\n"), 0644))
+	hashWithChangedDockerfile, err = HashBuildContext(buildRoot, dockerfile)
+	require.Nil(s.T(), err)
+	require.NotEqual(s.T(), hash, hashWithChangedDockerfile, "changing an ignored custom dockerfile must change the hash")
+}
+
+func TestDockerIgnore(t *testing.T) {
+	suite.Run(t, new(DockerIgnoreTestSuite))
+}
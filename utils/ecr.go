@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// ECRRegistryHost returns the host of the ECR registry of an AWS account
+func ECRRegistryHost(account, region string) string {
+	return fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com", account, region)
+}
+
+// AWSRegion returns the region set in AWS_REGION or AWS_DEFAULT_REGION
+func AWSRegion() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+// ECRCredentialProvider gets the credential of the ECR registry of an AWS
+// account with the GetAuthorizationToken API, signed with the AWS credentials
+// of LoadAWSCredentials
+type ECRCredentialProvider struct {
+	Account string
+	Region  string
+	// Profile is the profile of the AWS shared credentials file, see
+	// LoadAWSCredentials
+	Profile string
+	// Endpoint replaces the ECR API endpoint of the region when set
+	Endpoint string
+	// Retry retries failed requests, DefaultRetryPolicy when nil
+	Retry *RetryPolicy
+
+	now func() time.Time
+}
+
+const ecrGetAuthorizationTokenTarget = "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken"
+
+// Credential implements CredentialProvider
+func (p *ECRCredentialProvider) Credential() (string, string, time.Time, error) {
+	awsCredentials, err := LoadAWSCredentials(p.Profile)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	AddSecret(awsCredentials.SecretAccessKey, awsCredentials.SessionToken)
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://api.ecr.%s.amazonaws.com/", p.Region)
+	}
+	body, err := json.Marshal(map[string][]string{"registryIds": {p.Account}})
+	if err != nil {
+		return "", "", time.Time{}, stacktrace.Propagate(err, "Cannot encode ECR request")
+	}
+	responseBody, err := providerRequest(p.Retry, func() (*http.Request, error) {
+		request, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "Cannot create ECR request %s", endpoint)
+		}
+		request.Header.Set("Content-Type", "application/x-amz-json-1.1")
+		request.Header.Set("X-Amz-Target", ecrGetAuthorizationTokenTarget)
+		signAWSRequest(request, body, awsCredentials, p.Region, "ecr", p.timeNow())
+		return request, nil
+	}, ecrError)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	var result struct {
+		AuthorizationData []struct {
+			AuthorizationToken string  `json:"authorizationToken"`
+			ExpiresAt          float64 `json:"expiresAt"`
+		} `json:"authorizationData"`
+	}
+	err = json.Unmarshal(responseBody, &result)
+	if err != nil {
+		// The body is not printed, it holds the token
+		return "", "", time.Time{}, stacktrace.Propagate(err, "Cannot decode ECR authorization token")
+	}
+	if len(result.AuthorizationData) == 0 {
+		return "", "", time.Time{}, stacktrace.NewError("No ECR authorization token for account %s", p.Account)
+	}
+	data := result.AuthorizationData[0]
+	decoded, err := base64.StdEncoding.DecodeString(data.AuthorizationToken)
+	if err != nil {
+		return "", "", time.Time{}, stacktrace.Propagate(err, "Invalid ECR authorization token")
+	}
+	segments := strings.SplitN(string(decoded), ":", 2)
+	if len(segments) != 2 {
+		return "", "", time.Time{}, stacktrace.NewError("Invalid ECR authorization token")
+	}
+	AddCredentialSecret(segments[0], segments[1])
+	AddSecret(data.AuthorizationToken)
+	var expiresAt time.Time
+	if data.ExpiresAt > 0 {
+		expiresAt = time.Unix(0, int64(data.ExpiresAt*float64(time.Second)))
+	}
+	return segments[0], segments[1], expiresAt, nil
+}
+
+func (p *ECRCredentialProvider) timeNow() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+	return time.Now()
+}
+
+// ecrError is the error of a failed ECR request, from the AWS JSON error
+// response
+func ecrError(statusCode int, body []byte) error {
+	var result struct {
+		Type    string `json:"__type"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &result) == nil && result.Type != "" {
+		return stacktrace.NewError("Cannot get ECR authorization token: %s: %s", result.Type, result.Message)
+	}
+	return stacktrace.NewError("Cannot get ECR authorization token, unexpected status code %d: %s", statusCode, string(body))
+}
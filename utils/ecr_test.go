@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/anduintransaction/doriath/utils/registrytest"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ECRTestSuite struct {
+	suite.Suite
+	oldEnv map[string]string
+	ecr    *registrytest.ECR
+}
+
+func (s *ECRTestSuite) SetupTest() {
+	s.oldEnv = clearAWSEnv()
+	s.ecr = registrytest.NewECR("AKIDECR", "AWS", "s3cr3t-ecr-password")
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDECR")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "ecr-secret")
+}
+
+func (s *ECRTestSuite) TearDownTest() {
+	s.ecr.Close()
+	restoreAWSEnv(s.oldEnv)
+}
+
+func (s *ECRTestSuite) provider() *ECRCredentialProvider {
+	return &ECRCredentialProvider{Account: "123456789012", Region: "eu-west-1", Endpoint: s.ecr.URL}
+}
+
+func (s *ECRTestSuite) TestCredential() {
+	username, password, expiresAt, err := s.provider().Credential()
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "AWS", username)
+	require.Equal(s.T(), "s3cr3t-ecr-password", password)
+	require.WithinDuration(s.T(), time.Now().Add(12*time.Hour), expiresAt, time.Minute)
+	require.Equal(s.T(), []string{"123456789012"}, s.ecr.Requests())
+	require.Equal(s.T(), SecretMask+" "+SecretMask, Mask("s3cr3t-ecr-password ecr-secret"), "tokens and AWS keys must be masked")
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDOTHER")
+	_, _, _, err = s.provider().Credential()
+	require.NotNil(s.T(), err)
+	require.Contains(s.T(), err.Error(), "UnrecognizedClientException")
+	os.Unsetenv("AWS_ACCESS_KEY_ID")
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/nonexistent/credentials")
+	_, _, _, err = s.provider().Credential()
+	require.NotNil(s.T(), err, "missing AWS credentials must be an error")
+	require.Len(s.T(), s.ecr.Requests(), 1)
+}
+
+func (s *ECRTestSuite) TestRegistry() {
+	server := registrytest.NewRegistry()
+	defer server.Close()
+	server.BasicAuth = true
+	server.Username = "AWS"
+	server.Password = "s3cr3t-ecr-password"
+	server.PutImage("anduin/elrond", "1.0", nil)
+	credential := &DockerCredential{Registry: server.URL, Provider: CacheCredentialProvider(s.provider())}
+	registry, err := NewRegistry(credential)
+	require.Nil(s.T(), err)
+	for i := 0; i < 2; i++ {
+		exists, _, err := registry.TagExists("anduin/elrond", "1.0")
+		require.Nil(s.T(), err)
+		require.True(s.T(), exists)
+	}
+	require.Len(s.T(), s.ecr.Requests(), 1, "the ECR token must be reused")
+}
+
+// fakeCredentialProvider counts its calls, returning credentials expiring
+// after lifetime
+type fakeCredentialProvider struct {
+	now      func() time.Time
+	lifetime time.Duration
+	calls    int
+}
+
+func (p *fakeCredentialProvider) Credential() (string, string, time.Time, error) {
+	p.calls++
+	var expiresAt time.Time
+	if p.lifetime > 0 {
+		expiresAt = p.now().Add(p.lifetime)
+	}
+	return "user", "password", expiresAt, nil
+}
+
+func (s *ECRTestSuite) TestCacheCredentialProvider() {
+	now := time.Date(2019, 3, 14, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		return now
+	}
+	provider := &fakeCredentialProvider{now: clock, lifetime: time.Hour}
+	cached := CacheCredentialProvider(provider).(*cachedCredentialProvider)
+	cached.now = clock
+	for i := 0; i < 2; i++ {
+		_, _, _, err := cached.Credential()
+		require.Nil(s.T(), err)
+	}
+	require.Equal(s.T(), 1, provider.calls)
+	now = now.Add(54 * time.Minute)
+	cached.Credential()
+	require.Equal(s.T(), 1, provider.calls)
+	now = now.Add(2 * time.Minute)
+	cached.Credential()
+	require.Equal(s.T(), 2, provider.calls, "credentials must be refreshed before they expire")
+
+	provider = &fakeCredentialProvider{now: clock}
+	cached = CacheCredentialProvider(provider).(*cachedCredentialProvider)
+	cached.now = clock
+	cached.Credential()
+	now = now.Add(100 * time.Hour)
+	cached.Credential()
+	require.Equal(s.T(), 1, provider.calls, "credentials without expiry must be kept")
+}
+
+func TestECR(t *testing.T) {
+	suite.Run(t, new(ECRTestSuite))
+}
@@ -0,0 +1,598 @@
+package utils
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Engine API defaults
+const (
+	DefaultDockerHost = "unix:///var/run/docker.sock"
+	// DefaultRegistryServer is the server address used by docker for Docker Hub
+	DefaultRegistryServer = "https://index.docker.io/v1/"
+	// engineDockerfileName is the name of a dockerfile living outside of the
+	// build context once added to the context
+	engineDockerfileName = ".doriath.Dockerfile"
+)
+
+// engineBuilder talks to the Docker Engine API, over the unix socket or the
+// address in DOCKER_HOST
+type engineBuilder struct {
+	client  *http.Client
+	baseURL string
+	// auths holds the credentials given to Login by registry host, the engine
+	// API needs them on every push, pull and build. Registries without login
+	// use the docker config, and builds receive them by server address, see
+	// registryConfig.
+	auths     map[string]*engineAuthConfig
+	authsLock sync.Mutex
+}
+
+type engineAuthConfig struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	ServerAddress string `json:"serveraddress,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// engineMessage is a message of the JSON streams returned by build, push and pull
+type engineMessage struct {
+	Stream      string          `json:"stream"`
+	Status      string          `json:"status"`
+	ID          string          `json:"id"`
+	Progress    string          `json:"progress"`
+	Error       string          `json:"error"`
+	ErrorDetail *engineError    `json:"errorDetail"`
+	Aux         json.RawMessage `json:"aux"`
+}
+
+// engineError is an error returned by the engine API
+type engineError struct {
+	StatusCode int    `json:"-"`
+	Message    string `json:"message"`
+}
+
+func (e *engineError) Error() string {
+	return fmt.Sprintf("docker engine error (%d): %s", e.StatusCode, e.Message)
+}
+
+func newEngineBuilder() (*engineBuilder, error) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = DefaultDockerHost
+	}
+	hostURL, err := url.Parse(host)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Invalid DOCKER_HOST %q", host)
+	}
+	transport := &http.Transport{}
+	b := &engineBuilder{
+		client: &http.Client{Transport: transport},
+		auths:  make(map[string]*engineAuthConfig),
+	}
+	switch hostURL.Scheme {
+	case "unix":
+		socket := hostURL.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		}
+		b.baseURL = "http://docker"
+	case "tcp", "http", "https":
+		scheme := "http"
+		if hostURL.Scheme == "https" || os.Getenv("DOCKER_TLS_VERIFY") != "" {
+			scheme = "https"
+			transport.TLSClientConfig, err = engineTLSConfig()
+			if err != nil {
+				return nil, err
+			}
+		}
+		b.baseURL = scheme + "://" + hostURL.Host
+	default:
+		return nil, stacktrace.NewError("Unsupported DOCKER_HOST %q", host)
+	}
+	if version := os.Getenv("DOCKER_API_VERSION"); version != "" {
+		b.baseURL += "/v" + version
+	}
+	return b, nil
+}
+
+// engineTLSConfig reads the client certificates from DOCKER_CERT_PATH, like the
+// docker command line
+func engineTLSConfig() (*tls.Config, error) {
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if certPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "Cannot find home directory")
+		}
+		certPath = filepath.Join(home, ".docker")
+	}
+	return loadTLSConfig(filepath.Join(certPath, "ca.pem"), filepath.Join(certPath, "cert.pem"), filepath.Join(certPath, "key.pem"), false)
+}
+
+func (b *engineBuilder) Name() string {
+	return BuilderEngine
+}
+
+func (b *engineBuilder) Detect() error {
+	resp, err := b.do("GET", "/_ping", nil, nil, nil)
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot connect to docker engine")
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *engineBuilder) Build(opts *DockerBuildOptions, out io.Writer) (string, error) {
+	if len(opts.Platforms) > 1 {
+		return "", stacktrace.NewError("Cannot build image %s: multi-platform images need the %s, %s or %s builder", opts.FullName(), BuilderBuildx, BuilderPodman, BuilderBuildah)
+	}
+	dockerfile, err := engineDockerfile(opts)
+	if err != nil {
+		return "", err
+	}
+	buildArgs, _ := json.Marshal(opts.BuildArgs)
+	labels, _ := json.Marshal(opts.Labels)
+	query := url.Values{
+		"t":          {opts.FullName()},
+		"dockerfile": {dockerfile},
+		"buildargs":  {string(buildArgs)},
+		"labels":     {string(labels)},
+		"rm":         {"1"},
+	}
+	if opts.Target != "" {
+		query.Set("target", opts.Target)
+	}
+	if len(opts.Platforms) == 1 {
+		query.Set("platform", opts.Platforms[0])
+	}
+	registryAuths, err := b.registryConfig()
+	if err != nil {
+		return "", err
+	}
+	registryConfig, _ := json.Marshal(registryAuths)
+	header := http.Header{
+		"Content-Type":      {"application/x-tar"},
+		"X-Registry-Config": {base64.URLEncoding.EncodeToString(registryConfig)},
+	}
+	body, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeEngineBuildContext(writer, opts, dockerfile))
+	}()
+	defer body.Close()
+	resp, err := b.doContext(opts.context(), "POST", "/build", query, header, body)
+	if err != nil {
+		return "", stacktrace.Propagate(err, "Cannot build image %s", opts.FullName())
+	}
+	defer resp.Body.Close()
+	imageID := ""
+	err = readEngineMessages(resp.Body, out, func(aux json.RawMessage) {
+		var result struct {
+			ID string `json:"ID"`
+		}
+		if json.Unmarshal(aux, &result) == nil && result.ID != "" {
+			imageID = result.ID
+		}
+	})
+	return imageID, stacktrace.Propagate(err, "Cannot build image %s", opts.FullName())
+}
+
+// engineDockerfile returns the path of the dockerfile in the build context
+func engineDockerfile(opts *DockerBuildOptions) (string, error) {
+	if opts.Dockerfile == "" {
+		return "Dockerfile", nil
+	}
+	rel, err := filepath.Rel(opts.BuildRoot, opts.Dockerfile)
+	if err != nil {
+		return "", stacktrace.Propagate(err, "Cannot resolve %q in build context %q", opts.Dockerfile, opts.BuildRoot)
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return engineDockerfileName, nil
+	}
+	return rel, nil
+}
+
+// writeEngineBuildContext writes the build context as a tar archive. The
+// dockerfile is always added, even when ignored or outside of the context.
+func writeEngineBuildContext(w io.Writer, opts *DockerBuildOptions, dockerfile string) error {
+	tw := tar.NewWriter(w)
+	err := walkBuildContext(opts.BuildRoot, opts.Dockerfile, func(path, rel string, info os.FileInfo) error {
+		if rel == dockerfile {
+			return nil
+		}
+		return addTarEntry(tw, path, rel, info)
+	})
+	if err != nil {
+		return err
+	}
+	dockerfilePath := opts.Dockerfile
+	if dockerfilePath == "" {
+		dockerfilePath = filepath.Join(opts.BuildRoot, "Dockerfile")
+	}
+	info, err := os.Stat(dockerfilePath)
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot read dockerfile %q", dockerfilePath)
+	}
+	err = addTarEntry(tw, dockerfilePath, dockerfile, info)
+	if err != nil {
+		return err
+	}
+	return stacktrace.Propagate(tw.Close(), "Cannot write build context")
+}
+
+func addTarEntry(tw *tar.Writer, path, rel string, info os.FileInfo) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		link, err = os.Readlink(path)
+		if err != nil {
+			return stacktrace.Propagate(err, "Cannot read link %q", path)
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot archive %q", path)
+	}
+	header.Name = rel
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	err = tw.WriteHeader(header)
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot archive %q", path)
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot open %q", path)
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return stacktrace.Propagate(err, "Cannot archive %q", path)
+}
+
+func (b *engineBuilder) Push(opts *DockerBuildOptions, out io.Writer) (string, error) {
+	if len(opts.Platforms) > 0 {
+		return "", stacktrace.NewError("Cannot push image %s: multi-platform images need the %s, %s or %s builder", opts.FullName(), BuilderBuildx, BuilderPodman, BuilderBuildah)
+	}
+	header, err := b.registryAuthHeader(opts.Name)
+	if err != nil {
+		return "", err
+	}
+	resp, err := b.doContext(opts.context(), "POST", "/images/"+opts.Name+"/push", url.Values{"tag": {opts.Tag}}, header, nil)
+	if err != nil {
+		return "", stacktrace.Propagate(err, "Cannot push image %s", opts.FullName())
+	}
+	defer resp.Body.Close()
+	digest := ""
+	err = readEngineMessages(resp.Body, out, func(aux json.RawMessage) {
+		var result struct {
+			Digest string `json:"Digest"`
+		}
+		if json.Unmarshal(aux, &result) == nil && result.Digest != "" {
+			digest = result.Digest
+		}
+	})
+	return digest, stacktrace.Propagate(err, "Cannot push image %s", opts.FullName())
+}
+
+func (b *engineBuilder) Tag(name, tag, newTag string) error {
+	resp, err := b.do("POST", "/images/"+name+":"+tag+"/tag", url.Values{"repo": {name}, "tag": {newTag}}, nil, nil)
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot tag image %s:%s as %s", name, tag, newTag)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *engineBuilder) Remove(name, tag string, out io.Writer) error {
+	resp, err := b.do("DELETE", "/images/"+name+":"+tag, nil, nil, nil)
+	if isEngineStatus(err, http.StatusNotFound) {
+		return nil
+	}
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot remove image %s:%s", name, tag)
+	}
+	defer resp.Body.Close()
+	var deleted []map[string]string
+	json.NewDecoder(resp.Body).Decode(&deleted)
+	stdout, _, flush := commandWriters(out)
+	defer flush()
+	for _, item := range deleted {
+		for action, id := range item {
+			fmt.Fprintf(stdout, "%s: %s\n", action, id)
+		}
+	}
+	return nil
+}
+
+func (b *engineBuilder) ExistsLocally(fullname string) (bool, error) {
+	_, err := b.inspect(fullname)
+	if isEngineStatus(err, http.StatusNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, stacktrace.Propagate(err, "Cannot check image on local: %s", fullname)
+	}
+	return true, nil
+}
+
+// engineImage is the result of an image inspection
+type engineImage struct {
+	ID          string   `json:"Id"`
+	RepoTags    []string `json:"RepoTags"`
+	RepoDigests []string `json:"RepoDigests"`
+}
+
+// inspect returns the details of a local image
+func (b *engineBuilder) inspect(fullname string) (*engineImage, error) {
+	resp, err := b.do("GET", "/images/"+fullname+"/json", nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	image := &engineImage{}
+	err = json.NewDecoder(resp.Body).Decode(image)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot decode image %s", fullname)
+	}
+	return image, nil
+}
+
+func (b *engineBuilder) Pull(fullname string, out io.Writer) error {
+	existed, err := b.ExistsLocally(fullname)
+	if err != nil {
+		return err
+	}
+	if existed {
+		return nil
+	}
+	imageInfo, err := ExtractDockerImageInfo(fullname)
+	if err != nil {
+		return err
+	}
+	header, err := b.registryAuthHeader(imageInfo.FullName)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"fromImage": {imageInfo.FullName}, "tag": {imageInfo.Tag}}
+	if imageInfo.Digest != "" {
+		query.Set("tag", imageInfo.Digest)
+	}
+	resp, err := b.do("POST", "/images/create", query, header, nil)
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot pull image %s", fullname)
+	}
+	defer resp.Body.Close()
+	return stacktrace.Propagate(readEngineMessages(resp.Body, out, nil), "Cannot pull image %s", fullname)
+}
+
+func (b *engineBuilder) Login(host, username, password string) error {
+	auth := &engineAuthConfig{
+		Username:      username,
+		Password:      password,
+		ServerAddress: host,
+	}
+	if host == "" {
+		auth.ServerAddress = DefaultRegistryServer
+	}
+	body, _ := json.Marshal(auth)
+	resp, err := b.do("POST", "/auth", nil, http.Header{"Content-Type": {"application/json"}}, strings.NewReader(string(body)))
+	if err != nil {
+		return stacktrace.Propagate(err, "Cannot login to %s", auth.ServerAddress)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		IdentityToken string `json:"IdentityToken"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if result.IdentityToken != "" {
+		auth.Password = ""
+		auth.IdentityToken = result.IdentityToken
+	}
+	b.authsLock.Lock()
+	b.auths[registryHost(host)] = auth
+	b.authsLock.Unlock()
+	return nil
+}
+
+// registryAuthHeader returns the X-Registry-Auth header for the registry of an
+// image. The header is mandatory, even without credential.
+func (b *engineBuilder) registryAuthHeader(name string) (http.Header, error) {
+	imageInfo, err := ExtractDockerImageInfo(name)
+	if err != nil {
+		return nil, err
+	}
+	dockerConfig, err := ReadDockerConfig(DockerConfigDir())
+	if err != nil {
+		return nil, err
+	}
+	auth, err := b.registryAuth(dockerConfig, imageInfo.RegistryName)
+	if err != nil {
+		return nil, err
+	}
+	if auth == nil {
+		auth = &engineAuthConfig{}
+	}
+	encoded, _ := json.Marshal(auth)
+	return http.Header{"X-Registry-Auth": {base64.URLEncoding.EncodeToString(encoded)}}, nil
+}
+
+// registryAuth returns the credential of a registry given to Login or, like
+// the docker command line, found in the docker config. It returns nil when the
+// registry has no credential.
+func (b *engineBuilder) registryAuth(dockerConfig *DockerConfig, registryName string) (*engineAuthConfig, error) {
+	host := ""
+	if registryName != DefaultRegistryName {
+		host = registryHost(registryName)
+	}
+	b.authsLock.Lock()
+	auth := b.auths[host]
+	b.authsLock.Unlock()
+	if auth != nil {
+		return auth, nil
+	}
+	credential, err := dockerConfig.Credential(registryName)
+	if err != nil || credential == nil {
+		return nil, err
+	}
+	auth = &engineAuthConfig{
+		Username:      credential.Username,
+		Password:      credential.Password,
+		ServerAddress: host,
+		IdentityToken: credential.IdentityToken,
+	}
+	if host == "" {
+		auth.ServerAddress = DefaultRegistryServer
+	}
+	return auth, nil
+}
+
+// registryConfig returns the credentials for the X-Registry-Config header of
+// builds, given to Login or found in the docker config, by server address
+// since the daemon looks them up like this, Docker Hub being
+// https://index.docker.io/v1/
+func (b *engineBuilder) registryConfig() (map[string]*engineAuthConfig, error) {
+	dockerConfig, err := ReadDockerConfig(DockerConfigDir())
+	if err != nil {
+		return nil, err
+	}
+	registryNames := make(StringSet)
+	for key := range dockerConfig.Auths {
+		registryNames.Add(registryHost(key))
+	}
+	for key := range dockerConfig.CredHelpers {
+		registryNames.Add(registryHost(key))
+	}
+	b.authsLock.Lock()
+	for host := range b.auths {
+		registryNames.Add(host)
+	}
+	b.authsLock.Unlock()
+	config := make(map[string]*engineAuthConfig)
+	for host := range registryNames {
+		registryName := host
+		if host == "" {
+			registryName = DefaultRegistryName
+		}
+		auth, err := b.registryAuth(dockerConfig, registryName)
+		if err != nil {
+			// Builds may not pull from this registry
+			Warn("Cannot get credential of %s: %s", registryName, stacktrace.RootCause(err))
+			continue
+		}
+		if auth != nil {
+			config[auth.ServerAddress] = auth
+		}
+	}
+	return config, nil
+}
+
+// registryHost returns the host of a registry address like https://gcr.io/v2/,
+// Docker Hub is the empty host
+func registryHost(address string) string {
+	address = strings.TrimPrefix(strings.TrimPrefix(address, "https://"), "http://")
+	if idx := strings.Index(address, "/"); idx >= 0 {
+		address = address[:idx]
+	}
+	switch address {
+	case "index.docker.io", "docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return ""
+	}
+	return address
+}
+
+// do sends a request to the engine, responses with an error status are
+// returned as *engineError
+func (b *engineBuilder) do(method, path string, query url.Values, header http.Header, body io.Reader) (*http.Response, error) {
+	return b.doContext(context.Background(), method, path, query, header, body)
+}
+
+// doContext sends a request to the engine which is cancelled when ctx is done
+func (b *engineBuilder) doContext(ctx context.Context, method, path string, query url.Values, header http.Header, body io.Reader) (*http.Response, error) {
+	u := b.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot create engine request %s %s", method, path)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot send engine request %s %s", method, path)
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		engineErr := &engineError{StatusCode: resp.StatusCode}
+		content, _ := ioutil.ReadAll(resp.Body)
+		if json.Unmarshal(content, engineErr) != nil || engineErr.Message == "" {
+			engineErr.Message = strings.TrimSpace(string(content))
+		}
+		return nil, engineErr
+	}
+	return resp, nil
+}
+
+func isEngineStatus(err error, statusCode int) bool {
+	engineErr, ok := stacktrace.RootCause(err).(*engineError)
+	return ok && engineErr.StatusCode == statusCode
+}
+
+// readEngineMessages prints a JSON message stream to out and calls aux for
+// every aux message. An error message stops the stream.
+func readEngineMessages(r io.Reader, out io.Writer, aux func(json.RawMessage)) error {
+	stdout, _, flush := commandWriters(out)
+	defer flush()
+	decoder := json.NewDecoder(r)
+	for {
+		message := &engineMessage{}
+		err := decoder.Decode(message)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return stacktrace.Propagate(err, "Cannot decode docker engine message")
+		}
+		switch {
+		case message.ErrorDetail != nil && message.ErrorDetail.Message != "":
+			return stacktrace.NewError("%s", message.ErrorDetail.Message)
+		case message.Error != "":
+			return stacktrace.NewError("%s", message.Error)
+		case len(message.Aux) > 0:
+			if aux != nil {
+				aux(message.Aux)
+			}
+		case message.Stream != "":
+			fmt.Fprint(stdout, message.Stream)
+		case message.Status != "" && message.Progress == "":
+			// Progress bars are skipped, they only make sense on a terminal
+			if message.ID != "" {
+				fmt.Fprintf(stdout, "%s: %s\n", message.ID, message.Status)
+			} else {
+				fmt.Fprintln(stdout, message.Status)
+			}
+		}
+	}
+}
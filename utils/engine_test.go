@@ -0,0 +1,306 @@
+package utils
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// fakeEngine is an in-process Docker Engine API serving the endpoints used by
+// the engine builder
+type fakeEngine struct {
+	lock sync.Mutex
+	// buildFiles holds the files of the last build context
+	buildFiles map[string]string
+	buildQuery map[string]string
+	// buildRegistryConfig is the decoded X-Registry-Config header of the last
+	// build
+	buildRegistryConfig map[string]map[string]string
+	// pushAuth is the decoded X-Registry-Auth header of the last push
+	pushAuth map[string]string
+	tags     []string
+}
+
+func (f *fakeEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	path := r.URL.Path
+	switch {
+	case r.Method == "GET" && path == "/_ping":
+		fmt.Fprint(w, "OK")
+	case r.Method == "POST" && path == "/build":
+		f.buildQuery = map[string]string{}
+		for key := range r.URL.Query() {
+			f.buildQuery[key] = r.URL.Query().Get(key)
+		}
+		f.buildRegistryConfig = map[string]map[string]string{}
+		registryConfig, _ := base64.URLEncoding.DecodeString(r.Header.Get("X-Registry-Config"))
+		json.Unmarshal(registryConfig, &f.buildRegistryConfig)
+		f.buildFiles = map[string]string{}
+		tr := tar.NewReader(r.Body)
+		for {
+			header, err := tr.Next()
+			if err != nil {
+				break
+			}
+			content, _ := ioutil.ReadAll(tr)
+			f.buildFiles[header.Name] = string(content)
+		}
+		if f.buildQuery["t"] == "anduin/broken:1.0" {
+			fmt.Fprintln(w, `{"stream":"Step 1/2 : FROM scratch\n"}`)
+			fmt.Fprintln(w, `{"errorDetail":{"message":"unknown instruction: RUNN"},"error":"unknown instruction: RUNN"}`)
+			return
+		}
+		fmt.Fprintln(w, `{"stream":"Step 1/1 : FROM scratch\n"}`)
+		fmt.Fprintln(w, `{"aux":{"ID":"sha256:built"}}`)
+		fmt.Fprintln(w, `{"stream":"Successfully built\n"}`)
+	case r.Method == "POST" && strings.HasSuffix(path, "/tag"):
+		f.tags = append(f.tags, strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/tag")+" "+r.URL.Query().Get("repo")+":"+r.URL.Query().Get("tag"))
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "POST" && strings.HasSuffix(path, "/push"):
+		header := r.Header.Get("X-Registry-Auth")
+		decoded, err := base64.URLEncoding.DecodeString(header)
+		if header == "" || err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"message":"missing X-Registry-Auth"}`)
+			return
+		}
+		f.pushAuth = map[string]string{}
+		json.Unmarshal(decoded, &f.pushAuth)
+		fmt.Fprintln(w, `{"status":"The push refers to repository [docker.io/anduin/elrond]"}`)
+		fmt.Fprintln(w, `{"status":"Pushing","progressDetail":{"current":1,"total":2},"progress":"[==>  ]","id":"abc"}`)
+		fmt.Fprintln(w, `{"status":"1.0: digest: sha256:pushed size: 528"}`)
+		fmt.Fprintln(w, `{"progressDetail":{},"aux":{"Tag":"1.0","Digest":"sha256:pushed","Size":528}}`)
+	case r.Method == "DELETE" && path == "/images/missing:1":
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message":"No such image: missing:1"}`)
+	case r.Method == "DELETE" && path == "/images/used:1":
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, `{"message":"image is being used by running container"}`)
+	case r.Method == "DELETE":
+		fmt.Fprint(w, `[{"Untagged":"anduin/elrond:1.0"}]`)
+	case r.Method == "GET" && path == "/images/missing:1/json":
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message":"No such image: missing:1"}`)
+	case r.Method == "GET" && strings.HasSuffix(path, "/json"):
+		fmt.Fprint(w, `{"Id":"sha256:built","RepoTags":["anduin/elrond:1.0"]}`)
+	case r.Method == "POST" && path == "/auth":
+		var auth map[string]string
+		json.NewDecoder(r.Body).Decode(&auth)
+		if auth["password"] != "mellon" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"message":"login attempt failed"}`)
+			return
+		}
+		fmt.Fprint(w, `{"Status":"Login Succeeded"}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"message":"page not found: %s %s"}`, r.Method, path)
+	}
+}
+
+type EngineTestSuite struct {
+	suite.Suite
+	engine     *fakeEngine
+	server     *httptest.Server
+	oldHost    string
+	oldConfig  string
+	contextDir string
+	configDir  string
+}
+
+func (s *EngineTestSuite) SetupTest() {
+	s.engine = &fakeEngine{}
+	s.server = httptest.NewServer(s.engine)
+	s.oldHost = os.Getenv("DOCKER_HOST")
+	os.Setenv("DOCKER_HOST", "tcp://"+strings.TrimPrefix(s.server.URL, "http://"))
+	s.oldConfig = os.Getenv("DOCKER_CONFIG")
+	s.configDir = s.T().TempDir()
+	os.Setenv("DOCKER_CONFIG", s.configDir)
+	contextDir, err := ioutil.TempDir("", "doriath-engine")
+	require.Nil(s.T(), err)
+	s.contextDir = contextDir
+	files := map[string]string{
+		"Dockerfile":    "FROM scratch\n",
+		".dockerignore": "*.log\n",
+		"app/main.txt":  "galadriel\n",
+		"debug.log":     "ignored\n",
+	}
+	for name, content := range files {
+		filename := filepath.Join(contextDir, name)
+		require.Nil(s.T(), os.MkdirAll(filepath.Dir(filename), 0755))
+		require.Nil(s.T(), ioutil.WriteFile(filename, []byte(content), 0644))
+	}
+}
+
+func (s *EngineTestSuite) TearDownTest() {
+	s.server.Close()
+	os.Setenv("DOCKER_HOST", s.oldHost)
+	os.Setenv("DOCKER_CONFIG", s.oldConfig)
+	os.RemoveAll(s.contextDir)
+}
+
+func (s *EngineTestSuite) builder() Builder {
+	builder, err := NewBuilder(BuilderEngine)
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), builder.Detect())
+	return builder
+}
+
+func (s *EngineTestSuite) buildFileNames() []string {
+	names := []string{}
+	for name := range s.engine.buildFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *EngineTestSuite) TestBuild() {
+	builder := s.builder()
+	output := &strings.Builder{}
+	imageID, err := builder.Build(&DockerBuildOptions{
+		Name:      "anduin/elrond",
+		Tag:       "1.0",
+		BuildRoot: s.contextDir,
+		Target:    "prod",
+		BuildArgs: map[string]string{"VERSION": "1.0"},
+		Labels:    map[string]string{"team": "rivendell"},
+	}, output)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "sha256:built", imageID)
+	require.Equal(s.T(), "Step 1/1 : FROM scratch\nSuccessfully built\n", output.String())
+	require.Equal(s.T(), []string{".dockerignore", "Dockerfile", "app/", "app/main.txt"}, s.buildFileNames())
+	require.Equal(s.T(), "anduin/elrond:1.0", s.engine.buildQuery["t"])
+	require.Equal(s.T(), "Dockerfile", s.engine.buildQuery["dockerfile"])
+	require.Equal(s.T(), "prod", s.engine.buildQuery["target"])
+	require.Equal(s.T(), `{"VERSION":"1.0"}`, s.engine.buildQuery["buildargs"])
+	require.Equal(s.T(), `{"team":"rivendell"}`, s.engine.buildQuery["labels"])
+}
+
+func (s *EngineTestSuite) TestBuildDockerfileOutsideContext() {
+	dockerfileDir, err := ioutil.TempDir("", "doriath-engine-dockerfile")
+	require.Nil(s.T(), err)
+	defer os.RemoveAll(dockerfileDir)
+	dockerfile := filepath.Join(dockerfileDir, "Dockerfile.prod")
+	require.Nil(s.T(), ioutil.WriteFile(dockerfile, []byte("FROM ubuntu:16.04\n"), 0644))
+	_, err = s.builder().Build(&DockerBuildOptions{
+		Name:       "anduin/elrond",
+		Tag:        "1.0",
+		BuildRoot:  s.contextDir,
+		Dockerfile: dockerfile,
+	}, ioutil.Discard)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), engineDockerfileName, s.engine.buildQuery["dockerfile"])
+	require.Equal(s.T(), "FROM ubuntu:16.04\n", s.engine.buildFiles[engineDockerfileName])
+}
+
+func (s *EngineTestSuite) TestBuildRegistryConfig() {
+	builder := s.builder()
+	require.Nil(s.T(), builder.Login("", "frodo", "mellon"))
+	require.Nil(s.T(), builder.Login("https://gcr.io/v2/", "sam", "mellon"))
+	_, err := builder.Build(&DockerBuildOptions{Name: "anduin/elrond", Tag: "1.0", BuildRoot: s.contextDir}, ioutil.Discard)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), map[string]map[string]string{
+		DefaultRegistryServer: {"username": "frodo", "password": "mellon", "serveraddress": DefaultRegistryServer},
+		"https://gcr.io/v2/":  {"username": "sam", "password": "mellon", "serveraddress": "https://gcr.io/v2/"},
+	}, s.engine.buildRegistryConfig, "credentials of builds must be keyed by server address")
+}
+
+func (s *EngineTestSuite) TestBuildError() {
+	_, err := s.builder().Build(&DockerBuildOptions{Name: "anduin/broken", Tag: "1.0", BuildRoot: s.contextDir}, ioutil.Discard)
+	require.NotNil(s.T(), err)
+	require.Contains(s.T(), err.Error(), "unknown instruction: RUNN")
+}
+
+func (s *EngineTestSuite) TestLoginAndPush() {
+	builder := s.builder()
+	require.NotNil(s.T(), builder.Login("", "frodo", "speak friend"), "wrong password must fail")
+	require.Nil(s.T(), builder.Login("", "frodo", "mellon"))
+	output := &strings.Builder{}
+	digest, err := builder.Push(&DockerBuildOptions{Name: "anduin/elrond", Tag: "1.0"}, output)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "sha256:pushed", digest)
+	require.Equal(s.T(), map[string]string{
+		"username":      "frodo",
+		"password":      "mellon",
+		"serveraddress": DefaultRegistryServer,
+	}, s.engine.pushAuth)
+	require.NotContains(s.T(), output.String(), "[==>", "progress bars must be skipped")
+
+	_, err = builder.Push(&DockerBuildOptions{Name: "gcr.io/anduin/elrond", Tag: "1.0"}, ioutil.Discard)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), map[string]string{}, s.engine.pushAuth, "credential of another registry must not be sent")
+}
+
+func (s *EngineTestSuite) TestDockerConfigAuth() {
+	config := `{"auths": {"gcr.io": {"auth": "c2FtOm1lbGxvbg=="}, "https://index.docker.io/v1/": {"identitytoken": "s3cr3t-engine-identity"}}}`
+	require.Nil(s.T(), ioutil.WriteFile(filepath.Join(s.configDir, "config.json"), []byte(config), 0600))
+	builder := s.builder()
+	_, err := builder.Push(&DockerBuildOptions{Name: "gcr.io/anduin/elrond", Tag: "1.0"}, ioutil.Discard)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), map[string]string{"username": "sam", "password": "mellon", "serveraddress": "gcr.io"}, s.engine.pushAuth, "credentials of the docker config must be used without login")
+
+	require.Nil(s.T(), builder.Login("", "frodo", "mellon"))
+	_, err = builder.Build(&DockerBuildOptions{Name: "anduin/elrond", Tag: "1.0", BuildRoot: s.contextDir}, ioutil.Discard)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), map[string]map[string]string{
+		DefaultRegistryServer: {"username": "frodo", "password": "mellon", "serveraddress": DefaultRegistryServer},
+		"gcr.io":              {"username": "sam", "password": "mellon", "serveraddress": "gcr.io"},
+	}, s.engine.buildRegistryConfig, "builds must receive the credentials of the docker config, logins first")
+}
+
+func (s *EngineTestSuite) TestTagRemoveAndInspect() {
+	builder := s.builder()
+	require.Nil(s.T(), builder.Tag("anduin/elrond", "1.0", "latest"))
+	require.Equal(s.T(), []string{"anduin/elrond:1.0 anduin/elrond:latest"}, s.engine.tags)
+	require.Nil(s.T(), builder.Remove("anduin/elrond", "1.0", ioutil.Discard))
+	require.Nil(s.T(), builder.Remove("missing", "1", ioutil.Discard), "missing image must not be an error")
+	require.NotNil(s.T(), builder.Remove("used", "1", ioutil.Discard))
+	exists, err := builder.ExistsLocally("anduin/elrond:1.0")
+	require.Nil(s.T(), err)
+	require.True(s.T(), exists)
+	exists, err = builder.ExistsLocally("missing:1")
+	require.Nil(s.T(), err)
+	require.False(s.T(), exists)
+}
+
+func (s *EngineTestSuite) TestUnixSocket() {
+	socketDir, err := ioutil.TempDir("", "doriath-engine-socket")
+	require.Nil(s.T(), err)
+	defer os.RemoveAll(socketDir)
+	socket := filepath.Join(socketDir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	require.Nil(s.T(), err)
+	server := &http.Server{Handler: s.engine}
+	go server.Serve(listener)
+	defer server.Close()
+	os.Setenv("DOCKER_HOST", "unix://"+socket)
+	_, err = s.builder().Build(&DockerBuildOptions{Name: "anduin/elrond", Tag: "1.0", BuildRoot: s.contextDir}, ioutil.Discard)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "anduin/elrond:1.0", s.engine.buildQuery["t"])
+}
+
+func (s *EngineTestSuite) TestInvalidDockerHost() {
+	os.Setenv("DOCKER_HOST", "npipe:////./pipe/docker_engine")
+	_, err := NewBuilder(BuilderEngine)
+	require.NotNil(s.T(), err)
+}
+
+func TestEngine(t *testing.T) {
+	suite.Run(t, new(EngineTestSuite))
+}
@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"os"
+	"sync"
+)
+
+var exitHandlers struct {
+	sync.Mutex
+	fns []func()
+}
+
+// AtExit registers fn to be called when doriath exits with Exit. fn may also
+// be called before, and must then do nothing. Signals are not handled here:
+// commands handling them cancel their work and exit with Exit once the
+// processes they started are done.
+func AtExit(fn func()) {
+	exitHandlers.Lock()
+	defer exitHandlers.Unlock()
+	exitHandlers.fns = append(exitHandlers.fns, fn)
+}
+
+// Exit calls the functions registered with AtExit and exits
+func Exit(code int) {
+	runExitHandlers()
+	os.Exit(code)
+}
+
+// runExitHandlers calls the functions registered with AtExit, most recent first
+func runExitHandlers() {
+	exitHandlers.Lock()
+	fns := exitHandlers.fns
+	exitHandlers.fns = nil
+	exitHandlers.Unlock()
+	for i := len(fns) - 1; i >= 0; i-- {
+		fns[i]()
+	}
+}
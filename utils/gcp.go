@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Defaults of GCP service account credentials
+const (
+	DefaultGCPTokenURL = "https://oauth2.googleapis.com/token"
+	DefaultGCPScope    = "https://www.googleapis.com/auth/cloud-platform"
+	// GCPTokenUsername is the username of registries authenticated with an
+	// OAuth2 access token
+	GCPTokenUsername = "oauth2accesstoken"
+)
+
+// gcpAssertionLifetime is the lifetime of the JWT asking for an access token
+const gcpAssertionLifetime = time.Hour
+
+// GCPServiceAccountProvider gets an OAuth2 access token for Artifact Registry
+// and Container Registry by signing a JWT with the key of a service account
+type GCPServiceAccountProvider struct {
+	// KeyFile is the JSON key file of the service account
+	KeyFile string
+	// TokenURL replaces the token URL of the key file when set
+	TokenURL string
+	// Scope defaults to DefaultGCPScope
+	Scope string
+	// Retry retries failed requests, DefaultRetryPolicy when nil
+	Retry *RetryPolicy
+
+	now func() time.Time
+}
+
+type gcpServiceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// Credential implements CredentialProvider
+func (p *GCPServiceAccountProvider) Credential() (string, string, time.Time, error) {
+	content, err := ioutil.ReadFile(p.KeyFile)
+	if err != nil {
+		return "", "", time.Time{}, stacktrace.Propagate(err, "Cannot read service account key %q", p.KeyFile)
+	}
+	key := &gcpServiceAccountKey{}
+	err = json.Unmarshal(content, key)
+	if err != nil {
+		return "", "", time.Time{}, stacktrace.Propagate(err, "Cannot decode service account key %q", p.KeyFile)
+	}
+	if key.Type != "service_account" || key.ClientEmail == "" || key.PrivateKey == "" {
+		return "", "", time.Time{}, stacktrace.NewError("Invalid service account key %q", p.KeyFile)
+	}
+	AddSecret(key.PrivateKey)
+	privateKey, err := parseRSAPrivateKey(key.PrivateKey)
+	if err != nil {
+		return "", "", time.Time{}, stacktrace.Propagate(err, "Invalid private key in %q", p.KeyFile)
+	}
+	tokenURL := p.TokenURL
+	if tokenURL == "" {
+		tokenURL = key.TokenURI
+	}
+	if tokenURL == "" {
+		tokenURL = DefaultGCPTokenURL
+	}
+	scope := p.Scope
+	if scope == "" {
+		scope = DefaultGCPScope
+	}
+	now := p.timeNow()
+	assertion, err := signJWT(privateKey, key.PrivateKeyID, map[string]interface{}{
+		"iss":   key.ClientEmail,
+		"scope": scope,
+		"aud":   tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(gcpAssertionLifetime).Unix(),
+	})
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+	body, err := providerRequest(p.Retry, func() (*http.Request, error) {
+		return newFormRequest(tokenURL, form)
+	}, oauth2Error(tokenURL))
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	token, err := decodeOAuth2Token(tokenURL, body)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	return GCPTokenUsername, token.AccessToken, token.expiresAt(now), nil
+}
+
+func (p *GCPServiceAccountProvider) timeNow() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+	return time.Now()
+}
+
+// parseRSAPrivateKey parses a PEM RSA private key in PKCS #8 or PKCS #1 form
+func parseRSAPrivateKey(content string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(content))
+	if block == nil {
+		return nil, stacktrace.NewError("No PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot parse private key")
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, stacktrace.NewError("Private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// signJWT signs claims into a JWT with RS256
+func signJWT(key *rsa.PrivateKey, keyID string, claims map[string]interface{}) (string, error) {
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	if keyID != "" {
+		header["kid"] = keyID
+	}
+	segments := []string{}
+	for _, part := range []interface{}{header, claims} {
+		content, err := json.Marshal(part)
+		if err != nil {
+			return "", stacktrace.Propagate(err, "Cannot encode JWT")
+		}
+		segments = append(segments, base64.RawURLEncoding.EncodeToString(content))
+	}
+	signingInput := strings.Join(segments, ".")
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", stacktrace.Propagate(err, "Cannot sign JWT")
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
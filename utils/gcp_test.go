@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anduintransaction/doriath/utils/registrytest"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type GCPTestSuite struct {
+	suite.Suite
+	key     *rsa.PrivateKey
+	keyFile string
+	oauth2  *registrytest.OAuth2
+}
+
+func (s *GCPTestSuite) SetupTest() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(s.T(), err)
+	s.key = key
+	s.oauth2 = registrytest.NewOAuth2("s3cr3t-gcp-access-token")
+	s.oauth2.PublicKey = &key.PublicKey
+	s.keyFile = writeGCPKeyFile(s.T(), key, s.oauth2.URL+"/token")
+}
+
+func (s *GCPTestSuite) TearDownTest() {
+	s.oauth2.Close()
+}
+
+// writeGCPKeyFile writes the JSON key file of a service account
+func writeGCPKeyFile(t *testing.T, key *rsa.PrivateKey, tokenURI string) string {
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	content, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "doriath@anduin.iam.gserviceaccount.com",
+		"private_key_id": "key-1",
+		"private_key":    string(privateKey),
+		"token_uri":      tokenURI,
+	})
+	require.Nil(t, err)
+	keyFile := filepath.Join(t.TempDir(), "key.json")
+	require.Nil(t, ioutil.WriteFile(keyFile, content, 0600))
+	return keyFile
+}
+
+func (s *GCPTestSuite) TestCredential() {
+	provider := &GCPServiceAccountProvider{KeyFile: s.keyFile}
+	username, password, expiresAt, err := provider.Credential()
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), GCPTokenUsername, username)
+	require.Equal(s.T(), "s3cr3t-gcp-access-token", password)
+	require.WithinDuration(s.T(), time.Now().Add(time.Hour), expiresAt, time.Minute)
+	require.Equal(s.T(), []string{"/token urn:ietf:params:oauth:grant-type:jwt-bearer"}, s.oauth2.Requests())
+	require.Equal(s.T(), SecretMask, Mask("s3cr3t-gcp-access-token"))
+
+	provider = &GCPServiceAccountProvider{KeyFile: s.keyFile, TokenURL: s.oauth2.URL + "/override"}
+	_, _, _, err = provider.Credential()
+	require.Nil(s.T(), err, "token URL must be overridden")
+	require.Len(s.T(), s.oauth2.Requests(), 2)
+}
+
+func (s *GCPTestSuite) TestErrors() {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(s.T(), err)
+	provider := &GCPServiceAccountProvider{KeyFile: writeGCPKeyFile(s.T(), otherKey, s.oauth2.URL+"/token")}
+	_, _, _, err = provider.Credential()
+	require.NotNil(s.T(), err)
+	require.Contains(s.T(), err.Error(), "invalid_grant: Invalid JWT Signature.")
+
+	provider = &GCPServiceAccountProvider{KeyFile: filepath.Join(s.T().TempDir(), "missing.json")}
+	_, _, _, err = provider.Credential()
+	require.NotNil(s.T(), err, "missing key file must be an error")
+
+	invalidKeyFile := filepath.Join(s.T().TempDir(), "key.json")
+	require.Nil(s.T(), ioutil.WriteFile(invalidKeyFile, []byte(`{"type": "service_account", "client_email": "doriath", "private_key": "not a key"}`), 0600))
+	provider = &GCPServiceAccountProvider{KeyFile: invalidKeyFile}
+	_, _, _, err = provider.Credential()
+	require.NotNil(s.T(), err, "invalid private key must be an error")
+	require.Len(s.T(), s.oauth2.Requests(), 1)
+}
+
+func (s *GCPTestSuite) TestRegistry() {
+	server := registrytest.NewRegistry()
+	defer server.Close()
+	server.BasicAuth = true
+	server.Username = GCPTokenUsername
+	server.Password = "s3cr3t-gcp-access-token"
+	server.PutImage("anduin/elrond", "1.0", nil)
+	provider := CacheCredentialProvider(&GCPServiceAccountProvider{KeyFile: s.keyFile})
+	registry, err := NewRegistry(&DockerCredential{Registry: server.URL, Provider: provider})
+	require.Nil(s.T(), err)
+	for i := 0; i < 2; i++ {
+		exists, _, err := registry.TagExists("anduin/elrond", "1.0")
+		require.Nil(s.T(), err)
+		require.True(s.T(), exists)
+	}
+	require.Len(s.T(), s.oauth2.Requests(), 1, "the access token must be reused")
+}
+
+func TestGCP(t *testing.T) {
+	suite.Run(t, new(GCPTestSuite))
+}
@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+)
+
+// outputLock serializes writes of complete lines coming from concurrent jobs
+var outputLock sync.Mutex
+
+// PrefixWriter prepends a prefix to every line written to the underlying writer.
+// Lines are buffered until complete so that output from concurrent jobs never
+// interleaves in the middle of a line.
+type PrefixWriter struct {
+	prefix []byte
+	w      io.Writer
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+// NewPrefixWriter creates a new PrefixWriter
+func NewPrefixWriter(prefix string, w io.Writer) *PrefixWriter {
+	return &PrefixWriter{
+		prefix: []byte(prefix),
+		w:      w,
+	}
+}
+
+// Write implements io.Writer
+func (p *PrefixWriter) Write(data []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.buffer.Write(data)
+	for {
+		line := p.buffer.Bytes()
+		idx := bytes.IndexByte(line, '\n')
+		if idx < 0 {
+			break
+		}
+		err := p.writeLine(line[:idx+1])
+		p.buffer.Next(idx + 1)
+		if err != nil {
+			return len(data), err
+		}
+	}
+	return len(data), nil
+}
+
+// Flush writes any incomplete line left in the buffer
+func (p *PrefixWriter) Flush() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.buffer.Len() == 0 {
+		return nil
+	}
+	line := append(p.buffer.Bytes(), '\n')
+	p.buffer.Reset()
+	return p.writeLine(line)
+}
+
+func (p *PrefixWriter) writeLine(line []byte) error {
+	outputLock.Lock()
+	defer outputLock.Unlock()
+	_, err := p.w.Write(append(append([]byte{}, p.prefix...), line...))
+	return err
+}
+
+// commandWriters returns the writers for a subprocess stdout and stderr,
+// masking secrets, and a function flushing them once the subprocess is done. A
+// nil out means the subprocess writes to the process stdout and stderr.
+func commandWriters(out io.Writer) (io.Writer, io.Writer, func()) {
+	if out == nil {
+		stdout, stderr := NewMaskingWriter(os.Stdout), NewMaskingWriter(os.Stderr)
+		return stdout, stderr, func() {
+			stdout.Flush()
+			stderr.Flush()
+		}
+	}
+	masked := NewMaskingWriter(out)
+	return masked, masked, func() {
+		masked.Flush()
+	}
+}
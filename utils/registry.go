@@ -0,0 +1,454 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Registry reads images from a docker registry. Repositories are the image
+// names without registry host, like anduin/doriath.
+type Registry interface {
+	// TagExists checks if a tag exists in a repository and returns the digest
+	// of its manifest
+	TagExists(repository, tag string) (bool, string, error)
+	// ListTags returns all tags of a repository
+	ListTags(repository string) ([]string, error)
+	// ImageLabels returns the labels of an image from its config
+	ImageLabels(repository, tag string) (map[string]string, error)
+	// FindMatchingTags returns the digest of a reference tag and the other
+	// tags pointing to the same manifest
+	FindMatchingTags(repository, reference string) (string, []string, error)
+}
+
+// ociRegistry implements Registry with the OCI distribution API
+type ociRegistry struct {
+	credential *DockerCredential
+	client     *http.Client
+	retry      *RetryPolicy
+	ctx        context.Context
+	tokens     *tokenCache
+	lock       sync.Mutex
+	// challenge is the last authentication challenge of the registry, used
+	// to authenticate requests before being challenged again
+	challenge    *authChallenge
+	refreshToken string
+	// noRefreshToken is set when the token endpoint refused a refresh token
+	noRefreshToken bool
+}
+
+// DefaultRegistryTimeout is the default timeout of registry requests
+const DefaultRegistryTimeout = 30 * time.Second
+
+type registryOpt struct {
+	timeout time.Duration
+	retry   *RetryPolicy
+	ctx     context.Context
+}
+
+// RegistryOptFn sets an option of a registry client
+type RegistryOptFn func(opt *registryOpt)
+
+// WithTimeout sets the timeout of every registry request
+func WithTimeout(timeout time.Duration) RegistryOptFn {
+	return func(opt *registryOpt) {
+		opt.timeout = timeout
+	}
+}
+
+// WithRetryPolicy sets how registry requests failing with a network error, a
+// 429 or a 5xx status are retried
+func WithRetryPolicy(policy *RetryPolicy) RegistryOptFn {
+	return func(opt *registryOpt) {
+		opt.retry = policy
+	}
+}
+
+// WithContext cancels registry requests, and their retries, when ctx is done
+func WithContext(ctx context.Context) RegistryOptFn {
+	return func(opt *registryOpt) {
+		opt.ctx = ctx
+	}
+}
+
+// NewRegistry creates a Registry talking the OCI distribution API. Tokens are
+// cached until they expire and shared by all registries.
+func NewRegistry(credential *DockerCredential, optFns ...RegistryOptFn) (Registry, error) {
+	return newOCIRegistry(credential, registryTokens, optFns...)
+}
+
+func newOCIRegistry(credential *DockerCredential, tokens *tokenCache, optFns ...RegistryOptFn) (*ociRegistry, error) {
+	opt := &registryOpt{
+		timeout: DefaultRegistryTimeout,
+		retry:   DefaultRetryPolicy(),
+		ctx:     context.Background(),
+	}
+	for _, fn := range optFns {
+		fn(opt)
+	}
+	client, err := registryClient(credential, opt.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &ociRegistry{
+		credential:   credential,
+		client:       client,
+		retry:        opt.retry,
+		ctx:          opt.ctx,
+		tokens:       tokens,
+		refreshToken: credential.IdentityToken,
+	}, nil
+}
+
+func (r *ociRegistry) TagExists(repository, tag string) (bool, string, error) {
+	manifestURL := r.manifestURL(repository, tag)
+	accept := strings.Join(manifestMediaTypes, ", ")
+	response, err := r.do("HEAD", manifestURL, repository, accept)
+	if err != nil {
+		return false, "", err
+	}
+	switch response.statusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return false, "", nil
+	default:
+		return false, "", stacktrace.NewError("Unexpected status %d for HEAD %s", response.statusCode, manifestURL)
+	}
+	digest := response.header.Get("Docker-Content-Digest")
+	if digest != "" {
+		return true, digest, nil
+	}
+	// The digest header is optional, the digest of the manifest content is the same
+	responseBody, err := r.getOK(manifestURL, repository, accept)
+	if err != nil {
+		return false, "", err
+	}
+	return true, sha256Digest(responseBody), nil
+}
+
+// ListTags returns all tags of a repository, following the pagination of the
+// registry
+func (r *ociRegistry) ListTags(repository string) ([]string, error) {
+	tags := []string{}
+	err := r.listTagPages(repository, "", func(responseBody []byte) error {
+		var tagResponse struct {
+			Tags []string `json:"tags"`
+		}
+		err := json.Unmarshal(responseBody, &tagResponse)
+		if err != nil {
+			return stacktrace.Propagate(err, "Cannot decode response body: %s", string(responseBody))
+		}
+		tags = append(tags, tagResponse.Tags...)
+		return nil
+	})
+	return tags, err
+}
+
+// tagListPageSize is the number of tags requested per page
+const tagListPageSize = 1000
+
+// listTagPages calls fn with the body of every page of the tag list. The next
+// page is given by the Link header, as described in the distribution spec.
+func (r *ociRegistry) listTagPages(repository, accept string, fn func(responseBody []byte) error) error {
+	pageURL := fmt.Sprintf("%s?n=%d", r.tagListURL(repository), tagListPageSize)
+	for pageURL != "" {
+		response, err := r.do("GET", pageURL, repository, accept)
+		if err != nil {
+			return err
+		}
+		if response.statusCode == http.StatusNotFound {
+			return nil
+		}
+		if response.statusCode != http.StatusOK {
+			return stacktrace.NewError("Unexpected status: %d, response body: %s", response.statusCode, string(response.body))
+		}
+		err = fn(response.body)
+		if err != nil {
+			return err
+		}
+		pageURL, err = nextPageURL(pageURL, response.header.Get("Link"))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextPageURL reads a Link header like </v2/name/tags/list?n=2&last=b>; rel="next"
+// and resolves it against the current page URL
+func nextPageURL(currentURL, link string) (string, error) {
+	for _, part := range strings.Split(link, ",") {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(part, "<") || !strings.Contains(part, `rel="next"`) {
+			continue
+		}
+		end := strings.Index(part, ">")
+		if end < 0 {
+			return "", stacktrace.NewError("Invalid Link header: %q", link)
+		}
+		base, err := url.Parse(currentURL)
+		if err != nil {
+			return "", stacktrace.Propagate(err, "Invalid URL %q", currentURL)
+		}
+		next, err := base.Parse(part[1:end])
+		if err != nil {
+			return "", stacktrace.Propagate(err, "Invalid Link header: %q", link)
+		}
+		return next.String(), nil
+	}
+	return "", nil
+}
+
+func (r *ociRegistry) ImageLabels(repository, tag string) (map[string]string, error) {
+	manifest, err := r.getManifest(repository, tag)
+	if err != nil {
+		return nil, err
+	}
+	if len(manifest.Manifests) > 0 {
+		// Every platform of a multi-platform image is built from the same context
+		manifest, err = r.getManifest(repository, manifest.Manifests[0].Digest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if manifest.Config.Digest == "" {
+		return nil, stacktrace.NewError("Cannot find config of image %s:%s", repository, tag)
+	}
+	blobURL := r.registryURL() + "/v2/" + repository + "/blobs/" + manifest.Config.Digest
+	responseBody, err := r.getOK(blobURL, repository, "")
+	if err != nil {
+		return nil, err
+	}
+	var imageConfig struct {
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"config"`
+	}
+	err = json.Unmarshal(responseBody, &imageConfig)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot decode image config: %s", string(responseBody))
+	}
+	return imageConfig.Config.Labels, nil
+}
+
+func (r *ociRegistry) FindMatchingTags(repository, reference string) (string, []string, error) {
+	exists, digest, err := r.TagExists(repository, reference)
+	if err != nil {
+		return "", nil, err
+	}
+	if !exists {
+		return "", nil, stacktrace.NewError("Tag %q not found in %s", reference, repository)
+	}
+	tags := []string{}
+	// Some registries like gcr.io give the digest of every tag in the tag
+	// list, other tags are checked one by one
+	tagDigests := make(map[string]string)
+	err = r.listTagPages(repository, "", func(responseBody []byte) error {
+		var tagResponse struct {
+			Tags     []string `json:"tags"`
+			Manifest map[string]struct {
+				Tag []string `json:"tag"`
+			} `json:"manifest"`
+		}
+		err := json.Unmarshal(responseBody, &tagResponse)
+		if err != nil {
+			return stacktrace.Propagate(err, "Cannot decode response body: %s", string(responseBody))
+		}
+		for manifestDigest, manifest := range tagResponse.Manifest {
+			for _, tag := range manifest.Tag {
+				tagDigests[tag] = manifestDigest
+			}
+		}
+		tags = append(tags, tagResponse.Tags...)
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	matchingTags := []string{}
+	for _, tag := range tags {
+		if tag == reference {
+			continue
+		}
+		tagDigest, ok := tagDigests[tag]
+		if !ok {
+			_, tagDigest, err = r.TagExists(repository, tag)
+			if err != nil {
+				return "", nil, err
+			}
+		}
+		if tagDigest == digest {
+			matchingTags = append(matchingTags, tag)
+		}
+	}
+	return digest, matchingTags, nil
+}
+
+func (r *ociRegistry) registryURL() string {
+	registry := r.credential.Registry
+	if registry == "" {
+		return DefaultRegistry
+	}
+	if !strings.HasPrefix(registry, "http://") && !strings.HasPrefix(registry, "https://") {
+		registry = "https://" + registry
+	}
+	// The API path is added to the registry URL, like https://gcr.io/v2/
+	return strings.TrimSuffix(strings.TrimSuffix(registry, "/"), "/v2")
+}
+
+func (r *ociRegistry) tagListURL(repository string) string {
+	return r.registryURL() + "/v2/" + repository + "/tags/list"
+}
+
+func (r *ociRegistry) manifestURL(repository, reference string) string {
+	return r.registryURL() + "/v2/" + repository + "/manifests/" + reference
+}
+
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+type dockerManifest struct {
+	Config struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Manifests []struct {
+		Digest string `json:"digest"`
+	} `json:"manifests"`
+}
+
+func (r *ociRegistry) getManifest(repository, reference string) (*dockerManifest, error) {
+	manifestURL := r.manifestURL(repository, reference)
+	responseBody, err := r.getOK(manifestURL, repository, strings.Join(manifestMediaTypes, ", "))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &dockerManifest{}
+	err = json.Unmarshal(responseBody, manifest)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Cannot decode manifest: %s", string(responseBody))
+	}
+	return manifest, nil
+}
+
+type registryResponse struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+// do makes an authorized request on a repository of the registry. When the
+// registry challenges the request, it authenticates and retries once.
+func (r *ociRegistry) do(method, url, repository, accept string) (*registryResponse, error) {
+	r.lock.Lock()
+	authorization, err := r.authorization(repository, r.challenge, nil, false)
+	r.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	response, err := r.send(method, url, authorization, accept)
+	if err != nil || response.statusCode != http.StatusUnauthorized || r.credential.HTTPToken != "" {
+		return response, err
+	}
+	challenge, err := registryChallenge(response.header)
+	if err != nil {
+		return nil, err
+	}
+	var scopes []string
+	if scope := challenge.params["scope"]; scope != "" {
+		scopes = strings.Fields(scope)
+	}
+	r.lock.Lock()
+	r.challenge = challenge
+	// A rejected token is requested again, otherwise a cached token may be used
+	authorization, err = r.authorization(repository, challenge, scopes, authorization != "")
+	r.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return r.send(method, url, authorization, accept)
+}
+
+// send sends a request to the registry, following redirects as blobs are
+// usually served from a different storage
+func (r *ociRegistry) send(method, url, authorization, accept string) (*registryResponse, error) {
+	return r.roundTrip(func() (*http.Request, error) {
+		request, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "Cannot create request to %s", url)
+		}
+		if authorization != "" {
+			request.Header.Add("Authorization", authorization)
+		}
+		if accept != "" {
+			request.Header.Add("Accept", accept)
+		}
+		return request, nil
+	})
+}
+
+// roundTrip sends the request created by newRequest and reads the response,
+// retrying network errors and retryable statuses with the retry policy
+func (r *ociRegistry) roundTrip(newRequest func() (*http.Request, error)) (*registryResponse, error) {
+	var result *registryResponse
+	err := r.retry.DoContext(r.ctx, func() error {
+		request, err := newRequest()
+		if err != nil {
+			return err
+		}
+		response, err := r.client.Do(request.WithContext(r.ctx))
+		if err != nil {
+			retryable := isRetryableNetworkError(err)
+			err = stacktrace.Propagate(err, "Cannot make request to %s", request.URL)
+			if retryable {
+				return Retryable(err, 0)
+			}
+			return err
+		}
+		defer response.Body.Close()
+		responseBody, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return Retryable(stacktrace.Propagate(err, "Cannot read body of request to %s", request.URL), 0)
+		}
+		if isRetryableStatus(response.StatusCode) {
+			return retryStatusError(request.Method, request.URL.String(), response.StatusCode, response.Header)
+		}
+		result = &registryResponse{
+			statusCode: response.StatusCode,
+			header:     response.Header,
+			body:       responseBody,
+		}
+		return nil
+	})
+	return result, err
+}
+
+// getOK makes a GET request with do, failing if the response status is not 200
+func (r *ociRegistry) getOK(url, repository, accept string) ([]byte, error) {
+	response, err := r.do("GET", url, repository, accept)
+	if err != nil {
+		return nil, err
+	}
+	if response.statusCode != http.StatusOK {
+		return nil, stacktrace.NewError("Unexpected status: %d, response body: %s", response.statusCode, string(response.body))
+	}
+	return response.body, nil
+}
+
+func sha256Digest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
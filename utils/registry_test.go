@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/anduintransaction/doriath/utils/registrytest"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type RegistryTestSuite struct {
+	suite.Suite
+	server *registrytest.Registry
+	digest string
+}
+
+func (s *RegistryTestSuite) SetupTest() {
+	s.server = registrytest.NewRegistry()
+	s.server.Username = "frodo"
+	s.server.Password = "mellon"
+	s.digest = s.server.PutImage("anduin/elrond", "1.0", map[string]string{"team": "rivendell"})
+}
+
+func (s *RegistryTestSuite) TearDownTest() {
+	s.server.Close()
+}
+
+func (s *RegistryTestSuite) registry(password string) Registry {
+	registry, err := NewRegistry(&DockerCredential{
+		Registry: s.server.URL,
+		Username: "frodo",
+		Password: password,
+	})
+	require.Nil(s.T(), err)
+	return registry
+}
+
+func (s *RegistryTestSuite) TestTagExists() {
+	registry := s.registry("mellon")
+	exists, digest, err := registry.TagExists("anduin/elrond", "1.0")
+	require.Nil(s.T(), err)
+	require.True(s.T(), exists)
+	require.Equal(s.T(), s.digest, digest)
+	exists, _, err = registry.TagExists("anduin/elrond", "2.0")
+	require.Nil(s.T(), err)
+	require.False(s.T(), exists)
+	exists, _, err = registry.TagExists("anduin/arwen", "1.0")
+	require.Nil(s.T(), err)
+	require.False(s.T(), exists, "unknown repository must not be an error")
+	for _, request := range s.server.Requests() {
+		require.NotContains(s.T(), request, "/tags/list", "tag existence must not list tags")
+	}
+	require.Contains(s.T(), s.server.Requests(), "HEAD /v2/anduin/elrond/manifests/1.0")
+}
+
+func (s *RegistryTestSuite) TestListTagsPagination() {
+	expectedTags := []string{"1.0"}
+	for i := 0; i < 7; i++ {
+		tag := fmt.Sprintf("2.%d", i)
+		s.server.PutImage("anduin/elrond", tag, nil)
+		expectedTags = append(expectedTags, tag)
+	}
+	s.server.PageSize = 3
+	tags, err := s.registry("mellon").ListTags("anduin/elrond")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), expectedTags, tags)
+	pages := 0
+	for _, request := range s.server.Requests() {
+		if request == "GET /v2/anduin/elrond/tags/list" {
+			pages++
+		}
+	}
+	require.Equal(s.T(), 3, pages)
+}
+
+func (s *RegistryTestSuite) TestNextPageURL() {
+	next, err := nextPageURL("https://gcr.io/v2/anduin/elrond/tags/list?n=2", `</v2/anduin/elrond/tags/list?n=2&last=b>; rel="next"`)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "https://gcr.io/v2/anduin/elrond/tags/list?n=2&last=b", next)
+	next, err = nextPageURL("https://gcr.io/v2/anduin/elrond/tags/list?n=2", "")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "", next)
+}
+
+func (s *RegistryTestSuite) TestRegistryURL() {
+	for registry, expected := range map[string]string{
+		"":                     DefaultRegistry,
+		"https://gcr.io/v2/":   "https://gcr.io",
+		"harbor.corp":          "https://harbor.corp",
+		"http://10.0.0.1:5000": "http://10.0.0.1:5000",
+	} {
+		r, err := newOCIRegistry(&DockerCredential{Registry: registry}, registryTokens)
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), expected, r.registryURL())
+	}
+}
+
+func (s *RegistryTestSuite) TestImageLabels() {
+	labels, err := s.registry("mellon").ImageLabels("anduin/elrond", "1.0")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), map[string]string{"team": "rivendell"}, labels)
+}
+
+func (s *RegistryTestSuite) TestFindMatchingTags() {
+	s.server.PutImage("anduin/elrond", "2.0", map[string]string{"team": "lothlorien"})
+	s.server.PutImage("anduin/elrond", "2.1", map[string]string{"team": "mirkwood"})
+	s.server.PutImage("anduin/elrond", "stable", map[string]string{"team": "lothlorien"})
+	latestDigest := s.server.PutImage("anduin/elrond", "latest", map[string]string{"team": "mirkwood"})
+	// Without the manifest map, every tag is checked with a HEAD request
+	expectedHeads := map[bool]int{false: 3*5 + 1, true: 3 + 1}
+	for _, manifestTagList := range []bool{false, true} {
+		s.server.ManifestTagList = manifestTagList
+		requestCount := len(s.server.Requests())
+		digest, tags, err := s.registry("mellon").FindMatchingTags("anduin/elrond", "latest")
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), latestDigest, digest)
+		require.Equal(s.T(), []string{"2.1"}, tags)
+		_, tags, err = s.registry("mellon").FindMatchingTags("anduin/elrond", "stable")
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), []string{"2.0"}, tags)
+		_, tags, err = s.registry("mellon").FindMatchingTags("anduin/elrond", "1.0")
+		require.Nil(s.T(), err)
+		require.Empty(s.T(), tags)
+		_, _, err = s.registry("mellon").FindMatchingTags("anduin/elrond", "3.0")
+		require.NotNil(s.T(), err, "missing reference must be an error")
+		heads := 0
+		for _, request := range s.server.Requests()[requestCount:] {
+			if strings.HasPrefix(request, "HEAD ") {
+				heads++
+			}
+		}
+		require.Equal(s.T(), expectedHeads[manifestTagList], heads)
+	}
+}
+
+func (s *RegistryTestSuite) TestInvalidCredential() {
+	_, _, err := s.registry("speak friend").TagExists("anduin/elrond", "1.0")
+	require.NotNil(s.T(), err)
+}
+
+func TestRegistry(t *testing.T) {
+	suite.Run(t, new(RegistryTestSuite))
+}
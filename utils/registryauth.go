@@ -0,0 +1,407 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// authChallenge is a challenge of a WWW-Authenticate header, like
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+type authChallenge struct {
+	scheme string
+	// params holds the auth params by lower case name
+	params map[string]string
+	// token68 is set for challenges without params
+	token68 string
+}
+
+func (c *authChallenge) isScheme(scheme string) bool {
+	return strings.EqualFold(c.scheme, scheme)
+}
+
+// parseAuthChallenges parses the values of WWW-Authenticate headers as
+// described in RFC 7235: a comma separated list of challenges, each made of a
+// scheme followed by a token68 or a comma separated list of params whose
+// values are tokens or quoted strings
+func parseAuthChallenges(values []string) ([]*authChallenge, error) {
+	p := &challengeParser{input: strings.Join(values, ", ")}
+	challenges := []*authChallenge{}
+	for {
+		p.skip(" \t,")
+		if p.done() {
+			return challenges, nil
+		}
+		scheme := p.token()
+		if scheme == "" {
+			return nil, p.invalid()
+		}
+		challenge := &authChallenge{scheme: scheme, params: make(map[string]string)}
+		challenges = append(challenges, challenge)
+		if p.skip(" \t") == 0 {
+			continue
+		}
+		err := p.params(challenge)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+type challengeParser struct {
+	input string
+	pos   int
+}
+
+const (
+	challengeTokenChars   = "!#$%&'*+-.^_`|~"
+	challengeToken68Chars = "-._~+/"
+)
+
+func (p *challengeParser) done() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *challengeParser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *challengeParser) invalid() error {
+	return stacktrace.NewError("Invalid WWW-Authenticate header %q at position %d", p.input, p.pos)
+}
+
+// skip skips the given characters and returns how many were skipped
+func (p *challengeParser) skip(chars string) int {
+	start := p.pos
+	for !p.done() && strings.IndexByte(chars, p.peek()) >= 0 {
+		p.pos++
+	}
+	return p.pos - start
+}
+
+func isAlphaNumeric(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+func (p *challengeParser) token() string {
+	start := p.pos
+	for !p.done() && (isAlphaNumeric(p.peek()) || strings.IndexByte(challengeTokenChars, p.peek()) >= 0) {
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+func (p *challengeParser) token68() string {
+	start := p.pos
+	for !p.done() && (isAlphaNumeric(p.peek()) || strings.IndexByte(challengeToken68Chars, p.peek()) >= 0) {
+		p.pos++
+	}
+	p.skip("=")
+	return p.input[start:p.pos]
+}
+
+func (p *challengeParser) quotedString() (string, error) {
+	p.pos++
+	value := &strings.Builder{}
+	for !p.done() {
+		c := p.peek()
+		p.pos++
+		switch c {
+		case '"':
+			return value.String(), nil
+		case '\\':
+			if p.done() {
+				return "", p.invalid()
+			}
+			value.WriteByte(p.peek())
+			p.pos++
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return "", p.invalid()
+}
+
+// params reads the token68 or the params of a challenge, stopping before the
+// scheme of the next challenge
+func (p *challengeParser) params(challenge *authChallenge) error {
+	first := true
+	for {
+		start := p.pos
+		name := p.token()
+		p.skip(" \t")
+		if name == "" || p.peek() != '=' {
+			p.pos = start
+			if first {
+				challenge.token68 = p.token68()
+			}
+			return nil
+		}
+		p.pos++
+		p.skip(" \t")
+		switch c := p.peek(); {
+		case c == '"':
+			value, err := p.quotedString()
+			if err != nil {
+				return err
+			}
+			challenge.params[strings.ToLower(name)] = value
+		case isAlphaNumeric(c) || strings.IndexByte(challengeTokenChars, c) >= 0:
+			challenge.params[strings.ToLower(name)] = p.token()
+		case first:
+			// A param value cannot be empty, this is a token68 ending with =
+			p.pos = start
+			challenge.token68 = p.token68()
+			return nil
+		default:
+			return p.invalid()
+		}
+		first = false
+		p.skip(" \t")
+		if p.done() {
+			return nil
+		}
+		if p.peek() != ',' {
+			return p.invalid()
+		}
+		p.skip(" \t,")
+	}
+}
+
+// tokenExpiryMargin is subtracted from the lifetime of tokens so that they do
+// not expire while being used
+const tokenExpiryMargin = 5 * time.Second
+
+// defaultTokenLifetime is the lifetime of tokens without expires_in, as
+// defined by the docker token authentication spec
+const defaultTokenLifetime = 60 * time.Second
+
+// tokenCache holds registry tokens until they expire
+type tokenCache struct {
+	now    func() time.Time
+	lock   sync.Mutex
+	tokens map[string]*cachedToken
+}
+
+type cachedToken struct {
+	token   string
+	expires time.Time
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{
+		now:    time.Now,
+		tokens: make(map[string]*cachedToken),
+	}
+}
+
+// registryTokens is shared by all registry clients, so that a token is only
+// requested once per registry and scope
+var registryTokens = newTokenCache()
+
+func (c *tokenCache) get(key string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cached, ok := c.tokens[key]
+	if !ok || !c.now().Before(cached.expires) {
+		return "", false
+	}
+	return cached.token, true
+}
+
+func (c *tokenCache) put(key, token string, lifetime time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if lifetime > 2*tokenExpiryMargin {
+		lifetime -= tokenExpiryMargin
+	}
+	c.tokens[key] = &cachedToken{
+		token:   token,
+		expires: c.now().Add(lifetime),
+	}
+}
+
+// tokenClientID identifies doriath to OAuth2 token servers
+const tokenClientID = "doriath"
+
+type tokenResponse struct {
+	Token        string `json:"token"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// authorization returns the Authorization header of requests on a
+// repository, requesting a token when needed. challenge is the challenge of
+// the registry, scopes default to pulling the repository.
+func (r *ociRegistry) authorization(repository string, challenge *authChallenge, scopes []string, refresh bool) (string, error) {
+	credential := r.credential
+	if credential.HTTPToken != "" {
+		authType := "Basic"
+		if credential.ChallengeType != "" {
+			authType = credential.ChallengeType
+		}
+		return authType + " " + credential.HTTPToken, nil
+	}
+	if challenge == nil {
+		return "", nil
+	}
+	username, password, err := credential.BasicAuth()
+	if err != nil {
+		return "", err
+	}
+	if challenge.isScheme("Basic") {
+		if username == "" && password == "" {
+			return "", nil
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)), nil
+	}
+	if !challenge.isScheme("Bearer") {
+		return "", stacktrace.NewError("Unsupported authentication scheme %q for %s", challenge.scheme, r.registryURL())
+	}
+	if len(scopes) == 0 {
+		scopes = []string{"repository:" + repository + ":pull"}
+	}
+	identity := HashStrings(username, password, credential.IdentityToken)
+	key := HashStrings(append([]string{challenge.params["realm"], challenge.params["service"], identity}, scopes...)...)
+	if !refresh {
+		if token, ok := r.tokens.get(key); ok {
+			return "Bearer " + token, nil
+		}
+	}
+	response, err := r.requestToken(challenge, scopes, username, password)
+	if err != nil {
+		return "", err
+	}
+	token := response.Token
+	if token == "" {
+		token = response.AccessToken
+	}
+	if token == "" {
+		return "", stacktrace.NewError("Empty token from %s", challenge.params["realm"])
+	}
+	lifetime := defaultTokenLifetime
+	if response.ExpiresIn > 0 {
+		lifetime = time.Duration(response.ExpiresIn) * time.Second
+	}
+	r.tokens.put(key, token, lifetime)
+	return "Bearer " + token, nil
+}
+
+// requestToken requests a token to the realm of a challenge. With a refresh
+// token, the token is requested with an OAuth2 POST request, otherwise with a
+// GET request using the credential as basic authentication, asking for a
+// refresh token used for the next requests, unless the credential has a
+// provider refreshing it. Like the docker client, a failed POST request falls
+// back to the GET request, and refresh tokens are not asked for anymore.
+func (r *ociRegistry) requestToken(challenge *authChallenge, scopes []string, username, password string) (*tokenResponse, error) {
+	realm := challenge.params["realm"]
+	if realm == "" {
+		return nil, stacktrace.NewError("Missing realm in authentication challenge of %s", r.registryURL())
+	}
+	realmURL, err := url.Parse(realm)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "Invalid realm %q", realm)
+	}
+	var response *registryResponse
+	if r.refreshToken != "" {
+		response, err = r.roundTrip(func() (*http.Request, error) {
+			form := url.Values{}
+			form.Set("grant_type", "refresh_token")
+			form.Set("refresh_token", r.refreshToken)
+			form.Set("client_id", tokenClientID)
+			form.Set("scope", strings.Join(scopes, " "))
+			if service := challenge.params["service"]; service != "" {
+				form.Set("service", service)
+			}
+			request, err := http.NewRequest("POST", realmURL.String(), strings.NewReader(form.Encode()))
+			if err != nil {
+				return nil, stacktrace.Propagate(err, "Cannot create token request %s", realm)
+			}
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return request, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if response.statusCode < 200 || response.statusCode >= 300 {
+			r.refreshToken = ""
+			r.noRefreshToken = true
+			response = nil
+		}
+	}
+	if response == nil {
+		response, err = r.roundTrip(func() (*http.Request, error) {
+			query := realmURL.Query()
+			if service := challenge.params["service"]; service != "" {
+				query.Set("service", service)
+			}
+			for _, scope := range scopes {
+				query.Add("scope", scope)
+			}
+			if username != "" && r.credential.Provider == nil && !r.noRefreshToken {
+				query.Set("offline_token", "true")
+				query.Set("client_id", tokenClientID)
+			}
+			tokenURL := *realmURL
+			tokenURL.RawQuery = query.Encode()
+			request, err := http.NewRequest("GET", tokenURL.String(), nil)
+			if err != nil {
+				return nil, stacktrace.Propagate(err, "Cannot create token request %s", realm)
+			}
+			if username != "" || password != "" {
+				request.SetBasicAuth(username, password)
+			}
+			return request, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if response.statusCode != http.StatusOK {
+		return nil, stacktrace.NewError("Unexpected status code %d, response body is %s", response.statusCode, string(response.body))
+	}
+	responseContent := response.body
+	tokenJSON := &tokenResponse{}
+	err = json.Unmarshal(responseContent, tokenJSON)
+	if err != nil {
+		// The body is not printed, it may hold tokens
+		return nil, stacktrace.Propagate(err, "Cannot parse token response of %s", realm)
+	}
+	AddSecret(tokenJSON.Token, tokenJSON.AccessToken, tokenJSON.RefreshToken)
+	if tokenJSON.RefreshToken != "" {
+		r.refreshToken = tokenJSON.RefreshToken
+	}
+	return tokenJSON, nil
+}
+
+// registryChallenge picks the challenge used to authenticate, preferring
+// Bearer over Basic
+func registryChallenge(header http.Header) (*authChallenge, error) {
+	challenges, err := parseAuthChallenges(header.Values("Www-Authenticate"))
+	if err != nil {
+		return nil, err
+	}
+	var found *authChallenge
+	for _, challenge := range challenges {
+		if challenge.isScheme("Bearer") {
+			return challenge, nil
+		}
+		if challenge.isScheme("Basic") {
+			found = challenge
+		}
+	}
+	if found == nil {
+		return nil, stacktrace.NewError("No supported authentication challenge in %q", header.Values("Www-Authenticate"))
+	}
+	return found, nil
+}
@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anduintransaction/doriath/utils/registrytest"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type RegistryAuthTestSuite struct {
+	suite.Suite
+	server *registrytest.Registry
+	tokens *tokenCache
+	now    time.Time
+}
+
+func (s *RegistryAuthTestSuite) SetupTest() {
+	s.server = registrytest.NewRegistry()
+	s.server.Username = "frodo"
+	s.server.Password = "mellon"
+	s.server.PutImage("anduin/elrond", "1.0", nil)
+	s.now = time.Date(2019, 3, 14, 0, 0, 0, 0, time.UTC)
+	s.tokens = newTokenCache()
+	s.tokens.now = func() time.Time {
+		return s.now
+	}
+}
+
+func (s *RegistryAuthTestSuite) TearDownTest() {
+	s.server.Close()
+}
+
+func (s *RegistryAuthTestSuite) registry(credential *DockerCredential) *ociRegistry {
+	registry, err := newOCIRegistry(credential, s.tokens)
+	require.Nil(s.T(), err)
+	return registry
+}
+
+func (s *RegistryAuthTestSuite) requireTagExists(registry Registry) {
+	exists, _, err := registry.TagExists("anduin/elrond", "1.0")
+	require.Nil(s.T(), err)
+	require.True(s.T(), exists)
+}
+
+func (s *RegistryAuthTestSuite) TestParseAuthChallenges() {
+	testCases := []struct {
+		header   []string
+		expected []*authChallenge
+	}{
+		{
+			header: []string{`Bearer realm="https://auth.example.com/token?a=b,c",service="registry.example.com",scope="repository:a:pull repository:b:pull"`},
+			expected: []*authChallenge{
+				{scheme: "Bearer", params: map[string]string{
+					"realm":   "https://auth.example.com/token?a=b,c",
+					"service": "registry.example.com",
+					"scope":   "repository:a:pull repository:b:pull",
+				}},
+			},
+		},
+		{
+			header: []string{`Newauth realm="apps", type=1, title="Login to \"apps\"", Basic REALM="simple, realm"`},
+			expected: []*authChallenge{
+				{scheme: "Newauth", params: map[string]string{"realm": "apps", "type": "1", "title": `Login to "apps"`}},
+				{scheme: "Basic", params: map[string]string{"realm": "simple, realm"}},
+			},
+		},
+		{
+			header: []string{"Negotiate YIIB3gYGKwYBBQUCoII=", `Basic realm="registry"`, "Anonymous"},
+			expected: []*authChallenge{
+				{scheme: "Negotiate", params: map[string]string{}, token68: "YIIB3gYGKwYBBQUCoII="},
+				{scheme: "Basic", params: map[string]string{"realm": "registry"}},
+				{scheme: "Anonymous", params: map[string]string{}},
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		challenges, err := parseAuthChallenges(testCase.header)
+		require.Nil(s.T(), err, "%q must be parsed", testCase.header)
+		require.Equal(s.T(), testCase.expected, challenges)
+	}
+	for _, header := range []string{`Bearer realm="unterminated`, `Bearer realm=a b`, `="value"`} {
+		_, err := parseAuthChallenges([]string{header})
+		require.NotNil(s.T(), err, "%q must be invalid", header)
+	}
+}
+
+func (s *RegistryAuthTestSuite) TestTokenCache() {
+	s.server.TokenExpiresIn = 120
+	registry := s.registry(&DockerCredential{Registry: s.server.URL, Username: "frodo", Password: "mellon"})
+	s.requireTagExists(registry)
+	s.requireTagExists(registry)
+	_, err := registry.ImageLabels("anduin/elrond", "1.0")
+	require.Nil(s.T(), err)
+	other := s.registry(&DockerCredential{Registry: s.server.URL, Username: "frodo", Password: "mellon"})
+	s.requireTagExists(other)
+	require.Equal(s.T(), []string{"GET basic repository:anduin/elrond:pull"}, s.server.TokenRequests(), "token must be cached")
+
+	s.now = s.now.Add(2 * time.Minute)
+	s.requireTagExists(registry)
+	require.Equal(s.T(), []string{
+		"GET basic repository:anduin/elrond:pull",
+		"POST refresh_token repository:anduin/elrond:pull",
+	}, s.server.TokenRequests(), "expired token must be refreshed with the refresh token")
+}
+
+func (s *RegistryAuthTestSuite) TestRefreshTokenFallback() {
+	s.server.NoOAuth2 = true
+	s.server.PutImage("anduin/arwen", "1.0", nil)
+	s.server.PutImage("anduin/gimli", "1.0", nil)
+	registry := s.registry(&DockerCredential{Registry: s.server.URL, Username: "frodo", Password: "mellon"})
+	for _, repository := range []string{"anduin/elrond", "anduin/arwen", "anduin/gimli"} {
+		exists, _, err := registry.TagExists(repository, "1.0")
+		require.Nil(s.T(), err, "tokens must be requested with GET when the POST request fails")
+		require.True(s.T(), exists)
+	}
+	require.Equal(s.T(), []string{
+		"GET basic repository:anduin/elrond:pull",
+		"POST unsupported",
+		"GET basic repository:anduin/arwen:pull",
+		"GET basic repository:anduin/gimli:pull",
+	}, s.server.TokenRequests(), "refresh tokens must not be used after a failed POST request")
+}
+
+func (s *RegistryAuthTestSuite) TestIdentityToken() {
+	registry := s.registry(&DockerCredential{Registry: s.server.URL, IdentityToken: s.server.RefreshToken()})
+	s.requireTagExists(registry)
+	require.Equal(s.T(), []string{"POST refresh_token repository:anduin/elrond:pull"}, s.server.TokenRequests())
+}
+
+func (s *RegistryAuthTestSuite) TestBasicAuth() {
+	s.server.BasicAuth = true
+	s.requireTagExists(s.registry(&DockerCredential{Registry: s.server.URL, Username: "frodo", Password: "mellon"}))
+	require.Empty(s.T(), s.server.TokenRequests())
+	_, _, err := s.registry(&DockerCredential{Registry: s.server.URL, Username: "frodo", Password: "friend"}).TagExists("anduin/elrond", "1.0")
+	require.NotNil(s.T(), err)
+}
+
+func TestRegistryAuth(t *testing.T) {
+	suite.Run(t, new(RegistryAuthTestSuite))
+}
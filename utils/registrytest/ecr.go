@@ -0,0 +1,100 @@
+package registrytest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ECR is a fake AWS ECR API serving GetAuthorizationToken requests
+type ECR struct {
+	// URL is the endpoint of the API
+	URL string
+	// AccessKeyID is the key which must sign requests
+	AccessKeyID string
+	// Username and Password are returned in authorization tokens
+	Username string
+	Password string
+	// ExpiresIn is the lifetime of authorization tokens
+	ExpiresIn time.Duration
+
+	server   *httptest.Server
+	lock     sync.Mutex
+	requests []string
+}
+
+// NewECR starts a new ECR API, which must be closed after use. Tokens are
+// valid for 12 hours like ECR ones.
+func NewECR(accessKeyID, username, password string) *ECR {
+	e := &ECR{
+		AccessKeyID: accessKeyID,
+		Username:    username,
+		Password:    password,
+		ExpiresIn:   12 * time.Hour,
+	}
+	e.server = httptest.NewServer(http.HandlerFunc(e.serveHTTP))
+	e.URL = e.server.URL
+	return e
+}
+
+// Close stops the API
+func (e *ECR) Close() {
+	e.server.Close()
+}
+
+// Requests returns the registry IDs of every authorized request
+func (e *ECR) Requests() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]string{}, e.requests...)
+}
+
+func (e *ECR) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" || req.Header.Get("X-Amz-Target") != "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken" {
+		e.error(w, http.StatusBadRequest, "UnknownOperationException", "unknown operation")
+		return
+	}
+	authorization := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential="+e.AccessKeyID+"/") || !strings.Contains(authorization, "/ecr/aws4_request") {
+		e.error(w, http.StatusForbidden, "UnrecognizedClientException", "The security token included in the request is invalid.")
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		e.error(w, http.StatusBadRequest, "SerializationException", err.Error())
+		return
+	}
+	var request struct {
+		RegistryIDs []string `json:"registryIds"`
+	}
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		e.error(w, http.StatusBadRequest, "SerializationException", err.Error())
+		return
+	}
+	e.lock.Lock()
+	e.requests = append(e.requests, strings.Join(request.RegistryIDs, ","))
+	e.lock.Unlock()
+	data := []map[string]interface{}{}
+	for _, registryID := range request.RegistryIDs {
+		data = append(data, map[string]interface{}{
+			"authorizationToken": base64.StdEncoding.EncodeToString([]byte(e.Username + ":" + e.Password)),
+			"expiresAt":          float64(time.Now().Add(e.ExpiresIn).UnixNano()) / float64(time.Second),
+			"proxyEndpoint":      fmt.Sprintf("https://%s.dkr.ecr.us-east-1.amazonaws.com", registryID),
+		})
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(map[string]interface{}{"authorizationData": data})
+}
+
+func (e *ECR) error(w http.ResponseWriter, statusCode int, errorType, message string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]string{"__type": errorType, "message": message})
+}
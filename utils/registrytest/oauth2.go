@@ -0,0 +1,129 @@
+package registrytest
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// OAuth2 is a fake OAuth2 token endpoint granting AccessToken to JWT bearer
+// assertions signed with PublicKey, like the Google one, and to client
+// credentials at /{tenant}/oauth2/v2.0/token, like the Azure AD one
+type OAuth2 struct {
+	// URL is the endpoint of the server
+	URL string
+	// PublicKey verifies JWT bearer assertions, which are refused when nil
+	PublicKey *rsa.PublicKey
+	// ClientID and ClientSecret are the client credentials, which are refused
+	// when empty
+	ClientID     string
+	ClientSecret string
+	// AccessToken is the token granted
+	AccessToken string
+	// ExpiresIn is the lifetime of tokens in seconds
+	ExpiresIn int64
+
+	server   *httptest.Server
+	lock     sync.Mutex
+	requests []string
+}
+
+// NewOAuth2 starts a new token endpoint, which must be closed after use.
+// Tokens are valid for an hour.
+func NewOAuth2(accessToken string) *OAuth2 {
+	o := &OAuth2{
+		AccessToken: accessToken,
+		ExpiresIn:   3600,
+	}
+	o.server = httptest.NewServer(http.HandlerFunc(o.serveHTTP))
+	o.URL = o.server.URL
+	return o
+}
+
+// Close stops the server
+func (o *OAuth2) Close() {
+	o.server.Close()
+}
+
+// Requests returns the path and grant type of every request
+func (o *OAuth2) Requests() []string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return append([]string{}, o.requests...)
+}
+
+func (o *OAuth2) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		o.error(w, "invalid_request", "POST only")
+		return
+	}
+	req.ParseForm()
+	grantType := req.PostForm.Get("grant_type")
+	o.lock.Lock()
+	o.requests = append(o.requests, req.URL.Path+" "+grantType)
+	o.lock.Unlock()
+	switch grantType {
+	case "urn:ietf:params:oauth:grant-type:jwt-bearer":
+		if !o.verifyAssertion(req.PostForm.Get("assertion"), o.URL+req.URL.Path) {
+			o.error(w, "invalid_grant", "Invalid JWT Signature.")
+			return
+		}
+	case "client_credentials":
+		segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+		if len(segments) != 4 || segments[1] != "oauth2" || segments[3] != "token" {
+			o.error(w, "invalid_request", "unknown tenant endpoint")
+			return
+		}
+		if o.ClientID == "" || req.PostForm.Get("client_id") != o.ClientID || req.PostForm.Get("client_secret") != o.ClientSecret {
+			o.error(w, "invalid_client", "Invalid client secret provided.")
+			return
+		}
+	default:
+		o.error(w, "unsupported_grant_type", "unsupported grant type "+grantType)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": o.AccessToken,
+		"token_type":   "Bearer",
+		"expires_in":   o.ExpiresIn,
+	})
+}
+
+// verifyAssertion checks the RS256 signature and the audience of a JWT
+func (o *OAuth2) verifyAssertion(assertion, audience string) bool {
+	if o.PublicKey == nil {
+		return false
+	}
+	segments := strings.Split(assertion, ".")
+	if len(segments) != 3 {
+		return false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(segments[2])
+	if err != nil {
+		return false
+	}
+	digest := sha256.Sum256([]byte(segments[0] + "." + segments[1]))
+	if rsa.VerifyPKCS1v15(o.PublicKey, crypto.SHA256, digest[:], signature) != nil {
+		return false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(segments[1])
+	if err != nil {
+		return false
+	}
+	var claims struct {
+		Aud string `json:"aud"`
+	}
+	return json.Unmarshal(payload, &claims) == nil && claims.Aud == audience
+}
+
+func (o *OAuth2) error(w http.ResponseWriter, errorType, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": errorType, "error_description": description})
+}
@@ -0,0 +1,446 @@
+// Package registrytest provides an in-memory docker registry for tests
+package registrytest
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Media types served by the registry
+const (
+	MediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+)
+
+// Registry is an in-memory registry implementing the read part of the OCI
+// distribution API with a token authentication
+type Registry struct {
+	// URL is the base URL of the registry, like http://127.0.0.1:1234
+	URL string
+	// Username and Password are required by the token endpoint when not empty
+	Username string
+	Password string
+	// BasicAuth makes the registry challenge requests with the Basic scheme
+	// and check Username and Password itself instead of using tokens
+	BasicAuth bool
+	// TokenExpiresIn is sent as expires_in in token responses when not zero
+	TokenExpiresIn int
+	// ManifestTagList adds the manifest map of gcr.io to the tag list, giving
+	// the tags of every manifest digest
+	ManifestTagList bool
+	// Latency delays every response of the registry
+	Latency time.Duration
+	// PageSize is the maximum number of tags in a page of the tag list, zero
+	// means no limit
+	PageSize int
+	// NoOAuth2 makes the token endpoint answer OAuth2 POST requests with 404
+	// while still granting refresh tokens, like registries only supporting
+	// GET token requests
+	NoOAuth2 bool
+	// ExchangeToken is the Azure AD access or refresh token exchanged for
+	// Password at /oauth2/exchange, like ACR does
+	ExchangeToken string
+
+	server *httptest.Server
+	lock   sync.Mutex
+	// tags maps a repository to its tags and their manifest digest
+	tags  map[string]map[string]string
+	blobs map[string][]byte
+	// requests holds "METHOD path" of every authorized request
+	requests []string
+	// tokenRequests holds "METHOD grant scopes" of every token request
+	tokenRequests []string
+	// failures are the responses sent instead of the next requests
+	failures []failure
+}
+
+type failure struct {
+	statusCode int
+	retryAfter string
+}
+
+// NewRegistry starts a new registry, which must be closed after use
+func NewRegistry() *Registry {
+	r := newRegistry()
+	r.server.Start()
+	r.URL = r.server.URL
+	return r
+}
+
+// NewTLSRegistry starts a new registry served over HTTPS with a self-signed
+// certificate. When clientCAs is set, clients must present a certificate
+// signed by one of them.
+func NewTLSRegistry(clientCAs *x509.CertPool) *Registry {
+	r := newRegistry()
+	if clientCAs != nil {
+		r.server.TLS = &tls.Config{
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientCAs:  clientCAs,
+		}
+	}
+	r.server.StartTLS()
+	r.URL = r.server.URL
+	return r
+}
+
+func newRegistry() *Registry {
+	r := &Registry{
+		tags:  make(map[string]map[string]string),
+		blobs: make(map[string][]byte),
+	}
+	r.server = httptest.NewUnstartedServer(http.HandlerFunc(r.serveHTTP))
+	return r
+}
+
+// CACertificate returns the PEM certificate of a TLS registry
+func (r *Registry) CACertificate() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: r.server.Certificate().Raw})
+}
+
+// Close stops the registry
+func (r *Registry) Close() {
+	r.server.Close()
+}
+
+// Host returns the host and port of the registry, used as image name prefix
+func (r *Registry) Host() string {
+	return strings.TrimPrefix(strings.TrimPrefix(r.URL, "http://"), "https://")
+}
+
+// PutImage adds an image with the given labels and returns its manifest digest
+func (r *Registry) PutImage(repository, tag string, labels map[string]string) string {
+	config := map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config":       map[string]interface{}{"Labels": labels},
+	}
+	configContent, _ := json.Marshal(config)
+	manifest := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     MediaTypeManifest,
+		"config": map[string]interface{}{
+			"mediaType": MediaTypeConfig,
+			"digest":    digest(configContent),
+			"size":      len(configContent),
+		},
+		"layers": []interface{}{},
+	}
+	manifestContent, _ := json.Marshal(manifest)
+	manifestDigest := digest(manifestContent)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.blobs[digest(configContent)] = configContent
+	r.blobs[manifestDigest] = manifestContent
+	if r.tags[repository] == nil {
+		r.tags[repository] = make(map[string]string)
+	}
+	r.tags[repository][tag] = manifestDigest
+	return manifestDigest
+}
+
+// Requests returns "METHOD path" of the authorized requests received so far
+func (r *Registry) Requests() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string{}, r.requests...)
+}
+
+// TokenRequests returns "METHOD grant scopes" of the token requests received
+// so far, the grant being basic or anonymous for GET requests
+func (r *Registry) TokenRequests() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string{}, r.tokenRequests...)
+}
+
+// FailNext makes the next count requests fail with a status, setting the
+// Retry-After header when retryAfter is not empty
+func (r *Registry) FailNext(count, statusCode int, retryAfter string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i := 0; i < count; i++ {
+		r.failures = append(r.failures, failure{statusCode, retryAfter})
+	}
+}
+
+// RefreshToken returns the refresh token granted to Username
+func (r *Registry) RefreshToken() string {
+	return "refresh-" + r.Username
+}
+
+func digest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (r *Registry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	time.Sleep(r.Latency)
+	r.lock.Lock()
+	if len(r.failures) > 0 {
+		failure := r.failures[0]
+		r.failures = r.failures[1:]
+		r.lock.Unlock()
+		if failure.retryAfter != "" {
+			w.Header().Set("Retry-After", failure.retryAfter)
+		}
+		writeError(w, failure.statusCode, "UNAVAILABLE", "service unavailable")
+		return
+	}
+	r.lock.Unlock()
+	if req.URL.Path == "/token" {
+		r.serveToken(w, req)
+		return
+	}
+	if req.URL.Path == "/oauth2/exchange" {
+		r.serveExchange(w, req)
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !strings.HasPrefix(req.URL.Path, "/v2/") {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "page not found")
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	repository, action, reference := splitPath(path)
+	if !r.authorized(req, repository) {
+		w.Header().Set("WWW-Authenticate", r.challenge(repository))
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+		return
+	}
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+	switch action {
+	case "":
+		w.WriteHeader(http.StatusOK)
+	case "tags":
+		r.serveTags(w, req, repository)
+	case "manifests":
+		r.serveManifest(w, req, repository, reference)
+	case "blobs":
+		r.serveBlob(w, req, reference)
+	default:
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "page not found")
+	}
+}
+
+// splitPath splits name/manifests/reference, name/blobs/digest and
+// name/tags/list
+func splitPath(path string) (string, string, string) {
+	for _, action := range []string{"manifests", "blobs", "tags"} {
+		idx := strings.LastIndex(path, "/"+action+"/")
+		if idx >= 0 {
+			return path[:idx], action, path[idx+len(action)+2:]
+		}
+	}
+	return "", "", ""
+}
+
+// authorized checks the Authorization header of a request, setting the
+// WWW-Authenticate header when it is not valid. The realm of the challenge
+// contains a comma, which clients must handle.
+func (r *Registry) authorized(req *http.Request, repository string) bool {
+	if r.BasicAuth {
+		username, password, ok := req.BasicAuth()
+		if ok && username == r.Username && password == r.Password {
+			return true
+		}
+		return false
+	}
+	return req.Header.Get("Authorization") == "Bearer "+r.token(repository)
+}
+
+// challenge returns the WWW-Authenticate header of a repository
+func (r *Registry) challenge(repository string) string {
+	if r.BasicAuth {
+		return `Basic realm="registrytest, basic"`
+	}
+	scope := ""
+	if repository != "" {
+		scope = fmt.Sprintf(",scope=\"repository:%s:pull\"", repository)
+	}
+	return fmt.Sprintf("Bearer realm=\"%s/token?issuer=registry,test\",service=\"registrytest\"%s", r.URL, scope)
+}
+
+// token returns the token granted for a repository
+func (r *Registry) token(repository string) string {
+	return "token-" + repository
+}
+
+// serveToken grants tokens with a GET request authenticated with Username
+// and Password, or with an OAuth2 POST request using the password or the
+// refresh token grant
+func (r *Registry) serveToken(w http.ResponseWriter, req *http.Request) {
+	var scopes []string
+	var grant string
+	var authenticated bool
+	switch req.Method {
+	case "GET":
+		scopes = req.URL.Query()["scope"]
+		username, password, ok := req.BasicAuth()
+		grant = "anonymous"
+		if ok {
+			grant = "basic"
+		}
+		authenticated = (r.Username == "" && r.Password == "") || (username == r.Username && password == r.Password)
+	case "POST":
+		if r.NoOAuth2 {
+			r.lock.Lock()
+			r.tokenRequests = append(r.tokenRequests, "POST unsupported")
+			r.lock.Unlock()
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "page not found")
+			return
+		}
+		req.ParseForm()
+		scopes = strings.Fields(req.PostForm.Get("scope"))
+		grant = req.PostForm.Get("grant_type")
+		switch grant {
+		case "password":
+			authenticated = req.PostForm.Get("username") == r.Username && req.PostForm.Get("password") == r.Password
+		case "refresh_token":
+			authenticated = req.PostForm.Get("refresh_token") == r.RefreshToken()
+		}
+	}
+	r.lock.Lock()
+	r.tokenRequests = append(r.tokenRequests, req.Method+" "+grant+" "+strings.Join(scopes, " "))
+	r.lock.Unlock()
+	if !authenticated {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid credential")
+		return
+	}
+	repository := ""
+	if len(scopes) > 0 {
+		segments := strings.Split(scopes[0], ":")
+		if len(segments) == 3 {
+			repository = segments[1]
+		}
+	}
+	response := map[string]interface{}{}
+	if req.Method == "GET" {
+		response["token"] = r.token(repository)
+	} else {
+		response["access_token"] = r.token(repository)
+	}
+	if r.TokenExpiresIn != 0 {
+		response["expires_in"] = r.TokenExpiresIn
+	}
+	if r.Username != "" && (req.Method == "POST" || req.URL.Query().Get("offline_token") == "true") {
+		response["refresh_token"] = r.RefreshToken()
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// serveExchange exchanges ExchangeToken for Password, given with the
+// access_token or the refresh_token grant
+func (r *Registry) serveExchange(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	token := ""
+	switch req.PostForm.Get("grant_type") {
+	case "access_token":
+		token = req.PostForm.Get("access_token")
+	case "refresh_token":
+		token = req.PostForm.Get("refresh_token")
+	}
+	r.lock.Lock()
+	r.tokenRequests = append(r.tokenRequests, req.Method+" exchange "+req.PostForm.Get("grant_type"))
+	r.lock.Unlock()
+	if req.Method != "POST" || r.ExchangeToken == "" || token != r.ExchangeToken || req.PostForm.Get("service") != r.Host() {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "invalid token"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"refresh_token": r.Password})
+}
+
+// serveTags serves the tag list, paginated with the n and last parameters
+func (r *Registry) serveTags(w http.ResponseWriter, req *http.Request, repository string) {
+	tags, ok := r.tags[repository]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository name not known to registry")
+		return
+	}
+	tagList := []string{}
+	last := req.URL.Query().Get("last")
+	for tag := range tags {
+		if tag > last {
+			tagList = append(tagList, tag)
+		}
+	}
+	sort.Strings(tagList)
+	n := len(tagList)
+	if value := req.URL.Query().Get("n"); value != "" {
+		n, _ = strconv.Atoi(value)
+		if r.PageSize > 0 && n > r.PageSize {
+			n = r.PageSize
+		}
+	}
+	if n < len(tagList) {
+		tagList = tagList[:n]
+		next := url.Values{"n": {strconv.Itoa(n)}, "last": {tagList[n-1]}}
+		w.Header().Set("Link", fmt.Sprintf("</v2/%s/tags/list?%s>; rel=\"next\"", repository, next.Encode()))
+	}
+	response := map[string]interface{}{"name": repository, "tags": tagList}
+	if r.ManifestTagList {
+		manifests := make(map[string]map[string][]string)
+		for _, tag := range tagList {
+			if manifests[tags[tag]] == nil {
+				manifests[tags[tag]] = map[string][]string{"tag": {}}
+			}
+			manifests[tags[tag]]["tag"] = append(manifests[tags[tag]]["tag"], tag)
+		}
+		response["manifest"] = manifests
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, repository, reference string) {
+	manifestDigest := reference
+	if !strings.HasPrefix(reference, "sha256:") {
+		manifestDigest = r.tags[repository][reference]
+	}
+	content, ok := r.blobs[manifestDigest]
+	// Like real registries, a manifest whose media type is not accepted is
+	// not served
+	if !ok || !strings.Contains(req.Header.Get("Accept"), MediaTypeManifest) {
+		writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+		return
+	}
+	w.Header().Set("Content-Type", MediaTypeManifest)
+	w.Header().Set("Docker-Content-Digest", manifestDigest)
+	w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+	if req.Method != "HEAD" {
+		w.Write(content)
+	}
+}
+
+func (r *Registry) serveBlob(w http.ResponseWriter, req *http.Request, blobDigest string) {
+	content, ok := r.blobs[blobDigest]
+	if !ok {
+		writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+		return
+	}
+	w.Header().Set("Docker-Content-Digest", blobDigest)
+	if req.Method != "HEAD" {
+		w.Write(content)
+	}
+}
+
+func writeError(w http.ResponseWriter, statusCode int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
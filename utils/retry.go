@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Default retry policy
+const (
+	DefaultRetryAttempts     = 5
+	DefaultRetryInitialDelay = time.Second
+	DefaultRetryMaxDelay     = 30 * time.Second
+)
+
+// RetryPolicy retries failing operations with an exponential backoff
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts, including the first one
+	Attempts int
+	// InitialDelay is the delay before the first retry, doubled after each
+	// retry up to MaxDelay. Delays are randomized between half and all of
+	// their value so that clients do not retry together.
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+
+	sleep  func(time.Duration)
+	random func(n int64) int64
+}
+
+// DefaultRetryPolicy returns the default retry policy
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		Attempts:     DefaultRetryAttempts,
+		InitialDelay: DefaultRetryInitialDelay,
+		MaxDelay:     DefaultRetryMaxDelay,
+	}
+}
+
+// RetryableError is a temporary error, RetryAfter is the minimum delay before
+// retrying when not zero
+type RetryableError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+// Retryable marks an error as temporary
+func Retryable(err error, retryAfter time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return RetryableError{Err: err, RetryAfter: retryAfter}
+}
+
+// Do calls fn until it succeeds, fails with an error which is not a
+// RetryableError, or the attempts are exhausted
+func (p *RetryPolicy) Do(fn func() error) error {
+	return p.DoContext(context.Background(), fn)
+}
+
+// DoContext is Do, giving up as soon as ctx is done, also while waiting to
+// retry
+func (p *RetryPolicy) DoContext(ctx context.Context, fn func() error) error {
+	attempts := p.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		retryableErr, ok := stacktrace.RootCause(err).(RetryableError)
+		if !ok {
+			return err
+		}
+		if attempt >= attempts {
+			return stacktrace.Propagate(retryableErr.Err, "Giving up after %d attempts", attempts)
+		}
+		if p.wait(ctx, p.delay(attempt, retryableErr.RetryAfter)) != nil {
+			return stacktrace.Propagate(retryableErr.Err, "Cancelled after %d attempt(s)", attempt)
+		}
+	}
+}
+
+// delay returns the delay before retrying after an attempt
+func (p *RetryPolicy) delay(attempt int, retryAfter time.Duration) time.Duration {
+	delay := p.InitialDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay > 1 {
+		random := rand.Int63n
+		if p.random != nil {
+			random = p.random
+		}
+		delay = delay/2 + time.Duration(random(int64(delay/2)+1))
+	}
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	return delay
+}
+
+// wait waits for delay, returning the error of ctx if it is done before
+func (p *RetryPolicy) wait(ctx context.Context, delay time.Duration) error {
+	if p.sleep != nil {
+		p.sleep(delay)
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// isRetryableStatus checks if a response status is worth retrying
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
+
+// isRetryableNetworkError checks if an error of an HTTP client is temporary,
+// errors like invalid certificates are not
+func isRetryableNetworkError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// parseRetryAfter reads a Retry-After header, given in seconds or as a date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// retryStatusError is the error of a response with a retryable status
+func retryStatusError(method, url string, statusCode int, header http.Header) error {
+	return Retryable(stacktrace.NewError("Unexpected status %d for %s %s", statusCode, method, url), parseRetryAfter(header.Get("Retry-After"), time.Now()))
+}
@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/anduintransaction/doriath/utils/registrytest"
+	"github.com/palantir/stacktrace"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type RetryTestSuite struct {
+	suite.Suite
+	delays []time.Duration
+}
+
+func (s *RetryTestSuite) SetupTest() {
+	s.delays = nil
+}
+
+// policy returns a policy recording its delays instead of sleeping, without
+// jitter
+func (s *RetryTestSuite) policy(attempts int) *RetryPolicy {
+	return &RetryPolicy{
+		Attempts:     attempts,
+		InitialDelay: time.Second,
+		MaxDelay:     4 * time.Second,
+		sleep: func(delay time.Duration) {
+			s.delays = append(s.delays, delay)
+		},
+		random: func(n int64) int64 {
+			return n - 1
+		},
+	}
+}
+
+func (s *RetryTestSuite) TestDo() {
+	calls := 0
+	err := s.policy(10).Do(func() error {
+		calls++
+		if calls < 6 {
+			return stacktrace.Propagate(Retryable(errors.New("busy"), 0), "Cannot call")
+		}
+		return nil
+	})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 6, calls)
+	require.Equal(s.T(), []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second, 4 * time.Second}, s.delays)
+}
+
+func (s *RetryTestSuite) TestDoGivesUp() {
+	calls := 0
+	busy := errors.New("busy")
+	err := s.policy(3).Do(func() error {
+		calls++
+		return Retryable(busy, 10*time.Second)
+	})
+	require.Equal(s.T(), busy, stacktrace.RootCause(err))
+	require.Equal(s.T(), 3, calls)
+	require.Equal(s.T(), []time.Duration{10 * time.Second, 10 * time.Second}, s.delays, "Retry-After must be honoured")
+
+	calls = 0
+	fatal := errors.New("fatal")
+	err = s.policy(3).Do(func() error {
+		calls++
+		return fatal
+	})
+	require.Equal(s.T(), fatal, err)
+	require.Equal(s.T(), 1, calls, "errors which are not retryable must not be retried")
+}
+
+func (s *RetryTestSuite) TestDoContext() {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	policy := &RetryPolicy{Attempts: 3, InitialDelay: time.Minute, MaxDelay: time.Minute}
+	calls := 0
+	busy := errors.New("busy")
+	begin := time.Now()
+	err := policy.DoContext(ctx, func() error {
+		calls++
+		return Retryable(busy, 0)
+	})
+	require.Equal(s.T(), busy, stacktrace.RootCause(err))
+	require.Equal(s.T(), 1, calls, "operations must not be retried once the context is done")
+	require.Less(s.T(), time.Since(begin), 10*time.Second, "waiting to retry must stop when the context is done")
+}
+
+func (s *RetryTestSuite) TestJitter() {
+	policy := &RetryPolicy{InitialDelay: 4 * time.Second, MaxDelay: time.Minute}
+	for i := 0; i < 100; i++ {
+		delay := policy.delay(2, 0)
+		require.True(s.T(), delay >= 4*time.Second && delay <= 8*time.Second, "delay %s out of range", delay)
+	}
+}
+
+func (s *RetryTestSuite) TestParseRetryAfter() {
+	now := time.Date(2019, 3, 14, 0, 0, 0, 0, time.UTC)
+	require.Equal(s.T(), 120*time.Second, parseRetryAfter("120", now))
+	require.Equal(s.T(), 30*time.Second, parseRetryAfter(now.Add(30*time.Second).Format(http.TimeFormat), now))
+	require.Equal(s.T(), time.Duration(0), parseRetryAfter("soon", now))
+	require.Equal(s.T(), time.Duration(0), parseRetryAfter("", now))
+}
+
+func (s *RetryTestSuite) TestRegistryRetry() {
+	server := registrytest.NewRegistry()
+	defer server.Close()
+	server.PutImage("anduin/elrond", "1.0", nil)
+	registry, err := NewRegistry(&DockerCredential{Registry: server.URL}, WithRetryPolicy(s.policy(3)))
+	require.Nil(s.T(), err)
+	server.FailNext(1, http.StatusBadGateway, "")
+	server.FailNext(1, http.StatusTooManyRequests, "7")
+	exists, _, err := registry.TagExists("anduin/elrond", "1.0")
+	require.Nil(s.T(), err)
+	require.True(s.T(), exists)
+	require.Equal(s.T(), []time.Duration{time.Second, 7 * time.Second}, s.delays)
+
+	server.FailNext(3, http.StatusServiceUnavailable, "")
+	_, _, err = registry.TagExists("anduin/elrond", "1.0")
+	require.NotNil(s.T(), err, "registry must give up after 3 attempts")
+	server.FailNext(1, http.StatusServiceUnavailable, "")
+	exists, _, err = registry.TagExists("anduin/elrond", "1.0")
+	require.Nil(s.T(), err)
+	require.True(s.T(), exists)
+}
+
+func (s *RetryTestSuite) TestRegistryContext() {
+	server := registrytest.NewRegistry()
+	defer server.Close()
+	server.PutImage("anduin/elrond", "1.0", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	policy := &RetryPolicy{Attempts: 3, InitialDelay: time.Minute, MaxDelay: time.Minute}
+	registry, err := NewRegistry(&DockerCredential{Registry: server.URL}, WithRetryPolicy(policy), WithContext(ctx))
+	require.Nil(s.T(), err)
+	server.FailNext(3, http.StatusServiceUnavailable, "")
+	begin := time.Now()
+	_, _, err = registry.TagExists("anduin/elrond", "1.0")
+	require.NotNil(s.T(), err)
+	require.Less(s.T(), time.Since(begin), 10*time.Second, "registry requests must not be retried once the context is done")
+}
+
+func (s *RetryTestSuite) TestRegistryTimeout() {
+	server := registrytest.NewRegistry()
+	defer server.Close()
+	server.Latency = 200 * time.Millisecond
+	registry, err := NewRegistry(&DockerCredential{Registry: server.URL}, WithTimeout(20*time.Millisecond), WithRetryPolicy(s.policy(2)))
+	require.Nil(s.T(), err)
+	_, _, err = registry.TagExists("anduin/elrond", "1.0")
+	require.NotNil(s.T(), err)
+	require.Len(s.T(), s.delays, 1, "timeouts must be retried")
+}
+
+func TestRetry(t *testing.T) {
+	suite.Run(t, new(RetryTestSuite))
+}
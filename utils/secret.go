@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SecretMask replaces secrets in doriath output
+const SecretMask = "****"
+
+// minSecretLength is the minimum length of the lines of multiline secrets
+// masked by themselves. Shorter lines, like braces or the end of a key, would
+// mask unrelated output.
+const minSecretLength = 8
+
+// secrets holds the values masked in doriath output
+var secrets = struct {
+	sync.RWMutex
+	values   StringSet
+	replacer *strings.Replacer
+}{values: make(StringSet)}
+
+// AddSecret registers values to mask in all doriath output: log messages,
+// errors and the output of subprocesses. The lines of a multiline value are
+// masked too, since subprocess output is masked line by line, unless they are
+// shorter than minSecretLength.
+func AddSecret(values ...string) {
+	secrets.Lock()
+	defer secrets.Unlock()
+	added := false
+	add := func(secret string) {
+		if secret == "" || secrets.values.Exists(secret) {
+			return
+		}
+		secrets.values.Add(secret)
+		added = true
+	}
+	for _, value := range values {
+		secret := strings.TrimSpace(value)
+		add(secret)
+		if !strings.Contains(secret, "\n") {
+			continue
+		}
+		for _, line := range strings.Split(secret, "\n") {
+			if line = strings.TrimSpace(line); len(line) >= minSecretLength {
+				add(line)
+			}
+		}
+	}
+	if !added {
+		return
+	}
+	// Longer secrets first, so that a secret containing another one is
+	// masked as a whole
+	sorted := make([]string, 0, len(secrets.values))
+	for secret := range secrets.values {
+		sorted = append(sorted, secret)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i]) != len(sorted[j]) {
+			return len(sorted[i]) > len(sorted[j])
+		}
+		return sorted[i] < sorted[j]
+	})
+	oldNew := make([]string, 0, 2*len(sorted))
+	for _, secret := range sorted {
+		oldNew = append(oldNew, secret, SecretMask)
+	}
+	secrets.replacer = strings.NewReplacer(oldNew...)
+}
+
+// AddCredentialSecret registers the secrets of a credential, including the
+// basic authorization sent to registries
+func AddCredentialSecret(username, password string) {
+	if password == "" {
+		return
+	}
+	AddSecret(password, base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+}
+
+// Mask replaces the registered secrets in s
+func Mask(s string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	if secrets.replacer == nil {
+		return s
+	}
+	return secrets.replacer.Replace(s)
+}
+
+// MaskingWriter masks secrets in what is written to the underlying writer.
+// Lines, ended by \n or \r, are buffered until complete so that a secret
+// split over several writes is still masked.
+type MaskingWriter struct {
+	w      io.Writer
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+// NewMaskingWriter creates a new MaskingWriter
+func NewMaskingWriter(w io.Writer) *MaskingWriter {
+	return &MaskingWriter{w: w}
+}
+
+// Write implements io.Writer
+func (m *MaskingWriter) Write(data []byte) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.buffer.Write(data)
+	for {
+		line := m.buffer.Bytes()
+		idx := bytes.IndexAny(line, "\n\r")
+		if idx < 0 {
+			break
+		}
+		_, err := io.WriteString(m.w, Mask(string(line[:idx+1])))
+		m.buffer.Next(idx + 1)
+		if err != nil {
+			return len(data), err
+		}
+	}
+	return len(data), nil
+}
+
+// Flush writes any incomplete line left in the buffer
+func (m *MaskingWriter) Flush() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.buffer.Len() == 0 {
+		return nil
+	}
+	_, err := io.WriteString(m.w, Mask(m.buffer.String()))
+	m.buffer.Reset()
+	return err
+}
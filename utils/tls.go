@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// loadTLSConfig creates a TLS config trusting the system CAs and the CA of
+// caFile, presenting the client certificate of certFile and keyFile. Empty
+// files are ignored.
+func loadTLSConfig(caFile, certFile, keyFile string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "Cannot read CA certificate %q", caFile)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, stacktrace.NewError("Invalid CA certificate in %q", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "Cannot read client certificate %q and key %q", certFile, keyFile)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// registryClients holds the HTTP clients of registries by TLS settings and
+// timeout, so that registries share connections
+var registryClients = struct {
+	sync.Mutex
+	clients map[string]*http.Client
+}{clients: make(map[string]*http.Client)}
+
+// registryClient returns the HTTP client of a registry, using the TLS settings
+// of the credential and the proxy set in HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+func registryClient(credential *DockerCredential, timeout time.Duration) (*http.Client, error) {
+	key := fmt.Sprintf("%s|%s|%s|%t|%s", credential.CAFile, credential.ClientCert, credential.ClientKey, credential.Insecure, timeout)
+	registryClients.Lock()
+	defer registryClients.Unlock()
+	if client, ok := registryClients.clients[key]; ok {
+		return client, nil
+	}
+	tlsConfig, err := loadTLSConfig(credential.CAFile, credential.ClientCert, credential.ClientKey, credential.Insecure)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.TLSClientConfig = tlsConfig
+	client := &http.Client{Transport: transport, Timeout: timeout}
+	registryClients.clients[key] = client
+	return client, nil
+}
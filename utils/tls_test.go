@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anduintransaction/doriath/utils/registrytest"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type TLSTestSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (s *TLSTestSuite) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "doriath-tls")
+	require.Nil(s.T(), err)
+}
+
+func (s *TLSTestSuite) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *TLSTestSuite) writeFile(name string, content []byte) string {
+	filename := filepath.Join(s.dir, name)
+	err := ioutil.WriteFile(filename, content, 0600)
+	require.Nil(s.T(), err)
+	return filename
+}
+
+// clientCertificate creates a self-signed client certificate, returning its
+// certificate and key files
+func (s *TLSTestSuite) clientCertificate() (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(s.T(), err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "doriath"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	certContent, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(s.T(), err)
+	cert, err := x509.ParseCertificate(certContent)
+	require.Nil(s.T(), err)
+	keyContent, err := x509.MarshalECPrivateKey(key)
+	require.Nil(s.T(), err)
+	certFile := s.writeFile("client.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certContent}))
+	keyFile := s.writeFile("client-key.pem", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyContent}))
+	return cert, certFile, keyFile
+}
+
+func (s *TLSTestSuite) tagExists(credential *DockerCredential) error {
+	registry, err := NewRegistry(credential)
+	require.Nil(s.T(), err)
+	_, _, err = registry.TagExists("anduin/elrond", "1.0")
+	return err
+}
+
+func (s *TLSTestSuite) TestCAFile() {
+	server := registrytest.NewTLSRegistry(nil)
+	defer server.Close()
+	caFile := s.writeFile("ca.pem", server.CACertificate())
+	err := s.tagExists(&DockerCredential{Registry: server.URL})
+	require.NotNil(s.T(), err, "unknown CA must be rejected")
+	err = s.tagExists(&DockerCredential{Registry: server.URL, CAFile: caFile})
+	require.Nil(s.T(), err)
+	err = s.tagExists(&DockerCredential{Registry: server.URL, Insecure: true})
+	require.Nil(s.T(), err)
+}
+
+func (s *TLSTestSuite) TestClientCertificate() {
+	cert, certFile, keyFile := s.clientCertificate()
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	server := registrytest.NewTLSRegistry(clientCAs)
+	defer server.Close()
+	caFile := s.writeFile("ca.pem", server.CACertificate())
+	err := s.tagExists(&DockerCredential{Registry: server.URL, CAFile: caFile})
+	require.NotNil(s.T(), err, "client certificate must be required")
+	err = s.tagExists(&DockerCredential{Registry: server.URL, CAFile: caFile, ClientCert: certFile, ClientKey: keyFile})
+	require.Nil(s.T(), err)
+}
+
+func (s *TLSTestSuite) TestInvalidFiles() {
+	_, err := NewRegistry(&DockerCredential{CAFile: filepath.Join(s.dir, "missing.pem")})
+	require.NotNil(s.T(), err)
+	_, err = NewRegistry(&DockerCredential{CAFile: s.writeFile("invalid.pem", []byte("not a certificate"))})
+	require.NotNil(s.T(), err)
+	_, err = NewRegistry(&DockerCredential{ClientCert: filepath.Join(s.dir, "missing.pem")})
+	require.NotNil(s.T(), err)
+}
+
+func TestTLS(t *testing.T) {
+	suite.Run(t, new(TLSTestSuite))
+}